@@ -34,6 +34,15 @@ func (pw Pairwise) BasicMessage(ctx context.Context, content string) (pid *agenc
 	return pw.Conn.DoStart(ctx, protocol, pw.cOpts...)
 }
 
+func (pw Pairwise) Ping(ctx context.Context) (pid *agency.ProtocolID, err error) {
+	protocol := &agency.Protocol{
+		ConnectionID: pw.ID,
+		TypeID:       agency.Protocol_TRUST_PING,
+		Role:         agency.Protocol_INITIATOR,
+	}
+	return pw.Conn.DoStart(ctx, protocol, pw.cOpts...)
+}
+
 func (pw Pairwise) Issue(ctx context.Context, credDefID, attrsJSON string) (pid *agency.ProtocolID, err error) {
 	protocol := &agency.Protocol{
 		ConnectionID: pw.ID,
@@ -138,6 +147,30 @@ func (pw Pairwise) ReqProofWithAttrs(ctx context.Context, proofAttrs *agency.Pro
 	return pw.Conn.DoStart(ctx, protocol, pw.cOpts...)
 }
 
+// ReqProofWithPredicates requests the proof of the attributes and the
+// predicates. Both are optional, but one of them is needed.
+func (pw Pairwise) ReqProofWithPredicates(
+	ctx context.Context,
+	proofAttrs *agency.Protocol_Proof,
+	predicates *agency.Protocol_Predicates,
+) (
+	pid *agency.ProtocolID,
+	err error,
+) {
+	protocol := &agency.Protocol{
+		ConnectionID: pw.ID,
+		TypeID:       agency.Protocol_PRESENT_PROOF,
+		Role:         agency.Protocol_INITIATOR,
+		StartMsg: &agency.Protocol_PresentProof{
+			PresentProof: &agency.Protocol_PresentProofMsg{
+				AttrFmt: &agency.Protocol_PresentProofMsg_Attributes{
+					Attributes: proofAttrs},
+				PredFmt: &agency.Protocol_PresentProofMsg_Predicates{
+					Predicates: predicates}}},
+	}
+	return pw.Conn.DoStart(ctx, protocol, pw.cOpts...)
+}
+
 func (pw Pairwise) ProposeProof(ctx context.Context, proofAttrs string) (pid *agency.ProtocolID, err error) {
 	protocol := &agency.Protocol{
 		ConnectionID: pw.ID,
@@ -11,6 +11,7 @@ import (
 	"github.com/findy-network/findy-common-go/agency/client"
 	"github.com/findy-network/findy-common-go/agency/client/chat/chat"
 	"github.com/findy-network/findy-common-go/agency/fsm"
+	"github.com/findy-network/findy-common-go/crypto/db"
 	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
 	"github.com/findy-network/findy-common-go/utils"
 	"github.com/ghodss/yaml"
@@ -28,6 +29,25 @@ type Bot struct {
 	// They send messages to it and it send messages back to them. It has its
 	// own memory to store data.
 	ServiceFSM *fsm.MachineData
+
+	// ServiceFSMs are the optional named backend FSMs, e.g. an audit
+	// collector and a room broker. Each of them runs in its own goroutine,
+	// and the conversation FSMs address them with the service of the backend
+	// send. The ServiceFSM is the default one, which has no name.
+	ServiceFSMs map[string]*fsm.MachineData
+
+	// Store is optional. If it's set the conversations are persisted to it
+	// and they continue where they were after the bot is restarted.
+	Store *chat.Store
+
+	// DB is optional. If it's set it backs the persistent DB register of the
+	// Lua scripts and the rooms of the service FSM. The database must have
+	// fsm.RegisterBucket, and fsm.RoomBucket if the service FSM uses rooms.
+	DB db.Handle
+
+	// Mailer is optional. It delivers the emails of the email send protocol,
+	// see the mail package.
+	Mailer chat.Mailer
 }
 
 func LoadFSMMachineData(fName string, r io.Reader) (m fsm.MachineData, err error) {
@@ -51,6 +71,7 @@ func loadFSMData(fName string, data []byte) *fsm.Machine {
 	} else {
 		try.To(yaml.Unmarshal(data, &machine))
 	}
+	try.To(machine.ResolveIncludes(filepath.Dir(fName)))
 	return &machine
 }
 
@@ -85,6 +106,10 @@ func (b Bot) Run(intCh chan os.Signal) {
 		InterruptCh:         intCh,
 		ConversationMachine: b.MachineData,
 		BackendMachine:      b.ServiceFSM,
+		BackendMachines:     b.ServiceFSMs,
+		Store:               b.Store,
+		DB:                  b.DB,
+		Mailer:              b.Mailer,
 	})
 
 loop:
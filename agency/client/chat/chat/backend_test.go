@@ -0,0 +1,143 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/findy-network/findy-common-go/agency/fsm"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestBackend_services(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	termChan := make(fsm.TerminateChan, 1)
+	def := newBackendService(MultiplexerInfo{}, "", termChan)
+	audit := newBackendService(MultiplexerInfo{}, "audit", termChan)
+	defer func() {
+		delete(backendMachines, "")
+		delete(backendMachines, "audit")
+	}()
+
+	c := &Conversation{id: "conn"}
+	c.sendBackend(&fsm.BackendData{Content: "log", Service: "audit"}, false)
+	assert.Equal(len(audit.BackendChan), 1)
+	assert.Equal(len(def.BackendChan), 0)
+	d := <-audit.BackendChan
+	assert.Equal(d.ConnID, "conn")
+
+	c.sendBackend(&fsm.BackendData{Content: "hi"}, false)
+	assert.Equal(len(def.BackendChan), 1)
+	<-def.BackendChan
+
+	// unknown services are only logged
+	c.sendBackend(&fsm.BackendData{Content: "hi", Service: "nobody"}, false)
+	assert.Equal(len(def.BackendChan), 0)
+	assert.Equal(len(audit.BackendChan), 0)
+
+	// the rooms are backend's own, and the data tells its service
+	conn := addTestConversation("conn")
+	other := addTestConversation("other")
+	defer func() {
+		delete(conversations, "conn")
+		delete(conversations, "other")
+	}()
+	route := func(b *Backend, data *fsm.BackendData) {
+		b.sendBackendData(data, false)
+		routeBackendData(<-ConversationBackendChan)
+	}
+	def.router = fsm.NewRouter(nil)
+	audit.router = fsm.NewRouter(nil)
+	audit.router.Join("lobby", "conn")
+	route(audit, &fsm.BackendData{Route: fsm.RouteRoom,
+		Subject: "lobby", Content: "room"})
+	d = <-conn.BackendChan
+	assert.Equal(d.ConnID, "conn")
+	assert.Equal(d.Service, "audit")
+	assert.Equal(len(other.BackendChan), 0)
+	route(def, &fsm.BackendData{Route: fsm.RouteRoom,
+		Subject: "lobby", Content: "room"})
+	assert.Equal(len(conn.BackendChan), 0)
+
+	route(def, &fsm.BackendData{Route: fsm.RouteAll, Content: "all", ConnID: "conn"})
+	for _, c := range []*Conversation{conn, other} {
+		d = <-c.BackendChan
+		assert.Equal(d.Content, "all")
+		assert.Equal(d.ConnID, "conn") // for the no echo
+	}
+
+	// the sends without ConnID, e.g. by the timer, are for all
+	route(def, &fsm.BackendData{Content: "tick"})
+	assert.Equal((<-conn.BackendChan).Content, "tick")
+	assert.Equal((<-other.BackendChan).Content, "tick")
+}
+
+// echoBackendYAML is the backend machine written before the routes. Its
+// answers were delivered to all the conversations, which filtered them by
+// the SessionID.
+const echoBackendYAML = `
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: backend
+        rule: INPUT_SAVE
+        data: LINE
+      sends:
+      - protocol: backend
+        rule: FORMAT_MEM
+        data: "echo: {{.LINE}}"
+      target: IDLE
+`
+
+func TestBackend_machineWithoutRoutes(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	b := newBackendService(MultiplexerInfo{}, "", make(fsm.TerminateChan, 1))
+	a := addTestConversation("a")
+	other := addTestConversation("b")
+	defer func() {
+		delete(backendMachines, "")
+		delete(conversations, "a")
+		delete(conversations, "b")
+	}()
+	b.machine = fsm.NewBackendMachine(fsm.MachineData{FType: "echo.yaml",
+		Data: []byte(echoBackendYAML)})
+	try.To(b.machine.Initialize())
+	b.machine.InitLua()
+	b.machine.Start(nil)
+	b.router = fsm.NewRouter(nil)
+
+	// now the answer goes only to the sender, the others must use the all
+	// route to get it
+	b.backendReceived(&fsm.BackendData{ConnID: "a", SessionID: "s", Content: "hi"})
+	routeBackendData(<-ConversationBackendChan)
+	d := <-a.BackendChan
+	assert.Equal(d.Content, "echo: hi")
+	assert.Equal(d.SessionID, "s")
+	assert.Equal(len(other.BackendChan), 0)
+}
+
+func addTestConversation(connID string) *Conversation {
+	c := &Conversation{id: connID, BackendChan: make(fsm.BackendChan, 2)}
+	conversations[connID] = c
+	return c
+}
+
+func TestConversation_forwardBackendData(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	c := &Conversation{id: "conn", BackendChan: make(fsm.BackendChan, 3)}
+	for _, content := range []string{"1", "2", "3", "4", "5"} {
+		// the queue is full after three, but the multiplexer isn't blocked
+		c.forwardBackendData(&fsm.BackendData{Content: content})
+	}
+	assert.Equal(len(c.BackendChan), 3)
+	for _, content := range []string{"1", "2", "3"} {
+		assert.Equal((<-c.BackendChan).Content, content)
+	}
+	c.forwardBackendData(&fsm.BackendData{Content: "6"})
+	assert.Equal((<-c.BackendChan).Content, "6")
+}
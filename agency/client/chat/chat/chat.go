@@ -1,13 +1,18 @@
 package chat
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"os"
+	"sort"
 	"syscall"
 
 	"github.com/findy-network/findy-common-go/agency/client"
 	"github.com/findy-network/findy-common-go/agency/client/async"
 	"github.com/findy-network/findy-common-go/agency/fsm"
+	"github.com/findy-network/findy-common-go/crypto"
+	"github.com/findy-network/findy-common-go/crypto/db"
 	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
 	"github.com/golang/glog"
 	"github.com/lainio/err2/assert"
@@ -24,15 +29,43 @@ type QuestionChan chan QuestionStatus
 
 type HookChan chan map[string]string
 
+// Mailer delivers the emails of the FSM's email send protocol. See the mail
+// package for the implementations.
+type Mailer interface {
+	Send(email *fsm.Email) error
+}
+
 // Backend is optional state-machine for service level. We use backend name
 // because service is too generic and we want to underline that Conversations
-// are in the front and backend has our back!
+// are in the front and backend has our back! Every backend runs in its own
+// goroutine, see Run.
 type Backend struct {
 	fsm.TerminateChan // FSM tells us if machine has reached the end.
 	fsm.BackendChan
+	TransientChan fsm.TransientChan
+	TimerChan     fsm.TimerChan
+
+	// name is the service name of the backend, empty for the default one.
+	name string
+	client.Conn
 
 	// machine can be ptr because multiplexer creates a new for each one
 	machine *fsm.Machine
+
+	// router routes the backend's data to the conversations in the
+	// multiplexer, and the backend updates it. Every backend has its own
+	// rooms, which are the machine's Rooms. They are set before Run.
+	router *fsm.Router
+	rooms  *fsm.Rooms
+
+	// db is optional, it backs the DB register and the rooms of the machine.
+	// The cipher encrypts their values, see MultiplexerInfo.
+	db     db.Handle
+	cipher *crypto.Cipher
+
+	// mailer is optional like with the conversations, see emailFailed.
+	mailer    Mailer
+	emailChan chan error
 }
 
 type Conversation struct {
@@ -42,6 +75,7 @@ type Conversation struct {
 	fsm.TerminateChan // FSM tells us if machine has reached the end.
 	fsm.BackendChan
 	TransientChan fsm.TransientChan
+	TimerChan     fsm.TimerChan
 
 	id string
 	client.Conn
@@ -49,11 +83,32 @@ type Conversation struct {
 
 	// machine can be ptr because multiplexer creates a new for each one
 	machine *fsm.Machine
+
+	// store is optional, and if it's set the machine's snapshot is saved
+	// after every event. snapshot is set when conversation is restored.
+	store    *Store
+	snapshot *fsm.Snapshot
+	// saved is the last saved snapshot that unchanged ones aren't saved
+	// again, and deleted tells that the terminated one is already deleted.
+	saved   []byte
+	deleted bool
+
+	// db is optional, it backs the DB register of the machine. The cipher
+	// encrypts its values, see MultiplexerInfo.
+	db     db.Handle
+	cipher *crypto.Cipher
+
+	// mailer is optional, without it emails are only logged. emailChan
+	// receives the delivery results as events, see sendMail.
+	mailer    Mailer
+	emailChan chan error
 }
 
 // These are class level variables for this chat bot which means that every
 // conversation of this bot will share these variables
 var (
+	// ConversationBackendChan transports the backends' data to the
+	// conversations through the multiplexer, which owns the conversations.
 	ConversationBackendChan = make(fsm.BackendChan, 1)
 
 	// Status is input channel for multiplexing this chat bot i.e. CA sends
@@ -71,9 +126,10 @@ var (
 	// processes the map.
 	conversations = make(map[string]*Conversation)
 
-	// backendMachine is the only instance needed, if needed, i.e. 0..1
-	// created by function RunBackendService.
-	backendMachine *Backend
+	// backendMachines are the backends indexed by their service names. The
+	// default backend has the empty name. The map is filled before any
+	// conversation is started, and after that it's only read.
+	backendMachines = make(map[string]*Backend)
 
 	// SharedMem is memory register to be shared between all conversations.
 	// It can be used e.g. gather information.. not sure if this is needed.
@@ -85,12 +141,26 @@ var (
 	Hook HookFn
 )
 
-func newBackendService() *Backend {
-	backendMachine = &Backend{
-		TerminateChan: make(chan bool),
+func newBackendService(
+	info MultiplexerInfo,
+	name string,
+	termChan fsm.TerminateChan,
+) *Backend {
+	b := &Backend{
+		TerminateChan: termChan,
 		BackendChan:   make(fsm.BackendChan, 1),
+		TransientChan: make(fsm.TransientChan, 1),
+		TimerChan:     make(fsm.TimerChan, 1),
+
+		name:      name,
+		Conn:      info.Conn,
+		db:        info.DB,
+		cipher:    info.dbCipher(),
+		mailer:    info.Mailer,
+		emailChan: make(chan error, 1),
 	}
-	return backendMachine
+	backendMachines[name] = b
+	return b
 }
 
 type MultiplexerInfo struct {
@@ -98,6 +168,37 @@ type MultiplexerInfo struct {
 	InterruptCh         chan<- os.Signal
 	ConversationMachine fsm.MachineData
 	BackendMachine      *fsm.MachineData
+
+	// BackendMachines are the optional named backend machines. The
+	// conversations address them with the service of the backend send, and
+	// the BackendMachine is the default one without the name.
+	BackendMachines map[string]*fsm.MachineData
+
+	// Store is optional. When it's given, conversations are saved to it and
+	// restored from it when the multiplexer is started.
+	Store *Store
+
+	// DB is optional. When it's given, it backs the DB register of the
+	// machines' Lua scripts, and it persists the backend machine's rooms.
+	// Remember to add fsm.RegisterBucket to it, and fsm.RoomBucket if the
+	// backend machine uses the ROOM_ rules.
+	DB db.Handle
+
+	// Cipher is optional. It encrypts the values of the DB like the Store's
+	// cipher does the snapshots, and the Store's cipher is used if it isn't
+	// given. Without them the DB must take care of the encryption itself.
+	Cipher *crypto.Cipher
+
+	// Mailer is optional. It delivers the emails sent by the conversations.
+	Mailer Mailer
+}
+
+// dbCipher returns the cipher of the DB's values, see Cipher.
+func (info MultiplexerInfo) dbCipher() *crypto.Cipher {
+	if info.Cipher == nil && info.Store != nil {
+		return info.Store.cipher
+	}
+	return info.Cipher
 }
 
 // Multiplexer is a goroutine function to started multiplex all the
@@ -109,44 +210,30 @@ func Multiplexer(info MultiplexerInfo) {
 	glog.V(3).Infoln("starting multiplexer", info.ConversationMachine.FType)
 	termChan := make(fsm.TerminateChan, 1)
 
-	var backendChan fsm.BackendInChan
-	if info.BackendMachine.IsValid() {
-		b := newBackendService()
-		backendChan = b.BackendChan
-		b.machine = fsm.NewBackendMachine(*info.BackendMachine)
-		try.To(b.machine.Initialize())
-		b.machine.InitLua()
-
-		glog.V(2).Infoln("starting and send first step:", info.BackendMachine.FType)
-		b.send(b.machine.Start(fsm.TerminateOutChan(b.TerminateChan)))
-		glog.V(2).Infoln("going to for loop:", info.BackendMachine.FType)
-	}
+	// the includes are read once, not for every conversation
+	info.ConversationMachine = try.To1(info.ConversationMachine.ResolveIncludes())
+	checkIssuings(info.Conn, fsm.NewMachine(info.ConversationMachine))
+	startBackends(info, termChan)
+	restoreConversations(info, termChan)
 
 	for {
 		select {
-		// we serve backendMachine here if we have a REAL channel, see above
-		// NOTE. It's OK to listen nil channel (especially) in select.
-		case bd := <-backendChan:
-			backendMachine.backendReceived(bd)
-
 		case d := <-ConversationBackendChan:
-			c, ok := conversations[d.ConnID]
-			assert.That(ok, "backend msgs to existing conversations only")
-			c.BackendChan <- d
+			routeBackendData(d)
 		case t := <-Status:
 			connID := t.Notification.ConnectionID
 			c, ok := conversations[connID]
 			if !ok {
-				c = newConversation(info, connID, termChan)
+				c = newConversation(info, connID, termChan, nil)
 			}
-			c.StatusChan <- t
+			enqueue(c.StatusChan, t, c.id, "status")
 		case question := <-Question:
 			connID := question.Status.Notification.ConnectionID
 			c, ok := conversations[connID]
 			if !ok {
-				c = newConversation(info, connID, termChan)
+				c = newConversation(info, connID, termChan, nil)
 			}
-			c.QuestionChan <- question
+			enqueue(c.QuestionChan, question, c.id, "question")
 		case <-termChan:
 			// One machine has reached its terminate state. Let's signal
 			// outside that the whole system is ready to stop.
@@ -166,37 +253,222 @@ func Multiplexer(info MultiplexerInfo) {
 	}
 }
 
+// startBackends starts the default and the named backend machines in their
+// own goroutines.
+func startBackends(info MultiplexerInfo, termChan fsm.TerminateChan) {
+	if info.BackendMachine.IsValid() {
+		startBackend(info, "", info.BackendMachine, termChan)
+	}
+	for name, data := range info.BackendMachines {
+		if name == "" {
+			glog.Warningln("backend machine without name, use BackendMachine")
+			continue
+		}
+		if !data.IsValid() {
+			glog.Warningln("invalid backend machine:", name)
+			continue
+		}
+		startBackend(info, name, data, termChan)
+	}
+}
+
+// startBackend starts the backend machine. Its rooms are created before, that
+// the multiplexer can route the backend's data with them, see
+// routeBackendData.
+func startBackend(
+	info MultiplexerInfo,
+	name string,
+	data *fsm.MachineData,
+	termChan fsm.TerminateChan,
+) {
+	md := try.To1(data.ResolveIncludes())
+	m := fsm.NewBackendMachine(md)
+	checkIssuings(info.Conn, m)
+	b := newBackendService(info, name, termChan)
+	b.rooms = newRooms(info.DB, info.dbCipher(), m, md)
+	b.router = fsm.NewRouter(b.rooms)
+	go b.Run(md)
+}
+
+// routeBackendData routes the backend's data to the conversations with the
+// router of the backend, see fsm.Router.Receivers. Every conversation gets its
+// own copy of the data, because the receivers write to it.
+func routeBackendData(data *fsm.BackendData) {
+	b, ok := backendMachines[data.Service]
+	if !ok {
+		glog.Warningln("b-fsm: no backend machine:", data.Service)
+		return
+	}
+	connIDs, all := b.router.Receivers(data)
+	if all {
+		for _, c := range conversations {
+			d := *data
+			c.forwardBackendData(&d)
+		}
+		return
+	}
+	for _, connID := range connIDs {
+		c, ok := conversations[connID]
+		if !ok {
+			glog.Warningln("b-fsm: no conversation for", connID)
+			continue
+		}
+		d := *data
+		d.ConnID = connID
+		c.forwardBackendData(&d)
+	}
+}
+
+// checkIssuings checks the structured issuing sends of the machine against
+// the cred defs of the agency. It's done once at the startup, not for every
+// conversation, and the multiplexer doesn't start if the check fails, e.g.
+// the cred def isn't found.
+func checkIssuings(conn client.Conn, m *fsm.Machine) {
+	try.To(m.Initialize())
+	try.To(m.CheckIssuings(NewCredDefs(conn)))
+}
+
+// restoreConversations starts conversations for all the snapshots in the
+// store. Conversations continue from the state they were when saved.
+func restoreConversations(info MultiplexerInfo, termChan fsm.TerminateChan) {
+	if info.Store == nil {
+		return
+	}
+	snaps, err := info.Store.LoadAll()
+	if err != nil {
+		glog.Errorln("cannot restore conversations:", err)
+		return
+	}
+	for _, snap := range snaps {
+		if snap.ConnID == "" {
+			glog.Warningln("snapshot without connection ID, skipping")
+			continue
+		}
+		glog.V(1).Infoln("restoring conversation:", snap.ConnID)
+		newConversation(info, snap.ConnID, termChan, snap)
+	}
+}
+
+// conversationQueueLen is the length of the conversation's input queues
+// which the multiplexer fills, see enqueue.
+const conversationQueueLen = 64
+
+// enqueue puts the input to the conversation's queue in order without
+// blocking the multiplexer. The conversation can be waiting for the backend,
+// which waits for the multiplexer, and the multiplexer mustn't wait for the
+// conversation then. If the queue is full, the input is dropped and logged.
+func enqueue[T any](queue chan T, input T, connID, what string) {
+	select {
+	case queue <- input:
+	default:
+		glog.Errorf("conversation (%s) queue full, %s dropped", connID, what)
+	}
+}
+
 func newConversation(
 	info MultiplexerInfo,
 	connID string,
 	termChan fsm.TerminateChan,
+	snap *fsm.Snapshot,
 ) *Conversation {
 	glog.V(5).Infoln("Starting new conversation",
 		info.ConversationMachine.FType)
 	c := &Conversation{
 		id:            connID,
 		Conn:          info.Conn,
-		StatusChan:    make(StatusChan),
-		QuestionChan:  make(QuestionChan),
+		StatusChan:    make(StatusChan, conversationQueueLen),
+		QuestionChan:  make(QuestionChan, conversationQueueLen),
 		HookChan:      make(HookChan),
-		BackendChan:   make(fsm.BackendChan, 1),
+		BackendChan:   make(fsm.BackendChan, conversationQueueLen),
 		TransientChan: make(fsm.TransientChan, 1),
+		TimerChan:     make(fsm.TimerChan, 1),
 		TerminateChan: termChan,
+
+		store:     info.Store,
+		db:        info.DB,
+		cipher:    info.dbCipher(),
+		mailer:    info.Mailer,
+		emailChan: make(chan error, 1),
+		snapshot:  snap,
 	}
 	conversations[connID] = c
 	go c.Run(info.ConversationMachine)
 	return c
 }
 
+// Run runs the backend machine. It serves the backend's own channels, and the
+// conversations are reached through the multiplexer, see sendBackendData.
+func (b *Backend) Run(data fsm.MachineData) {
+	b.machine = fsm.NewBackendMachine(data)
+	try.To(b.machine.Initialize())
+	b.machine.DB = newDBRegister(b.db, b.cipher, b.machine, data)
+	if b.rooms == nil {
+		b.rooms = newRooms(b.db, b.cipher, b.machine, data)
+		b.router = fsm.NewRouter(b.rooms)
+	}
+	b.machine.Rooms = b.rooms
+	b.machine.InitLua()
+	b.machine.SetTimerChan(b.TimerChan)
+	b.machine.Inviter = NewInviter(b.Conn)
+
+	glog.V(2).Infoln("starting and send first step:", data.FType)
+	b.send(b.machine.Start(fsm.TerminateOutChan(b.TerminateChan)))
+	glog.V(2).Infoln("going to for loop:", data.FType)
+
+	for {
+		select {
+		case bd := <-b.BackendChan:
+			b.router.Update(bd)
+			b.backendReceived(bd)
+		case stepData := <-b.TransientChan:
+			b.stepReceived(stepData)
+		case td := <-b.TimerChan:
+			b.timerReceived(td)
+		case err := <-b.emailChan:
+			b.emailFailed(err)
+		}
+	}
+}
+
 func (b *Backend) backendReceived(data *fsm.BackendData) {
 	glog.V(2).Infof("+++ b-fsm data(%v):%v", data, b.machine.Type)
 	assert.Equal(b.machine.Type, fsm.MachineTypeBackend)
 	if transition := b.machine.TriggersByBackendData(data); transition != nil {
 		b.send(transition.BuildSendEventsFromBackendData(data))
-		b.machine.Step(transition)
+		b.send(b.machine.Step(transition))
+	}
+}
+
+func (b *Backend) timerReceived(td *fsm.TimerData) {
+	glog.V(3).Infoln("b-fsm: timer expired in:", b.machine.Current)
+	if transition := b.machine.TriggersByTimer(td); transition != nil {
+		b.send(transition.BuildSendEventsFromTimer())
+		b.send(b.machine.Step(transition))
 	}
 }
 
+func (b *Backend) stepReceived(data string) {
+	glog.V(3).Infoln("b-fsm: step w/ str:", data)
+	if transition := b.machine.TriggersByStep(); transition != nil {
+		b.send(transition.BuildSendEventsFromStep(data))
+		b.send(b.machine.Step(transition))
+	}
+}
+
+// emailFailed routes the delivery error back to the machine like the
+// conversations do.
+func (b *Backend) emailFailed(err error) {
+	if err == nil {
+		return
+	}
+	if transition := b.machine.TriggersByEmailError(err); transition != nil {
+		b.send(transition.BuildSendEventsFromEmailError(err))
+		b.send(b.machine.Step(transition))
+	}
+}
+
+// send sends the outputs of the backend machine. It doesn't have a
+// connection, so the sends that need one are only logged.
 func (b *Backend) send(outputs []*fsm.Event) {
 	if outputs == nil {
 		return
@@ -205,23 +477,57 @@ func (b *Backend) send(outputs []*fsm.Event) {
 		switch output.ProtocolType {
 		case fsm.BackendProtocol:
 			b.sendBackendData(output.EventData.Backend, false)
+		case fsm.EmailProtocol:
+			b.sendEmail(output.Email, output.WantStatus)
+		case fsm.HookProtocol:
+			glog.V(3).Infoln("b-fsm: calling hook")
+			callHook(output.Hook.Data)
+		case fsm.TransientProtocol:
+			b.TransientChan <- output.BasicMessage.Content
+		case agency.Protocol_DIDEXCHANGE:
+			// the invitation is already created by the machine's Inviter
+			glog.V(3).Infoln("invitation created:", output.Invitation != nil)
+		default:
+			glog.Warningf("b-fsm cannot send %s without connection",
+				output.Protocol)
 		}
 	}
 }
 
+func (b *Backend) sendEmail(message *fsm.Email, _ bool) {
+	if b.mailer == nil {
+		glog.Warningln("no mailer, cannot send email to", message.To)
+		return
+	}
+	glog.V(1).Infoln("b-fsm: sending email to", message.To)
+	sendMail(b.mailer, message, b.emailChan)
+}
+
+// sendBackendData sends the data to the multiplexer, which routes it to the
+// conversations, see routeBackendData. The backend's join and leave routes
+// only update the router.
 func (b *Backend) sendBackendData(data *fsm.BackendData, _ bool) {
-	for _, conversation := range conversations {
-		glog.V(2).Infof("b-fsm-> BackendData:%v", data)
-		conversation.BackendChan <- data
+	glog.V(2).Infof("b-fsm(%s)-> BackendData:%v", b.name, data)
+	data.Service = b.name
+	if b.router.Update(data) {
+		return
 	}
+	d := *data // the send events are reused
+	ConversationBackendChan <- &d
 }
 
 func (c *Conversation) Run(data fsm.MachineData) {
 	c.machine = fsm.NewMachine(data)
 	try.To(c.machine.Initialize())
 	c.machine.ConnID = c.id // conversation machines need ConnectionID
+	c.machine.DB = newDBRegister(c.db, c.cipher, c.machine, data)
 	c.machine.InitLua()
-	c.send(c.machine.Start(fsm.TerminateOutChan(c.TerminateChan)), nil)
+	c.machine.SetTimerChan(c.TimerChan)
+	c.machine.Inviter = NewInviter(c.Conn)
+	if !c.resume() {
+		c.send(c.machine.Start(fsm.TerminateOutChan(c.TerminateChan)), nil)
+		c.save()
+	}
 
 	for {
 		select {
@@ -235,18 +541,93 @@ func (c *Conversation) Run(data fsm.MachineData) {
 			c.backendReceived(backendData)
 		case stepData := <-c.TransientChan:
 			c.stepReceived(stepData)
+		case td := <-c.TimerChan:
+			c.timerReceived(td)
+		case err := <-c.emailChan:
+			c.emailFailed(err)
+		}
+		c.save()
+	}
+}
+
+// resume continues the conversation from the snapshot if we have one. It
+// returns false if the machine must be started normally.
+func (c *Conversation) resume() bool {
+	if c.snapshot == nil {
+		return false
+	}
+	snap := c.snapshot
+	c.snapshot = nil
+	if err := c.machine.Resume(fsm.TerminateOutChan(c.TerminateChan), snap); err != nil {
+		glog.Errorln("cannot resume conversation, starting over:", err)
+		return false
+	}
+	for _, pid := range snap.LastProtocolIDs {
+		c.SetLastProtocolID(&agency.ProtocolID{ID: pid})
+	}
+	return true
+}
+
+// save saves the conversation's snapshot if we have a store and the state or
+// the memory has changed since the last save. The snapshot of the terminated
+// conversation is deleted that it isn't restored anymore.
+func (c *Conversation) save() {
+	if c.store == nil {
+		return
+	}
+	if state := c.machine.CurrentState(); state != nil && state.Terminate {
+		if !c.deleted {
+			if err := c.store.Delete(c.id); err != nil {
+				glog.Errorln("cannot delete conversation:", err)
+			}
+			c.deleted, c.saved = true, nil
 		}
+		return
 	}
+	c.deleted = false
+	snap := c.machine.Snapshot()
+	snap.ConnID = c.id
+	for pid := range c.lastProtocolID {
+		snap.LastProtocolIDs = append(snap.LastProtocolIDs, pid)
+	}
+	sort.Strings(snap.LastProtocolIDs)
+	data, err := json.Marshal(snap)
+	if err != nil {
+		glog.Errorln("cannot save conversation:", err)
+		return
+	}
+	if bytes.Equal(data, c.saved) {
+		return
+	}
+	if err := c.store.Save(snap); err != nil {
+		glog.Errorln("cannot save conversation:", err)
+		return
+	}
+	c.saved = data
 }
 
 func (c *Conversation) stepReceived(data string) {
 	glog.V(3).Infoln("conversation: step w/ str:", data)
 	if transition := c.machine.TriggersByStep(); transition != nil {
 		c.send(transition.BuildSendEventsFromStep(data), nil)
-		c.machine.Step(transition)
+		c.send(c.machine.Step(transition), nil)
 	}
 }
 
+func (c *Conversation) timerReceived(td *fsm.TimerData) {
+	glog.V(3).Infoln("conversation: timer expired in:", c.machine.Current)
+	if transition := c.machine.TriggersByTimer(td); transition != nil {
+		c.send(transition.BuildSendEventsFromTimer(), nil)
+		c.send(c.machine.Step(transition), nil)
+	}
+}
+
+// forwardBackendData forwards the backend data to the conversation's queue
+// without blocking the multiplexer, see enqueue.
+func (c *Conversation) forwardBackendData(data *fsm.BackendData) {
+	enqueue(c.BackendChan, data, c.id, "backend data")
+}
+
 func (c *Conversation) backendReceived(data *fsm.BackendData) {
 	glog.V(2).Infof("+++ b-fsm data(%v):%v", data, c.machine.Type)
 	if data.ConnID == "" {
@@ -271,7 +652,7 @@ func (c *Conversation) backendReceived(data *fsm.BackendData) {
 	assert.Equal(c.machine.Type, fsm.MachineTypeConversation)
 	if transition := c.machine.TriggersByBackendData(data); transition != nil {
 		c.send(transition.BuildSendEventsFromBackendData(data), nil)
-		c.machine.Step(transition)
+		c.send(c.machine.Step(transition), nil)
 	}
 }
 
@@ -279,7 +660,7 @@ func (c *Conversation) hookReceived(hookData map[string]string) {
 	glog.V(4).Infoln("hook data arriwed:", hookData)
 	if transition := c.machine.TriggersByHook(); transition != nil {
 		c.send(transition.BuildSendEventsFromHook(hookData), nil)
-		c.machine.Step(transition)
+		c.send(c.machine.Step(transition), nil)
 	}
 }
 
@@ -287,12 +668,15 @@ func (c *Conversation) questionReceived(q QuestionStatus) {
 	glog.V(10).Infoln("conversation:", q.Status.Notification.ConnectionID)
 
 	switch q.TypeID {
-	case agency.Question_PROOF_VERIFY_WAITS:
-		glog.V(1).Infof("- %s: proof QA (%p)", c.machine.Name,
+	case agency.Question_PING_WAITS, agency.Question_ISSUE_PROPOSE_WAITS,
+		agency.Question_PROOF_PROPOSE_WAITS, agency.Question_PROOF_VERIFY_WAITS:
+		glog.V(1).Infof("- %s: %s QA (%p)", c.machine.Name, q.TypeID,
 			c.machine)
 		if transition := c.machine.Answers(q); transition != nil {
 			c.send(transition.BuildSendAnswers(q.Status), q.Status)
-			c.machine.Step(transition)
+			c.send(c.machine.Step(transition), nil)
+		} else {
+			glog.V(1).Infoln("machine doesn't have answer for:", q.TypeID)
 		}
 	}
 }
@@ -325,7 +709,7 @@ func (c *Conversation) statusReceived(as *agency.AgentStatus) {
 			}
 
 			c.send(transition.BuildSendEvents(status), as)
-			c.machine.Step(transition)
+			c.send(c.machine.Step(transition), nil)
 		} else {
 			glog.V(1).Infoln("machine doesn't have transition for:",
 				as.Notification.ProtocolType)
@@ -370,12 +754,27 @@ func (c *Conversation) sendBasicMessage(message *fsm.BasicMessage, wantStatus bo
 	}
 }
 
-func (c *Conversation) sendIssuing(message *fsm.Issuing, wantStatus bool) {
+func (c *Conversation) sendTrustPing(wantStatus bool) {
 	r := try.To1(async.NewPairwise(
 		c.Conn,
 		c.id,
-	).Issue(context.Background(),
-		message.CredDefID, message.AttrsJSON))
+	).Ping(context.Background()))
+	glog.V(10).Infoln("protocol id:", r.ID)
+	if !wantStatus {
+		c.SetLastProtocolID(r)
+	}
+}
+
+func (c *Conversation) sendIssuing(message *fsm.Issuing, wantStatus bool) {
+	pw := async.NewPairwise(c.Conn, c.id)
+	var r *agency.ProtocolID
+	if message.IsStructured() {
+		r = try.To1(pw.IssueWithAttrs(context.Background(),
+			message.CredDefID, message.Protocol()))
+	} else {
+		r = try.To1(pw.Issue(context.Background(),
+			message.CredDefID, message.AttrsJSON))
+	}
 	glog.V(10).Infoln("protocol id:", r.ID)
 	if !wantStatus {
 		c.SetLastProtocolID(r)
@@ -383,12 +782,22 @@ func (c *Conversation) sendIssuing(message *fsm.Issuing, wantStatus bool) {
 }
 
 func (c *Conversation) sendReqProof(message *fsm.Proof, wantStatus bool) {
-	glog.V(5).Infoln("+++ message.ProofJSON", message.ProofJSON)
-	r := try.To1(async.NewPairwise(
-		c.Conn,
-		c.id,
-	).ReqProof(context.Background(),
-		message.ProofJSON))
+	pw := async.NewPairwise(c.Conn, c.id)
+	var r *agency.ProtocolID
+	if message.IsStructured() {
+		// the predicate values can be formatted from the user's input
+		attrs, preds, err := message.Protocol()
+		if err != nil {
+			glog.Errorln("proof request:", err)
+			c.machine.Memory[fsm.LUA_ERROR] = err.Error()
+			return
+		}
+		glog.V(5).Infoln("+++ structured proof", attrs, preds)
+		r = try.To1(pw.ReqProofWithPredicates(context.Background(), attrs, preds))
+	} else {
+		glog.V(5).Infoln("+++ message.ProofJSON", message.ProofJSON)
+		r = try.To1(pw.ReqProof(context.Background(), message.ProofJSON))
+	}
 	glog.V(10).Infoln("protocol id:", r.ID)
 	if !wantStatus {
 		c.SetLastProtocolID(r)
@@ -421,16 +830,56 @@ func (c *Conversation) sendBackend(data *fsm.BackendData, _ bool) {
 		glog.Warningln("!!! ConnID is empty, fixing !!!")
 		data.ConnID = c.id
 	}
-	if backendMachine != nil {
-		backendMachine.BackendChan <- data
+	if b, ok := backendMachines[data.Service]; ok {
+		b.BackendChan <- data
 	} else {
-		glog.V(0).Infoln("!!! cannot send message to Service FSM")
+		glog.V(0).Infof("!!! cannot send message to Service FSM '%s'",
+			data.Service)
 	}
 }
 
 func (c *Conversation) sendEmail(message *fsm.Email, _ bool) {
-	// TODO: implement send email here
-	glog.V(0).Infoln("sending email to", message.To, message.Body)
+	if c.mailer == nil {
+		glog.Warningln("no mailer, cannot send email to", message.To)
+		return
+	}
+	glog.V(1).Infoln("sending email to", message.To)
+	sendMail(c.mailer, message, c.emailChan)
+}
+
+// maxMailSends is the count of the emails delivered at the same time by all
+// the machines.
+const maxMailSends = 8
+
+var mailSlots = make(chan struct{}, maxMailSends)
+
+// sendMail delivers the email in its own goroutine that a slow mail server
+// doesn't stall the machine, and the other conversations with it. The result
+// is given to the machine's email channel as an event, see emailFailed.
+func sendMail(mailer Mailer, message *fsm.Email, results chan<- error) {
+	email := *message // the send events are reused
+	go func() {
+		mailSlots <- struct{}{}
+		err := mailer.Send(&email)
+		<-mailSlots
+		if err != nil {
+			glog.Errorln("email delivery:", err)
+		}
+		results <- err
+	}()
+}
+
+// emailFailed routes the delivery error back to the machine as an email
+// trigger. The result is received after the event which sent the email is
+// processed, i.e. the machine has already stepped to the transition's target.
+func (c *Conversation) emailFailed(err error) {
+	if err == nil {
+		return
+	}
+	if transition := c.machine.TriggersByEmailError(err); transition != nil {
+		c.send(transition.BuildSendEventsFromEmailError(err), nil)
+		c.send(c.machine.Step(transition), nil)
+	}
 }
 
 func (c *Conversation) SetLastProtocolID(pid *agency.ProtocolID) {
@@ -447,7 +896,10 @@ func (c *Conversation) send(outputs []*fsm.Event, status ConnStatus) {
 	for _, output := range outputs {
 		switch output.ProtocolType {
 		case agency.Protocol_DIDEXCHANGE:
-			glog.Warningf("we should not be here!!")
+			// the invitation is already created by the machine's Inviter
+			glog.V(3).Infoln("invitation created:", output.Invitation != nil)
+		case agency.Protocol_TRUST_PING:
+			c.sendTrustPing(output.WantStatus)
 		case agency.Protocol_BASIC_MESSAGE:
 			assert.Equal(output.ProtocolType, agency.Protocol_BASIC_MESSAGE)
 			assert.NotNil(output.EventData)
@@ -484,3 +936,40 @@ func (c *Conversation) isOursAndRm(id string) bool {
 	}
 	return false
 }
+
+// newRooms creates the rooms of the backend machine, which are persisted if
+// the database is given and the machine uses the room rules. Otherwise the
+// rooms of the join and leave routes are only in memory.
+func newRooms(
+	h db.Handle,
+	c *crypto.Cipher,
+	m *fsm.Machine,
+	data fsm.MachineData,
+) *fsm.Rooms {
+	name := m.Name
+	if name == "" {
+		name = data.FType
+	}
+	if !m.UsesRooms() {
+		h = nil
+	}
+	return try.To1(fsm.NewRooms(h, c, name))
+}
+
+// newDBRegister creates the DB register of the machine which keys are prefixed
+// with the machine name. It returns nil if the database isn't given.
+func newDBRegister(
+	h db.Handle,
+	c *crypto.Cipher,
+	m *fsm.Machine,
+	data fsm.MachineData,
+) fsm.Register {
+	if h == nil {
+		return nil
+	}
+	name := m.Name
+	if name == "" {
+		name = data.FType
+	}
+	return fsm.NewDBRegister(h, c, name)
+}
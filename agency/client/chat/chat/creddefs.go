@@ -0,0 +1,70 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/findy-network/findy-common-go/agency/client"
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// credDefTimeout is the deadline of getting the cred def from the agency.
+const credDefTimeout = 10 * time.Second
+
+// credDefAttrs caches the attribute names of the cred defs, which never
+// change, for all the conversations.
+var credDefAttrs sync.Map
+
+// CredDefs resolves the attribute names of the cred defs with the agency for
+// the machines' structured issuing sends.
+type CredDefs struct {
+	client.Conn
+}
+
+// NewCredDefs creates the CredDefs resolver for the machines of the connection.
+func NewCredDefs(conn client.Conn) *CredDefs {
+	return &CredDefs{Conn: conn}
+}
+
+func (c *CredDefs) CredDefAttrs(credDefID string) (names []string, err error) {
+	defer err2.Handle(&err, "get cred def")
+
+	if names, ok := credDefAttrs.Load(credDefID); ok {
+		return names.([]string), nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), credDefTimeout)
+	defer cancel()
+	agentClient := agency.NewAgentServiceClient(c.Conn)
+	r := try.To1(agentClient.GetCredDef(ctx, &agency.CredDef{ID: credDefID}))
+	names = try.To1(parseCredDefAttrs(r.Data))
+	credDefAttrs.Store(credDefID, names)
+	return names, nil
+}
+
+// parseCredDefAttrs returns the attribute names of the cred def JSON from the
+// ledger. They are the keys of the primary public key's r, which has the
+// master secret as well.
+func parseCredDefAttrs(data string) (names []string, err error) {
+	defer err2.Handle(&err)
+
+	var credDef struct {
+		Value struct {
+			Primary struct {
+				R map[string]json.RawMessage `json:"r"`
+			} `json:"primary"`
+		} `json:"value"`
+	}
+	try.To(json.Unmarshal([]byte(data), &credDef))
+	for name := range credDef.Value.Primary.R {
+		if name != "master_secret" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,20 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestParseCredDefAttrs(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const credDef = `{"ver":"1.0","id":"EMAIL_CRED_DEF","type":"CL","tag":"t1",
+"value":{"primary":{"n":"1","s":"2","r":{"master_secret":"3","verified":"4","email":"5"},"rctxt":"6","z":"7"}}}`
+	names := try.To1(parseCredDefAttrs(credDef))
+	assert.DeepEqual(names, []string{"email", "verified"})
+
+	_, err := parseCredDefAttrs("not json")
+	assert.Error(err)
+}
@@ -0,0 +1,88 @@
+package chat
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/findy-network/findy-common-go/agency/client/chat/mail"
+	"github.com/findy-network/findy-common-go/agency/fsm"
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const emailMachineYAML = `
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_SAVE
+        data: EMAIL
+      sends:
+      - protocol: email
+        rule: GEN_PIN
+        data: '{"to":"{{.EMAIL}}","subject":"PIN","body":"{{.PIN}}"}'
+      target: WAITING_PIN
+  WAITING_PIN:
+    transitions:
+    - trigger:
+        protocol: email
+      target: EMAIL_FAILED
+  EMAIL_FAILED:
+    transitions:
+    - trigger:
+        protocol: basic_message
+      target: IDLE
+`
+
+func TestConversation_sendEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		sendErr error
+		want    string
+	}{
+		{"delivered", nil, "WAITING_PIN"},
+		{"failed", errors.New("mailbox full"), "EMAIL_FAILED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer assert.PushTester(t)()
+
+			mailer := mail.NewMemory()
+			mailer.Err = tt.sendErr
+			m := fsm.NewMachine(fsm.MachineData{FType: "email.yaml",
+				Data: []byte(emailMachineYAML)})
+			try.To(m.Initialize())
+			c := &Conversation{machine: m, mailer: mailer,
+				emailChan: make(chan error, 1)}
+			c.send(m.Start(nil), nil)
+
+			status := &agency.ProtocolStatus{
+				State: &agency.ProtocolState{ProtocolID: &agency.ProtocolID{
+					TypeID: agency.Protocol_BASIC_MESSAGE}},
+				Status: &agency.ProtocolStatus_BasicMessage{
+					BasicMessage: &agency.ProtocolStatus_BasicMessageStatus{
+						Content: "me@example.com",
+					},
+				},
+			}
+			transition := m.Triggers(status)
+			c.send(transition.BuildSendEvents(status), nil)
+			c.send(m.Step(transition), nil)
+			c.emailFailed(<-c.emailChan) // the delivery is asynchronous
+
+			assert.Equal(m.Current, tt.want)
+			if tt.sendErr == nil {
+				sent := mailer.Sent()
+				assert.SLen(sent, 1)
+				assert.Equal(sent[0].To, "me@example.com")
+				assert.Equal(sent[0].Body, m.Memory["PIN"])
+			} else {
+				assert.Equal(m.Memory[fsm.LUA_ERROR], "mailbox full")
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package chat
+
+import (
+	"context"
+
+	"github.com/findy-network/findy-common-go/agency/client"
+	"github.com/findy-network/findy-common-go/agency/fsm"
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/google/uuid"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// Inviter creates the invitations of the FSM's connection sends with the
+// agency. Every invitation has a new connection ID.
+type Inviter struct {
+	client.Conn
+}
+
+// NewInviter creates the Inviter for the machines of the connection.
+func NewInviter(conn client.Conn) *Inviter {
+	return &Inviter{Conn: conn}
+}
+
+func (i *Inviter) Invite(label string) (invitation *fsm.Invitation, err error) {
+	defer err2.Handle(&err, "create invitation")
+
+	agentClient := agency.NewAgentServiceClient(i.Conn)
+	r := try.To1(agentClient.CreateInvitation(context.Background(),
+		&agency.InvitationBase{Label: label, ID: uuid.New().String()}))
+	return &fsm.Invitation{JSON: r.JSON, URL: r.URL}, nil
+}
@@ -0,0 +1,62 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/findy-network/findy-common-go/agency/fsm"
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const proofMachineYAML = `
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_SAVE
+        data: AGE
+      sends:
+      - protocol: present_proof
+        rule: FORMAT_MEM
+        event_data:
+          proof:
+            predicates:
+            - name: age
+              p_type: ">="
+              p_value: "{{.AGE}}"
+      target: WAITING_PROOF
+  WAITING_PROOF:
+    transitions:
+    - trigger:
+        protocol: present_proof
+      target: IDLE
+`
+
+func TestConversation_sendReqProof(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := fsm.NewMachine(fsm.MachineData{FType: "proof.yaml",
+		Data: []byte(proofMachineYAML)})
+	try.To(m.Initialize())
+	c := &Conversation{id: "conn", machine: m}
+	c.send(m.Start(nil), nil)
+
+	// the user's input isn't integer, and the request isn't sent
+	status := &agency.ProtocolStatus{
+		State: &agency.ProtocolState{ProtocolID: &agency.ProtocolID{
+			TypeID: agency.Protocol_BASIC_MESSAGE}},
+		Status: &agency.ProtocolStatus_BasicMessage{
+			BasicMessage: &agency.ProtocolStatus_BasicMessageStatus{
+				Content: "old",
+			},
+		},
+	}
+	c.send(m.Triggers(status).BuildSendEvents(status), nil)
+	assert.That(strings.HasPrefix(m.Memory[fsm.LUA_ERROR], "predicate age"),
+		m.Memory[fsm.LUA_ERROR])
+}
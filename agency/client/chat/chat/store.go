@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+
+	"github.com/findy-network/findy-common-go/agency/fsm"
+	"github.com/findy-network/findy-common-go/crypto"
+	"github.com/findy-network/findy-common-go/crypto/db"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// SnapshotBucket is the bucket name where Store keeps conversation snapshots.
+// Remember to add it to db.Cfg.Buckets when creating the database.
+var SnapshotBucket = []byte("fsm_snapshots")
+
+// Store persists per-connection FSM snapshots to the managed database. The
+// snapshots are encrypted with the cipher and indexed by the hash of the
+// connection ID.
+type Store struct {
+	db     db.Handle
+	cipher *crypto.Cipher
+}
+
+// NewStore creates a new snapshot store. The cipher can be nil if the database
+// takes care of the encryption itself, e.g. in tests.
+func NewStore(h db.Handle, c *crypto.Cipher) *Store {
+	return &Store{db: h, cipher: c}
+}
+
+// Save stores the snapshot over the previous one of the same connection.
+func (s *Store) Save(snap *fsm.Snapshot) (err error) {
+	defer err2.Handle(&err, "save snapshot")
+
+	data := try.To1(json.Marshal(snap))
+	try.To(s.db.AddKeyValueToBucket(SnapshotBucket,
+		&db.Data{
+			Data: data,
+			Read: s.encrypt,
+		},
+		&db.Data{
+			Data: []byte(snap.ConnID),
+			Read: hash,
+		},
+	))
+	return nil
+}
+
+// Load loads the snapshot of the connection. found is false if there is no
+// snapshot for the connection.
+func (s *Store) Load(connID string) (snap *fsm.Snapshot, found bool, err error) {
+	defer err2.Handle(&err, "load snapshot")
+
+	value := &db.Data{
+		Write: s.decrypt,
+	}
+	found = try.To1(s.db.GetKeyValueFromBucket(SnapshotBucket,
+		&db.Data{
+			Data: []byte(connID),
+			Read: hash,
+		},
+		value,
+	))
+	if !found {
+		return nil, false, nil
+	}
+	snap = new(fsm.Snapshot)
+	try.To(json.Unmarshal(value.Data, snap))
+	return snap, true, nil
+}
+
+// LoadAll loads all the stored snapshots in no specific order.
+func (s *Store) LoadAll() (snaps []*fsm.Snapshot, err error) {
+	defer err2.Handle(&err, "load all snapshots")
+
+	values := try.To1(s.db.GetAllValuesFromBucket(SnapshotBucket, s.decrypt))
+	snaps = make([]*fsm.Snapshot, 0, len(values))
+	for _, value := range values {
+		snap := new(fsm.Snapshot)
+		try.To(json.Unmarshal(value, snap))
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+// Delete removes the snapshot of the connection.
+func (s *Store) Delete(connID string) (err error) {
+	defer err2.Handle(&err, "delete snapshot")
+
+	return s.db.RmKeyValueFromBucket(SnapshotBucket, &db.Data{
+		Data: []byte(connID),
+		Read: hash,
+	})
+}
+
+func (s *Store) encrypt(value []byte) []byte {
+	if s.cipher == nil {
+		return append(value[:0:0], value...)
+	}
+	return s.cipher.TryEncrypt(value)
+}
+
+func (s *Store) decrypt(value []byte) []byte {
+	if s.cipher == nil {
+		return append(value[:0:0], value...)
+	}
+	return s.cipher.TryDecrypt(value)
+}
+
+// hash makes the hash of the connection ID that we don't store IDs as plain.
+func hash(key []byte) []byte {
+	h := sha256.Sum256(key)
+	return h[:]
+}
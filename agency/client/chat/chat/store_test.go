@@ -0,0 +1,111 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/findy-network/findy-common-go/agency/fsm"
+	"github.com/findy-network/findy-common-go/crypto"
+	"github.com/findy-network/findy-common-go/crypto/db"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+var testKey = []byte{
+	1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+	1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+}
+
+func TestStore(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	h := db.NewMemDB([][]byte{SnapshotBucket}, "MEMORY_snapshots")
+	s := NewStore(h, crypto.NewCipher(testKey))
+
+	_, found, err := s.Load("conn-1")
+	assert.NoError(err)
+	assert.ThatNot(found)
+
+	snap := &fsm.Snapshot{
+		ConnID:          "conn-1",
+		Current:         "WAITING_EMAIL_PIN",
+		Memory:          map[string]string{"EMAIL": "me@example.com", "PIN": "123456"},
+		LastProtocolIDs: []string{"pid-1"},
+	}
+	try.To(s.Save(snap))
+	try.To(s.Save(&fsm.Snapshot{ConnID: "conn-2", Current: "IDLE"}))
+
+	got, found, err := s.Load("conn-1")
+	assert.NoError(err)
+	assert.That(found)
+	assert.DeepEqual(got, snap)
+
+	// saving again overwrites the previous snapshot
+	snap.Current = "WAITING_ISSUING_STATUS"
+	try.To(s.Save(snap))
+	all := try.To1(s.LoadAll())
+	assert.SLen(all, 2)
+	for _, a := range all {
+		if a.ConnID == "conn-1" {
+			assert.Equal(a.Current, "WAITING_ISSUING_STATUS")
+		}
+	}
+
+	try.To(s.Delete("conn-1"))
+	_, found, err = s.Load("conn-1")
+	assert.NoError(err)
+	assert.ThatNot(found)
+	assert.SLen(try.To1(s.LoadAll()), 1)
+}
+
+// countDB counts the writes of the snapshots.
+type countDB struct {
+	db.Handle
+	adds int
+}
+
+func (c *countDB) AddKeyValueToBucket(bucket []byte, keyValue, index *db.Data) error {
+	c.adds++
+	return c.Handle.AddKeyValueToBucket(bucket, keyValue, index)
+}
+
+func TestConversation_save(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const machine = `
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_EQUAL
+        data: bye
+      target: DONE
+  DONE:
+    terminate: true
+`
+	h := &countDB{Handle: db.NewMemDB([][]byte{SnapshotBucket}, "MEMORY_snapshots")}
+	s := NewStore(h, nil)
+	m := fsm.NewMachine(fsm.MachineData{FType: "save.yaml", Data: []byte(machine)})
+	try.To(m.Initialize())
+	m.Start(nil)
+	c := &Conversation{id: "conn-1", machine: m, store: s}
+
+	c.save()
+	assert.Equal(h.adds, 1)
+	// unchanged snapshots aren't written again
+	c.save()
+	assert.Equal(h.adds, 1)
+	m.Memory["EMAIL"] = "me@example.com"
+	c.save()
+	assert.Equal(h.adds, 2)
+	assert.SLen(try.To1(s.LoadAll()), 1)
+
+	// terminated conversations aren't restored
+	m.Current = "DONE"
+	c.save()
+	c.save()
+	assert.Equal(h.adds, 2)
+	assert.SLen(try.To1(s.LoadAll()), 0)
+}
@@ -0,0 +1,255 @@
+// Package mail implements mailers which deliver the emails of the FSM's email
+// send protocol. They all implement chat.Mailer.
+package mail
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/findy-network/findy-common-go/agency/fsm"
+	"github.com/findy-network/findy-common-go/utils"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// TLSMode tells how the SMTP connection is secured.
+type TLSMode string
+
+const (
+	// TLSNone uses plain connection. Use it only for local test servers.
+	TLSNone TLSMode = "none"
+	// TLSStart upgrades the plain connection with STARTTLS, usually port 587.
+	TLSStart TLSMode = "starttls"
+	// TLSImplicit connects with TLS from the beginning, usually port 465.
+	TLSImplicit TLSMode = "tls"
+)
+
+const defaultTimeout = 30 * time.Second
+
+var errNoRecipient = errors.New("email doesn't have recipient")
+
+// SMTPConfig is the configuration of the SMTP mailer.
+type SMTPConfig struct {
+	Host string
+	Port int
+
+	// Username and Password are used for PLAIN authentication if Username is
+	// set.
+	Username string
+	Password string
+
+	// From is used when the email of the FSM doesn't have a sender.
+	From string
+
+	// TLS is the TLS mode, default is TLSStart.
+	TLS TLSMode
+	// TLSConfig is optional, e.g. for custom root CAs.
+	TLSConfig *tls.Config
+
+	// Timeout is the timeout of the whole delivery, default is 30 seconds.
+	Timeout time.Duration
+}
+
+// SMTP is the mailer which delivers emails to the SMTP server.
+type SMTP struct {
+	cfg SMTPConfig
+}
+
+// NewSMTP creates a new SMTP mailer.
+func NewSMTP(cfg SMTPConfig) *SMTP {
+	if cfg.TLS == "" {
+		cfg.TLS = TLSStart
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	return &SMTP{cfg: cfg}
+}
+
+// Send delivers the email to the SMTP server.
+func (s *SMTP) Send(email *fsm.Email) (err error) {
+	defer err2.Handle(&err, "smtp send to %s", email.To)
+
+	from := sender(email, s.cfg.From)
+	msg := try.To1(Message(email, from, time.Now()))
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	tlsCfg := s.tlsConfig()
+	dialer := &net.Dialer{Timeout: s.cfg.Timeout}
+
+	var conn net.Conn
+	if s.cfg.TLS == TLSImplicit {
+		conn = try.To1(tls.DialWithDialer(dialer, "tcp", addr, tlsCfg))
+	} else {
+		conn = try.To1(dialer.Dial("tcp", addr))
+	}
+	try.To(conn.SetDeadline(time.Now().Add(s.cfg.Timeout)))
+	c, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.cfg.TLS == TLSStart {
+		try.To(c.StartTLS(tlsCfg))
+	}
+	if s.cfg.Username != "" {
+		try.To(c.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password,
+			s.cfg.Host)))
+	}
+	try.To(c.Mail(envelope(from)))
+	try.To(c.Rcpt(envelope(email.To)))
+	w := try.To1(c.Data())
+	try.To1(w.Write(msg))
+	try.To(w.Close())
+	return c.Quit()
+}
+
+func (s *SMTP) tlsConfig() *tls.Config {
+	if s.cfg.TLSConfig != nil {
+		return s.cfg.TLSConfig
+	}
+	return &tls.Config{ServerName: s.cfg.Host, MinVersion: tls.VersionTLS12}
+}
+
+// Memory is the mailer which keeps sent emails in memory. It's meant for
+// the tests. If Err is set, Send fails with it.
+type Memory struct {
+	sync.Mutex
+	Err  error
+	sent []fsm.Email
+}
+
+// NewMemory creates a new in-memory mailer.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Send stores the copy of the email or returns m.Err if it's set. The
+// addresses are checked like the other mailers do.
+func (m *Memory) Send(email *fsm.Email) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.Err != nil {
+		return m.Err
+	}
+	if err := checkAddresses(email, email.From); err != nil {
+		return err
+	}
+	m.sent = append(m.sent, *email)
+	return nil
+}
+
+// Sent returns the sent emails in sending order.
+func (m *Memory) Sent() []fsm.Email {
+	m.Lock()
+	defer m.Unlock()
+
+	return append([]fsm.Email(nil), m.sent...)
+}
+
+// FileDrop is the mailer which writes every email to its own .eml file in
+// Dir. It's useful for development environments where emails can be read
+// from the files.
+type FileDrop struct {
+	Dir  string
+	From string
+}
+
+// NewFileDrop creates a new file drop mailer. The directory is created if it
+// doesn't exist.
+func NewFileDrop(dir, from string) (f *FileDrop, err error) {
+	defer err2.Handle(&err, "file drop")
+
+	try.To(os.MkdirAll(dir, 0700))
+	return &FileDrop{Dir: dir, From: from}, nil
+}
+
+// Send writes the email to a new file.
+func (f *FileDrop) Send(email *fsm.Email) (err error) {
+	defer err2.Handle(&err, "file drop send to %s", email.To)
+
+	now := time.Now()
+	msg := try.To1(Message(email, sender(email, f.From), now))
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405"),
+		utils.UUID())
+	return os.WriteFile(filepath.Join(f.Dir, name), msg, 0600)
+}
+
+// Message builds the RFC 5322 message of the email. It returns error if the
+// addresses aren't valid, because the recipient comes usually from the user
+// and it must not inject headers to the message.
+func Message(email *fsm.Email, from string, date time.Time) ([]byte, error) {
+	if err := checkAddresses(email, from); err != nil {
+		return nil, err
+	}
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, "From: %s\r\n", from)
+	fmt.Fprintf(w, "To: %s\r\n", email.To)
+	fmt.Fprintf(w, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(w, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprint(w, "MIME-Version: 1.0\r\n")
+	fmt.Fprint(w, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprint(w, "\r\n")
+	fmt.Fprint(w, normalizeNewlines(email.Body))
+	return w.Bytes(), nil
+}
+
+// checkAddresses returns error if the recipient is missing or the addresses
+// cannot be parsed. The sender is optional.
+func checkAddresses(email *fsm.Email, from string) error {
+	if email.To == "" {
+		return errNoRecipient
+	}
+	if err := checkAddress(email.To); err != nil {
+		return err
+	}
+	if from != "" {
+		return checkAddress(from)
+	}
+	return nil
+}
+
+// envelope returns the plain address for the SMTP envelope. The address is
+// already checked by Message.
+func envelope(address string) string {
+	if a, err := netmail.ParseAddress(address); err == nil {
+		return a.Address
+	}
+	return address
+}
+
+func checkAddress(address string) error {
+	if strings.ContainsAny(address, "\r\n") {
+		return fmt.Errorf("address %q has line break", address)
+	}
+	if _, err := netmail.ParseAddress(address); err != nil {
+		return fmt.Errorf("address %q: %w", address, err)
+	}
+	return nil
+}
+
+func normalizeNewlines(s string) string {
+	b := bytes.ReplaceAll([]byte(s), []byte("\r\n"), []byte("\n"))
+	return string(bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n")))
+}
+
+func sender(email *fsm.Email, def string) string {
+	if email.From != "" {
+		return email.From
+	}
+	return def
+}
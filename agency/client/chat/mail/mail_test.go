@@ -0,0 +1,166 @@
+package mail
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-common-go/agency/fsm"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+var testEmail = &fsm.Email{
+	To:      "me@example.com",
+	Subject: "Your PIN",
+	Body:    "Your PIN is:\n123456",
+}
+
+func TestMessage(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	date := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := string(try.To1(Message(testEmail, "bot@example.com", date)))
+	assert.Equal(msg, "From: bot@example.com\r\n"+
+		"To: me@example.com\r\n"+
+		"Subject: Your PIN\r\n"+
+		"Date: Mon, 02 Jan 2023 03:04:05 +0000\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n"+
+		"Your PIN is:\r\n123456")
+}
+
+func TestMemory(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMemory()
+	try.To(m.Send(testEmail))
+	sent := m.Sent()
+	assert.SLen(sent, 1)
+	assert.Equal(sent[0], *testEmail)
+
+	m.Err = errors.New("mailbox full")
+	assert.Error(m.Send(testEmail))
+	assert.SLen(m.Sent(), 1)
+}
+
+func TestMessage_injection(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	date := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, to := range []string{
+		"me@example.com\r\nBcc: all@example.com",
+		"me@example.com\nBcc: all@example.com",
+		"not an address",
+	} {
+		_, err := Message(&fsm.Email{To: to, Body: "x"}, "bot@example.com", date)
+		assert.Error(err)
+	}
+	_, err := Message(testEmail, "bot@example.com\r\nBcc: all@example.com", date)
+	assert.Error(err)
+
+	dir := t.TempDir()
+	f := try.To1(NewFileDrop(dir, "bot@example.com"))
+	assert.Error(f.Send(&fsm.Email{To: "me@example.com\r\nBcc: x@example.com"}))
+	assert.SLen(try.To1(os.ReadDir(dir)), 0)
+	assert.Error(NewMemory().Send(&fsm.Email{To: "me@example.com\nBcc: x@example.com"}))
+}
+
+func TestFileDrop(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	dir := filepath.Join(t.TempDir(), "emails")
+	f := try.To1(NewFileDrop(dir, "bot@example.com"))
+	try.To(f.Send(testEmail))
+	assert.Error(f.Send(&fsm.Email{Body: "no recipient"}))
+
+	files := try.To1(os.ReadDir(dir))
+	assert.SLen(files, 1)
+	data := try.To1(os.ReadFile(filepath.Join(dir, files[0].Name())))
+	assert.That(strings.HasPrefix(string(data), "From: bot@example.com\r\n"))
+}
+
+func TestSMTP(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	l := try.To1(net.Listen("tcp", "127.0.0.1:0"))
+	defer l.Close()
+	received := make(chan []string, 1)
+	go serveSMTP(l, received)
+
+	port := l.Addr().(*net.TCPAddr).Port
+	s := NewSMTP(SMTPConfig{
+		Host:     "127.0.0.1",
+		Port:     port,
+		Username: "bot",
+		Password: "secret",
+		From:     "bot@example.com",
+		TLS:      TLSNone,
+		Timeout:  5 * time.Second,
+	})
+	try.To(s.Send(testEmail))
+	cmds := <-received
+	assert.DeepEqual(cmds, []string{
+		"EHLO localhost",
+		"AUTH PLAIN AGJvdABzZWNyZXQ=",
+		"MAIL FROM:<bot@example.com> BODY=8BITMIME",
+		"RCPT TO:<me@example.com>",
+		"DATA",
+		"QUIT",
+	})
+
+	s = NewSMTP(SMTPConfig{Host: "127.0.0.1", Port: port, TLS: TLSNone})
+	assert.Error(s.Send(&fsm.Email{Body: "no recipient"}))
+}
+
+// serveSMTP is a minimal SMTP server which accepts one email and sends the
+// commands it received to the channel.
+func serveSMTP(l net.Listener, received chan<- []string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+	var cmds []string
+	reply("220 localhost ESMTP test")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+		cmds = append(cmds, cmd)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250-localhost")
+			reply("250-8BITMIME")
+			reply("250 AUTH PLAIN")
+		case strings.HasPrefix(cmd, "AUTH"):
+			reply("235 OK")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+			}
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 bye")
+			received <- cmds
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
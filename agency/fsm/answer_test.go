@@ -0,0 +1,188 @@
+package fsm
+
+import (
+	"testing"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const holderMachineYAML = `
+name: holder machine
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: trust_ping
+        type_id: ANSWER_NEEDED_PING
+      sends:
+      - protocol: answer
+        data: ACK
+      target: IDLE
+    - trigger:
+        protocol: issue_cred
+        type_id: ANSWER_NEEDED_ISSUE_PROPOSE
+        rule: ACCEPT_AND_INPUT_VALUES
+        data: '[{"name":"email","credDefId":"EMAIL_CRED_DEF"}]'
+      sends:
+      - protocol: answer
+        data: ACK
+      target: ISSUING
+    - trigger:
+        protocol: issue_cred
+        type_id: ANSWER_NEEDED_ISSUE_PROPOSE
+        rule: NOT_ACCEPT_VALUES
+        data: '[{"name":"email","credDefId":"EMAIL_CRED_DEF"}]'
+      sends:
+      - protocol: answer
+        data: NACK
+      target: IDLE
+    - trigger:
+        protocol: present_proof
+        type_id: ANSWER_NEEDED_PROOF_PROPOSE
+        rule: LUA
+        data: |
+          if getRegValue("MEM", "CONN_ID") == "trusted" then
+            setRegValue("MEM", "OUTPUT", "OK")
+          else
+            setRegValue("MEM", "OUTPUT", "NO")
+          end
+      sends:
+      - protocol: answer
+        data: ACK
+      target: PROVING
+    - trigger:
+        protocol: present_proof
+        type_id: ANSWER_NEEDED_PROOF_PROPOSE
+      sends:
+      - protocol: answer
+        data: NACK
+      target: IDLE
+  ISSUING:
+    transitions:
+    - trigger:
+        protocol: issue_cred
+      target: IDLE
+  PROVING:
+    transitions:
+    - trigger:
+        protocol: present_proof
+      target: IDLE
+`
+
+func question(typeID agency.Question_Type, protocol agency.Protocol_Type, connID string) *agency.Question {
+	return &agency.Question{
+		TypeID: typeID,
+		Status: &agency.AgentStatus{
+			Notification: &agency.Notification{
+				ConnectionID: connID,
+				ProtocolType: protocol,
+			},
+		},
+	}
+}
+
+func issuePropose(credDefID, valuesJSON string) *agency.Question {
+	q := question(agency.Question_ISSUE_PROPOSE_WAITS, agency.Protocol_ISSUE_CREDENTIAL, "conn")
+	q.Question = &agency.Question_IssuePropose{
+		IssuePropose: &agency.Question_IssueProposeMsg{
+			CredDefID:  credDefID,
+			ValuesJSON: valuesJSON,
+		},
+	}
+	return q
+}
+
+// answer answers the question and steps the machine. It returns the answer,
+// the new state and the memory before the step, because the memory is cleared
+// in the initial state.
+func answer(m *Machine, q *agency.Question) (data, state string, mem map[string]string) {
+	transition := m.Answers(q)
+	if transition == nil {
+		return "", "", nil
+	}
+	sends := transition.BuildSendAnswers(q.Status)
+	assert.SLen(sends, 1)
+	data = sends[0].Data
+	mem = make(map[string]string, len(m.Memory))
+	for k, v := range m.Memory {
+		mem[k] = v
+	}
+	m.Step(transition)
+	return data, m.Current, mem
+}
+
+func TestMachine_Answers(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "holder.yaml", Data: []byte(holderMachineYAML)})
+	assert.SLen(m.Validate(), 0)
+	try.To(m.Initialize())
+	m.InitLua()
+	m.Start(nil)
+
+	data, state, mem := answer(m, question(agency.Question_PING_WAITS, agency.Protocol_TRUST_PING, "pinger"))
+	assert.Equal(data, "ACK")
+	assert.Equal(state, "IDLE")
+	assert.Equal(mem[LUA_CONN_ID], "pinger")
+
+	// wrong cred def is declined
+	data, state, mem = answer(m, issuePropose("OTHER_CRED_DEF", `[{"name":"email","value":"me@example.com"}]`))
+	assert.Equal(data, "NACK")
+	assert.Equal(state, "IDLE")
+	assert.Equal(mem[LUA_CRED_DEF_ID], "OTHER_CRED_DEF")
+	_, found := mem["email"]
+	assert.That(!found)
+
+	data, state, mem = answer(m, issuePropose("EMAIL_CRED_DEF", `[{"name":"email","value":"me@example.com"}]`))
+	assert.Equal(data, "ACK")
+	assert.Equal(state, "ISSUING")
+	assert.Equal(mem["email"], "me@example.com")
+
+	// question triggers don't trigger by the statuses
+	status := protocolStatus(agency.Protocol_ISSUE_CREDENTIAL)
+	m.Step(m.Triggers(status))
+	assert.Equal(m.Current, "IDLE")
+	status = protocolStatus(agency.Protocol_PRESENT_PROOF)
+	assert.That(m.Triggers(status) == nil)
+
+	data, state, _ = answer(m, question(agency.Question_PROOF_PROPOSE_WAITS, agency.Protocol_PRESENT_PROOF, "stranger"))
+	assert.Equal(data, "NACK")
+	assert.Equal(state, "IDLE")
+
+	data, state, _ = answer(m, question(agency.Question_PROOF_PROPOSE_WAITS, agency.Protocol_PRESENT_PROOF, "trusted"))
+	assert.Equal(data, "ACK")
+	assert.Equal(state, "PROVING")
+
+	// proof verify isn't answered by the proof propose triggers
+	q := question(agency.Question_PROOF_VERIFY_WAITS, agency.Protocol_PRESENT_PROOF, "trusted")
+	assert.That(m.Answers(q) == nil)
+}
+
+func TestMachine_AnswersInvalid(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const fsm = `
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: issue_cred
+        type_id: ANSWER_NEEDED_PING
+      sends:
+      - protocol: answer
+        data: ACK
+      target: DONE
+  DONE:
+    terminate: true
+`
+	m := NewMachine(MachineData{FType: "holder.yaml", Data: []byte(fsm)})
+	diags := m.Validate()
+	assert.SLen(diags, 1)
+	assert.Equal(diags[0].Msg, `type_id "ANSWER_NEEDED_PING" needs "trust_ping" trigger`)
+}
@@ -2,6 +2,8 @@ package fsm
 
 import (
 	"github.com/findy-network/findy-common-go/x"
+	"github.com/golang/glog"
+	"github.com/lainio/err2/try"
 )
 
 // BackendData is important value object to transoprt data between f-fsm and
@@ -21,13 +23,128 @@ type BackendData struct {
 	// see the EventData
 	Subject string // this could be used for the chat room,
 
+	// Route tells whom the data is for, see RouteConn. It's set from the
+	// send's route.
+	Route string
+
+	// Service is the name of the backend machine of the data, i.e. the
+	// receiver of the conversation's data and the sender of the backend's
+	// data. It's empty for the default backend machine.
+	Service string
+
 	Content string
 }
 
+// Routes of the BackendData. The backend machine's data is for the
+// conversation of the ConnID by default. The room route sends it to the
+// members of the Subject room, and only the all route to all the
+// conversations. Conversations, as well as the backend, join and leave the
+// rooms with the join and leave routes, see Router.
+//
+// NOTE. Before the routes all the backend data was delivered to all the
+// conversations, which filtered it by the SessionID. The backend machines
+// which rely on that must use the all route now. The data without ConnID,
+// e.g. the timer sends, is still delivered to all.
+const (
+	RouteConn  = ""
+	RouteRoom  = "room"
+	RouteAll   = "all"
+	RouteJoin  = "join"
+	RouteLeave = "leave"
+)
+
+var routes = map[string]struct{}{
+	RouteConn:  {},
+	RouteRoom:  {},
+	RouteAll:   {},
+	RouteJoin:  {},
+	RouteLeave: {},
+}
+
 func (bd *BackendData) String() string {
 	noEcho := x.Whom(bd.NoEcho, "yes", "no")
-	connID := bd.ConnID[:8]
-	return bd.Content + "|ConnID:" + connID + ", NoEcho:" + noEcho + ", SID:" + bd.SessionID
+	connID := bd.ConnID
+	if len(connID) > 8 {
+		connID = connID[:8]
+	}
+	return bd.Content + "|ConnID:" + connID + ", NoEcho:" + noEcho +
+		", SID:" + bd.SessionID + ", Route:" + bd.Route + ", Subject:" +
+		bd.Subject
+}
+
+// Router is the routing table of the backend data, i.e. the members of the
+// rooms. The runner of the machines routes the backend's data with it, e.g.
+// the chat multiplexer, and the backend machine's runner updates it by the
+// join and leave routes. The rooms are the backend machine's Rooms, which
+// means that the join and leave routes and the ROOM_ rules share the same
+// members. It's thread-safe like the Rooms.
+type Router struct {
+	rooms *Rooms
+}
+
+// NewRouter creates the router of the rooms. If the rooms are nil, the router
+// has its own rooms only in memory.
+func NewRouter(rooms *Rooms) *Router {
+	if rooms == nil {
+		rooms = try.To1(NewRooms(nil, nil, ""))
+	}
+	return &Router{rooms: rooms}
+}
+
+// Update updates the rooms by the join and leave routes. It returns true if
+// the data was either of them. The conversations' joins are delivered to the
+// backend machine as well, but the backend's joins aren't delivered.
+func (r *Router) Update(data *BackendData) bool {
+	switch data.Route {
+	case RouteJoin:
+		r.Join(data.Subject, data.ConnID)
+	case RouteLeave:
+		r.Leave(data.Subject, data.ConnID)
+	default:
+		return false
+	}
+	return true
+}
+
+// Join adds the connection to the room without a callsign. The callsign of
+// the member is kept, e.g. given by the ROOM_JOIN rule.
+func (r *Router) Join(room, connID string) {
+	if room == "" || connID == "" {
+		return
+	}
+	if err := r.rooms.add(room, connID); err != nil {
+		glog.Errorln("router join:", err)
+	}
+}
+
+func (r *Router) Leave(room, connID string) {
+	if err := r.rooms.Leave(room, connID); err != nil {
+		glog.Errorln("router leave:", err)
+	}
+}
+
+// Members returns the connection IDs of the room in order.
+func (r *Router) Members(room string) []string {
+	return r.rooms.Members(room)
+}
+
+// Receivers returns the connection IDs of the conversations the data is
+// routed to. If all is true, the data is for all the conversations, which is
+// the case for the conn route without the ConnID as well, e.g. the backend's
+// timer sends.
+func (r *Router) Receivers(data *BackendData) (connIDs []string, all bool) {
+	switch data.Route {
+	case RouteAll:
+		return nil, true
+	case RouteRoom:
+		return r.Members(data.Subject), false
+	case RouteConn:
+		if data.ConnID == "" {
+			return nil, true
+		}
+		return []string{data.ConnID}, false
+	}
+	return nil, false
 }
 
 type BackendChan = chan *BackendData
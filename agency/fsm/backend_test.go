@@ -1,6 +1,7 @@
 package fsm
 
 import (
+	"strings"
 	"testing"
 
 	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
@@ -91,6 +92,261 @@ func TestBackendTestLuaTrigger(t *testing.T) {
 	}
 }
 
+const serviceMachineYAML = `
+name: service machine
+initial:
+  target: IDLE
+  sends:
+  - protocol: backend
+    data: started
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: backend
+        rule: INPUT_SAVE
+        data: EMAIL
+      sends:
+      - protocol: email
+        rule: GEN_PIN
+        data: '{"to":"{{.EMAIL}}","subject":"PIN","body":"{{.PIN}}"}'
+      - protocol: hook
+        rule: INPUT
+      target: WAITING_PIN
+  WAITING_PIN:
+    on_entry:
+    - protocol: backend
+      rule: FORMAT_MEM
+      data: "PIN sent to {{.EMAIL}}"
+    transitions:
+    - trigger:
+        protocol: backend
+        rule: INPUT_VALIDATE_EQUAL
+        data: PIN
+      sends:
+      - protocol: backend
+        rule: FORMAT_MEM
+        data: "verified {{.EMAIL}}"
+      target: IDLE
+    - trigger:
+        protocol: timer
+        data: 1m
+      sends:
+      - protocol: backend
+        rule: INPUT
+      target: IDLE
+`
+
+func TestBackend_InputRules(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewBackendMachine(MachineData{FType: "service.yaml", Data: []byte(serviceMachineYAML)})
+	assert.SLen(m.Validate(), 0)
+	try.To(m.Initialize())
+	m.InitLua()
+
+	// sends without input and connection
+	sends := m.Start(nil)
+	assert.SLen(sends, 1)
+	assert.Equal(sends[0].Backend.Content, "started")
+	assert.Equal(sends[0].Backend.ConnID, "")
+
+	data := newBackend("me@example.com", "")
+	transition := m.TriggersByBackendData(data)
+	sends = transition.BuildSendEventsFromBackendData(data)
+	assert.SLen(sends, 2)
+	pin := m.Memory["PIN"]
+	assert.Equal(sends[0].Email.To, "me@example.com")
+	assert.Equal(sends[0].Email.Body, pin)
+	assert.Equal(sends[1].Hook.Data["data"], "me@example.com")
+	sends = m.Step(transition)
+	assert.SLen(sends, 1)
+	assert.Equal(sends[0].Backend.Content, "PIN sent to me@example.com")
+
+	assert.That(m.TriggersByBackendData(newBackend("wrong", "")) == nil)
+	data = newBackend(pin, "")
+	transition = m.TriggersByBackendData(data)
+	assert.NotNil(transition)
+	sends = transition.BuildSendEventsFromBackendData(data)
+	assert.Equal(sends[0].Backend.Content, "verified me@example.com")
+	assert.Equal(sends[0].Backend.ConnID, data.ConnID)
+
+	// timer sends are for all the conversations
+	transition = m.CurrentState().Transitions[1]
+	sends = transition.BuildSendEventsFromTimer()
+	assert.Equal(sends[0].Backend.Content, "1m")
+	assert.Equal(sends[0].Backend.ConnID, "")
+}
+
+func TestBackend_ValidateConnection(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const fsm = `
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+      sends:
+      - protocol: basic_message
+        data: hello
+      - protocol: connection
+        data: invitation
+      target: DONE
+  DONE:
+    terminate: true
+`
+	md := MachineData{FType: "service.yaml", Data: []byte(fsm)}
+	assert.SLen(NewMachine(md).Validate(), 0)
+	ds := NewBackendMachine(md).Validate()
+	assert.SLen(ds, 2)
+	assert.Equal(ds[0].Msg, `backend machine doesn't receive "basic_message", it has no connection`)
+	assert.Equal(ds[1].Msg, `backend machine cannot send "basic_message", it has no connection`)
+	assert.Equal(ds[1].Severity, SeverityWarning)
+}
+
+func TestRouter(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	r := NewRouter(nil)
+	assert.That(r.Update(&BackendData{Route: RouteJoin, Subject: "lobby", ConnID: "b"}))
+	assert.That(r.Update(&BackendData{Route: RouteJoin, Subject: "lobby", ConnID: "a"}))
+	assert.That(!r.Update(&BackendData{Route: RouteRoom, Subject: "lobby", ConnID: "c"}))
+	assert.DeepEqual(r.Members("lobby"), []string{"a", "b"})
+
+	tests := []struct {
+		name string
+		data BackendData
+		ids  []string
+		all  bool
+	}{
+		{"conn", BackendData{ConnID: "a"}, []string{"a"}, false},
+		{"no conn", BackendData{}, nil, true},
+		{"room", BackendData{Route: RouteRoom, Subject: "lobby", ConnID: "c"},
+			[]string{"a", "b"}, false},
+		{"unknown room", BackendData{Route: RouteRoom, Subject: "hall"}, []string{}, false},
+		{"all", BackendData{Route: RouteAll, ConnID: "a"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer assert.PushTester(t)()
+
+			ids, all := r.Receivers(&tt.data)
+			assert.DeepEqual(ids, tt.ids)
+			assert.Equal(all, tt.all)
+		})
+	}
+
+	r.Update(&BackendData{Route: RouteLeave, Subject: "lobby", ConnID: "a"})
+	assert.DeepEqual(r.Members("lobby"), []string{"b"})
+	r.Leave("lobby", "b")
+	assert.SLen(r.rooms.List(), 0)
+
+	// the router shares the members with the room rules of the machine
+	rooms := try.To1(NewRooms(nil, nil, "broker"))
+	try.To(rooms.Join("lobby", "a", "alice"))
+	r = NewRouter(rooms)
+	r.Join("lobby", "a")
+	r.Join("lobby", "b")
+	assert.DeepEqual(rooms.Members("lobby"), []string{"a", "b"})
+	assert.DeepEqual(rooms.Callsigns("lobby"), []string{"alice"})
+}
+
+func TestBackend_Routes(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const fsm = `
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: backend
+        rule: INPUT_SAVE
+        data: LINE
+      sends:
+      - protocol: backend
+        route: room
+        rule: INPUT
+      - protocol: backend
+        rule: INPUT
+        event_data:
+          backend:
+            ConnID: "{{.LINE}}"
+      target: DONE
+  DONE:
+    terminate: true
+`
+	m := NewBackendMachine(MachineData{FType: "router.yaml", Data: []byte(fsm)})
+	assert.SLen(m.Validate(), 0)
+	try.To(m.Initialize())
+	m.InitLua()
+
+	data := &BackendData{Content: "c", Subject: "lobby"}
+	sends := m.TriggersByBackendData(data).BuildSendEventsFromBackendData(data)
+	assert.SLen(sends, 2)
+	assert.Equal(sends[0].Backend.Route, RouteRoom)
+	assert.Equal(sends[0].Backend.Subject, "lobby")
+	assert.Equal(sends[1].Backend.ConnID, "c")
+
+	// the template is kept
+	data = &BackendData{Content: "d"}
+	sends = m.TriggersByBackendData(data).BuildSendEventsFromBackendData(data)
+	assert.Equal(sends[1].Backend.ConnID, "d")
+
+	data2 := strings.Replace(fsm, "route: room", "route: hall", 1)
+	ds := NewBackendMachine(MachineData{FType: "router.yaml", Data: []byte(data2)}).Validate()
+	assert.SLen(ds, 1)
+	assert.Equal(ds[0].Msg, `unknown route "hall"`)
+}
+
+func TestMachine_BackendService(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const fsm = `
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+      sends:
+      - protocol: backend
+        service: audit
+        rule: FORMAT_MEM
+        data: log
+      - protocol: backend
+        rule: INPUT
+      target: DONE
+  DONE:
+    terminate: true
+`
+	m := NewMachine(MachineData{FType: "service.yaml", Data: []byte(fsm)})
+	ds := m.Validate()
+	assert.SLen(ds, 0, ds)
+	try.To(m.Initialize())
+	m.ConnID = "conn"
+	m.Start(nil)
+
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE, "log")
+	sends := m.Triggers(status).BuildSendEvents(status)
+	assert.SLen(sends, 2)
+	assert.Equal(sends[0].Backend.Service, "audit")
+	assert.Equal(sends[0].Backend.Content, "log")
+	assert.Equal(sends[1].Backend.Service, "")
+
+	ds = NewBackendMachine(MachineData{FType: "service.yaml", Data: []byte(fsm)}).Validate()
+	found := false
+	for _, d := range ds {
+		found = found || d.Msg == "service is only for backend sends of conversation machines"
+	}
+	assert.That(found)
+}
+
 func newBackend(c, s string) *BackendData {
 	return &BackendData{
 		ConnID:   "TEST_CONN_ID_SET_IN_UNIT_TEST",
@@ -0,0 +1,107 @@
+package fsm
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of the machine's timers. The default is the real
+// time, but it can be replaced e.g. with the ManualClock in the tests.
+type Clock interface {
+	// AfterFunc calls f in its own goroutine after the duration d. The
+	// returned Stopper can be used to cancel the call.
+	AfterFunc(d time.Duration, f func()) Stopper
+}
+
+// Stopper cancels the pending call. It returns false if the call was already
+// executed or stopped.
+type Stopper interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Stopper {
+	return time.AfterFunc(d, f)
+}
+
+// ManualClock is a Clock which time moves only when Advance is called. It's
+// meant for the tests and simulations. Note that timer functions are called
+// synchronously in Advance.
+type ManualClock struct {
+	sync.Mutex
+	now    time.Duration
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	c       *ManualClock
+	at      time.Duration
+	f       func()
+	stopped bool
+}
+
+// NewManualClock creates a new ManualClock which starts from zero.
+func NewManualClock() *ManualClock {
+	return &ManualClock{}
+}
+
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Stopper {
+	c.Lock()
+	defer c.Unlock()
+
+	t := &manualTimer{c: c, at: c.now + d, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward and calls all the timer functions which are
+// due in the order of their expiration time.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.Lock()
+	c.now += d
+	var due []*manualTimer
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.stopped {
+			continue
+		}
+		if t.at <= c.now {
+			t.stopped = true
+			due = append(due, t)
+		} else {
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+	c.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at < due[j].at })
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// Pending returns the count of the timers waiting.
+func (c *ManualClock) Pending() int {
+	c.Lock()
+	defer c.Unlock()
+
+	count := 0
+	for _, t := range c.timers {
+		if !t.stopped {
+			count++
+		}
+	}
+	return count
+}
+
+func (t *manualTimer) Stop() bool {
+	t.c.Lock()
+	defer t.c.Unlock()
+
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
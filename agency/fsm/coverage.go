@@ -0,0 +1,208 @@
+package fsm
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Coverage tracks the visited states and the fired transitions of the
+// machine. States are identified by their full paths and transitions by their
+// locations like in Diagnostic, e.g. "IDLE.transitions[0]" or
+// "global_transitions[1]". Coverages of the several runs of the same machine
+// can be merged, see Merge.
+type Coverage struct {
+	States      map[string]int `json:"states"`
+	Transitions map[string]int `json:"transitions"`
+
+	ids map[*Event]string // transitions by their trigger
+}
+
+// NewCoverage creates a new empty Coverage.
+func NewCoverage() *Coverage {
+	return &Coverage{
+		States:      make(map[string]int),
+		Transitions: make(map[string]int),
+	}
+}
+
+// Merge adds the counts of the other coverage to c.
+func (c *Coverage) Merge(other *Coverage) {
+	if other == nil {
+		return
+	}
+	for k, v := range other.States {
+		c.States[k] += v
+	}
+	for k, v := range other.Transitions {
+		c.Transitions[k] += v
+	}
+}
+
+// EnableCoverage starts to track the coverage of the machine. Call it after
+// Initialize and before Start. The current coverage is available from
+// Coverage.
+func (m *Machine) EnableCoverage() *Coverage {
+	c := NewCoverage()
+	c.ids = make(map[*Event]string)
+	m.walkTransitions(func(id, _ string, t *Transition) {
+		c.ids[t.Trigger] = id
+	})
+	m.coverage = c
+	return c
+}
+
+// Coverage returns the tracked coverage or nil if it isn't enabled.
+func (m *Machine) Coverage() *Coverage {
+	return m.coverage
+}
+
+// walkTransitions calls f for every transition of the machine in the
+// deterministic order. id is the location of the transition and from the path
+// of its state, which is empty for the global transitions.
+func (m *Machine) walkTransitions(f func(id, from string, t *Transition)) {
+	m.walkStates(func(path string, state *State) {
+		if state == nil {
+			return
+		}
+		for i, t := range state.Transitions {
+			if t != nil && t.Trigger != nil {
+				f(transitionID(path, i), path, t)
+			}
+		}
+	})
+	for i, t := range m.GlobalTransitions {
+		if t != nil && t.Trigger != nil {
+			f(transitionID("", i), "", t)
+		}
+	}
+}
+
+// transitionID returns the location of the transition of the state, or of the
+// global transition if the state is empty.
+func transitionID(state string, i int) string {
+	if state == "" {
+		return fmt.Sprintf("global_transitions[%d]", i)
+	}
+	return fmt.Sprintf("%s.transitions[%d]", state, i)
+}
+
+// coverStep records the fired transition, which can be nil when the machine
+// starts, and the current state with its parents.
+func (m *Machine) coverStep(t *Transition) {
+	c := m.coverage
+	if c == nil {
+		return
+	}
+	if t != nil {
+		if id, ok := c.ids[t.Trigger]; ok {
+			c.Transitions[id]++
+		}
+	}
+	for p := m.Current; p != ""; p = parentPath(p) {
+		c.States[p]++
+	}
+}
+
+// CoverageReport is the coverage of the machine in the deterministic order.
+// It can be marshaled to JSON, and String returns it as text.
+type CoverageReport struct {
+	Machine     string               `json:"machine,omitempty"`
+	States      []StateCoverage      `json:"states"`
+	Transitions []TransitionCoverage `json:"transitions"`
+
+	StatesCovered      int `json:"states_covered"`
+	TransitionsCovered int `json:"transitions_covered"`
+}
+
+// StateCoverage is the number of visits of the state.
+type StateCoverage struct {
+	State  string `json:"state"`
+	Visits int    `json:"visits"`
+}
+
+// TransitionCoverage is the number of times the transition has fired.
+type TransitionCoverage struct {
+	ID      string `json:"id"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Trigger string `json:"trigger"`
+	Fired   int    `json:"fired"`
+}
+
+// CoverageReport builds the report of the coverage against all the states and
+// transitions of the machine. The coverage can be merged from several runs.
+func (m *Machine) CoverageReport(c *Coverage) *CoverageReport {
+	if c == nil {
+		c = NewCoverage()
+	}
+	r := &CoverageReport{Machine: m.Name}
+	m.walkStates(func(path string, _ *State) {
+		visits := c.States[path]
+		if visits > 0 {
+			r.StatesCovered++
+		}
+		r.States = append(r.States, StateCoverage{State: path, Visits: visits})
+	})
+	m.walkTransitions(func(id, from string, t *Transition) {
+		fired := c.Transitions[id]
+		if fired > 0 {
+			r.TransitionsCovered++
+		}
+		if from == "" {
+			from = globalState
+		}
+		r.Transitions = append(r.Transitions, TransitionCoverage{
+			ID:      id,
+			From:    from,
+			To:      m.diagramTarget(parentScope(from), t.Target),
+			Trigger: t.Trigger.String(),
+			Fired:   fired,
+		})
+	})
+	return r
+}
+
+// parentScope returns the scope where the transitions of the state are
+// resolved, i.e. the state itself and the top level for global transitions.
+func parentScope(from string) string {
+	if from == globalState {
+		return ""
+	}
+	return from
+}
+
+// Full tells if all the states and transitions are covered.
+func (r *CoverageReport) Full() bool {
+	return r.StatesCovered == len(r.States) &&
+		r.TransitionsCovered == len(r.Transitions)
+}
+
+func (r *CoverageReport) String() string {
+	w := new(bytes.Buffer)
+	if r.Machine != "" {
+		fmt.Fprintf(w, "machine: %s\n", r.Machine)
+	}
+	fmt.Fprintf(w, "states: %d/%d (%s)\n", r.StatesCovered, len(r.States),
+		percent(r.StatesCovered, len(r.States)))
+	for _, s := range r.States {
+		if s.Visits == 0 {
+			fmt.Fprintf(w, "  not visited: %s\n", s.State)
+		}
+	}
+	fmt.Fprintf(w, "transitions: %d/%d (%s)\n", r.TransitionsCovered,
+		len(r.Transitions), percent(r.TransitionsCovered, len(r.Transitions)))
+	for _, t := range r.Transitions {
+		if t.Fired == 0 {
+			fmt.Fprintf(w, "  not fired: %s: %s --> %s: %s\n", t.ID, t.From,
+				t.To, t.Trigger)
+		}
+	}
+	return w.String()
+}
+
+func percent(n, total int) string {
+	if total == 0 {
+		return "100.0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
@@ -0,0 +1,119 @@
+package fsm
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestMachine_Coverage(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "nested.yaml", Data: []byte(nestedMachineYAML)})
+	try.To(m.Initialize())
+	assert.That(m.Coverage() == nil)
+	c := m.EnableCoverage()
+	m.Start(nil)
+	for _, input := range []string{"register", "me@example.com", "cancel"} {
+		status := protocolStatus(agency.Protocol_BASIC_MESSAGE, input)
+		transition := m.Triggers(status)
+		transition.BuildSendEvents(status)
+		m.Step(transition)
+	}
+	assert.Equal(m.Coverage(), c)
+	assert.DeepEqual(c.States, map[string]int{
+		"IDLE":               2,
+		"REGISTER":           2,
+		"REGISTER/ASK_EMAIL": 1,
+		"REGISTER/ASK_PIN":   1,
+	})
+	assert.DeepEqual(c.Transitions, map[string]int{
+		"IDLE.transitions[0]":               1,
+		"REGISTER.transitions[0]":           1,
+		"REGISTER/ASK_EMAIL.transitions[0]": 1,
+	})
+
+	r := m.CoverageReport(c)
+	assert.Equal(r.Machine, "nested machine")
+	assert.SLen(r.States, 5)
+	assert.Equal(r.StatesCovered, 4)
+	assert.SLen(r.Transitions, 4)
+	assert.Equal(r.TransitionsCovered, 3)
+	assert.That(!r.Full())
+	assert.Equal(r.String(), `machine: nested machine
+states: 4/5 (80.0%)
+  not visited: REGISTER/DONE
+transitions: 3/4 (75.0%)
+  not fired: REGISTER/ASK_PIN.transitions[0]: REGISTER/ASK_PIN --> REGISTER/DONE: basic_message{== "123"}
+`)
+
+	data := try.To1(json.Marshal(r))
+	var r2 CoverageReport
+	try.To(json.Unmarshal(data, &r2))
+	assert.DeepEqual(&r2, r)
+
+	// another run covers the rest
+	m2 := NewMachine(MachineData{FType: "nested.yaml", Data: []byte(nestedMachineYAML)})
+	try.To(m2.Initialize())
+	c2 := m2.EnableCoverage()
+	m2.Start(nil)
+	for _, input := range []string{"register", "me@example.com", "123"} {
+		status := protocolStatus(agency.Protocol_BASIC_MESSAGE, input)
+		transition := m2.Triggers(status)
+		transition.BuildSendEvents(status)
+		m2.Step(transition)
+	}
+	merged := NewCoverage()
+	merged.Merge(c)
+	merged.Merge(c2)
+	merged.Merge(nil)
+	assert.Equal(merged.States["REGISTER/ASK_EMAIL"], 2)
+	assert.That(m.CoverageReport(merged).Full())
+}
+
+func TestMachine_CoverageGlobal(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "global.yaml", Data: []byte(globalMachineYAML)})
+	try.To(m.Initialize())
+	c := m.EnableCoverage()
+	m.Start(nil)
+	for _, input := range []string{"start", "help", "reset"} {
+		m.Step(m.Triggers(protocolStatus(agency.Protocol_BASIC_MESSAGE, input)))
+	}
+	assert.DeepEqual(c.Transitions, map[string]int{
+		"IDLE.transitions[0]":        1,
+		"WAITING_PIN.transitions[0]": 1,
+		"global_transitions[0]":      1,
+	})
+	r := m.CoverageReport(c)
+	assert.Equal(r.Transitions[4].From, "global_transitions")
+	assert.Equal(r.Transitions[4].To, "global_transitions")
+	assert.Equal(r.TransitionsCovered, 3)
+}
+
+func TestMachine_CoverageDiagrams(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "global.yaml", Data: []byte(globalMachineYAML)})
+	try.To(m.Initialize())
+	c := m.EnableCoverage()
+	m.Start(nil)
+	m.Step(m.Triggers(protocolStatus(agency.Protocol_BASIC_MESSAGE, "start")))
+
+	s := m.PlantUMLCoverage(c)
+	assert.That(strings.Contains(s, "IDLE --> WAITING_PIN"), s)
+	assert.That(strings.Contains(s, "WAITING_PIN -[#FF6666,bold]-> DONE"), s)
+	assert.That(strings.Contains(s, "as DONE #FF6666"), s)
+	assert.Equal(m.String(), m.plantUML(nil))
+
+	s = m.MermaidCoverage(c)
+	assert.That(strings.Contains(s, "IDLE --> WAITING_PIN : basic_message{== #quot;start#quot;}\n"), s)
+	assert.That(strings.Contains(s, "WAITING_PIN --> DONE : basic_message{== #quot;123#quot;}<br>(not covered)\n"), s)
+	assert.That(strings.Contains(s, "classDef uncovered fill:#FF6666\nclass DONE uncovered\n"), s)
+	assert.Equal(m.Mermaid(), m.mermaid(nil))
+}
@@ -0,0 +1,260 @@
+package fsm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// globalState is the pseudo state of the diagrams where the global transitions
+// are drawn from, because they would be too noisy if drawn from every state.
+const globalState = "global_transitions"
+
+// diagramTarget returns the full path of the transition's target for the
+// diagrams. The machine doesn't need to be initialized, and that's why the
+// target is resolved from the scope state.
+func (m *Machine) diagramTarget(scope, target string) string {
+	if target == TargetCurrent {
+		if scope == "" {
+			return globalState
+		}
+		return scope
+	}
+	if path, ok := m.resolvePath(scope, target); ok {
+		return path
+	}
+	return target
+}
+
+// transitionLabel returns the trigger and the sends of the transition as
+// lines.
+func transitionLabel(t *Transition) []string {
+	lines := []string{t.Trigger.String()}
+	for _, send := range t.Sends {
+		lines = append(lines, fmt.Sprintf("{%s} ==>", send))
+	}
+	return lines
+}
+
+// Mermaid returns the machine as a Mermaid state diagram. States are in
+// alphabetical order that the output is the same for the same machine.
+func (m *Machine) Mermaid() string {
+	return m.mermaid(nil)
+}
+
+// MermaidCoverage returns the Mermaid state diagram like Mermaid, but the
+// states not covered are highlighted with the uncovered class, and the
+// transitions not covered are marked in their labels, because Mermaid state
+// diagrams cannot style the transitions.
+func (m *Machine) MermaidCoverage(c *Coverage) string {
+	if c == nil {
+		c = NewCoverage()
+	}
+	return m.mermaid(c)
+}
+
+func (m *Machine) mermaid(c *Coverage) string {
+	w := new(bytes.Buffer)
+	if m.Name != "" {
+		fmt.Fprintf(w, "---\ntitle: %s\n---\n", m.Name)
+	}
+	fmt.Fprintln(w, "stateDiagram-v2")
+	if m.Initial != nil {
+		fmt.Fprintf(w, "[*] --> %s\n", stateAlias(m.diagramTarget("", m.Initial.Target)))
+	}
+	m.writeMermaidStates(w, c, "", m.States)
+	if len(m.GlobalTransitions) > 0 {
+		fmt.Fprintf(w, "state \"global transitions\" as %s\n", globalState)
+		for i, transition := range m.GlobalTransitions {
+			fmt.Fprintf(w, "%s --> %s : %s\n", globalState,
+				stateAlias(m.diagramTarget("", transition.Target)),
+				mermaidLabel(coverageLabel(c, transitionID("", i),
+					transitionLabel(transition))))
+		}
+	}
+	if c != nil {
+		var uncovered []string
+		m.walkStates(func(path string, _ *State) {
+			if c.States[path] == 0 {
+				uncovered = append(uncovered, stateAlias(path))
+			}
+		})
+		if len(uncovered) > 0 {
+			fmt.Fprintf(w, "classDef uncovered fill:%s\n", uncoveredColor)
+			fmt.Fprintf(w, "class %s uncovered\n", strings.Join(uncovered, ","))
+		}
+	}
+	return w.String()
+}
+
+// coverageLabel adds the not covered line to the label of the transition if
+// it isn't covered.
+func coverageLabel(c *Coverage, id string, lines []string) []string {
+	if c != nil && c.Transitions[id] == 0 {
+		return append(lines, "(not covered)")
+	}
+	return lines
+}
+
+func (m *Machine) writeMermaidStates(w *bytes.Buffer, c *Coverage, parent string, states map[string]*State) {
+	for _, name := range sortedStateNames(states) {
+		state := states[name]
+		path := joinPath(parent, name)
+		alias := stateAlias(path)
+		fmt.Fprintf(w, "state \"%s\" as %s\n", mermaidEscape(name), alias)
+		if state.IsComposite() {
+			fmt.Fprintf(w, "state %s {\n", alias)
+			fmt.Fprintf(w, "[*] --> %s\n", stateAlias(joinPath(path, state.Initial)))
+			m.writeMermaidStates(w, c, path, state.States)
+			fmt.Fprintln(w, "}")
+		}
+		for _, send := range state.OnEntry {
+			fmt.Fprintf(w, "%s : entry / %s\n", alias, mermaidEscape(send.String()))
+		}
+		for _, send := range state.OnExit {
+			fmt.Fprintf(w, "%s : exit / %s\n", alias, mermaidEscape(send.String()))
+		}
+		for i, transition := range state.Transitions {
+			fmt.Fprintf(w, "%s --> %s : %s\n", alias,
+				stateAlias(m.diagramTarget(path, transition.Target)),
+				mermaidLabel(coverageLabel(c, transitionID(path, i),
+					transitionLabel(transition))))
+		}
+		if state.Terminate {
+			fmt.Fprintf(w, "%s --> [*]\n", alias)
+		}
+	}
+}
+
+func mermaidLabel(lines []string) string {
+	for i := range lines {
+		lines[i] = mermaidEscape(lines[i])
+	}
+	return strings.Join(lines, "<br>")
+}
+
+var mermaidReplacer = strings.NewReplacer(
+	"#", "#35;",
+	";", "#59;",
+	"\"", "#quot;",
+	"\n", " ",
+)
+
+// mermaidEscape escapes the characters which would end Mermaid statements or
+// strings with Mermaid's entity codes.
+func mermaidEscape(s string) string {
+	return mermaidReplacer.Replace(s)
+}
+
+// DOT returns the machine as a Graphviz DOT digraph. Composite states are
+// clusters, terminate states have double borders and they have a transition
+// to the end node. States are in alphabetical order that the output is the
+// same for the same machine.
+func (m *Machine) DOT() string {
+	d := &dotWriter{m: m, w: new(bytes.Buffer)}
+	w := d.w
+	fmt.Fprintln(w, "digraph fsm {")
+	if m.Name != "" {
+		fmt.Fprintf(w, "label=%s\nlabelloc=t\n", dotQuote(m.Name))
+	}
+	fmt.Fprintln(w, "compound=true")
+	fmt.Fprintln(w, "node [shape=box, style=rounded]")
+	fmt.Fprintln(w, "__start [shape=point, width=0.2]")
+	if m.Initial != nil {
+		d.edge("__start", m.diagramTarget("", m.Initial.Target), nil)
+	}
+	d.writeStates("", m.States)
+	if len(m.GlobalTransitions) > 0 {
+		fmt.Fprintf(w, "%s [label=\"global transitions\", style=dashed]\n",
+			dotQuote(globalState))
+		for _, transition := range m.GlobalTransitions {
+			d.edge(globalState, m.diagramTarget("", transition.Target),
+				transitionLabel(transition))
+		}
+	}
+	if d.end {
+		fmt.Fprintln(w, "__end [shape=doublecircle, label=\"\", width=0.2]")
+	}
+	fmt.Fprintln(w, "}")
+	return w.String()
+}
+
+type dotWriter struct {
+	m   *Machine
+	w   *bytes.Buffer
+	end bool // is there terminate states
+}
+
+func (d *dotWriter) writeStates(parent string, states map[string]*State) {
+	for _, name := range sortedStateNames(states) {
+		state := states[name]
+		path := joinPath(parent, name)
+		if state.IsComposite() {
+			fmt.Fprintf(d.w, "subgraph %s {\n", dotQuote("cluster_"+path))
+			fmt.Fprintf(d.w, "label=%s\n", dotQuote(stateLabel(name, state)))
+			d.writeStates(path, state.States)
+			fmt.Fprintln(d.w, "}")
+		} else {
+			attrs := ""
+			if state.Terminate {
+				attrs = ", peripheries=2"
+			}
+			fmt.Fprintf(d.w, "%s [label=%s%s]\n", dotQuote(path),
+				dotQuote(stateLabel(name, state)), attrs)
+		}
+		for _, transition := range state.Transitions {
+			d.edge(path, d.m.diagramTarget(path, transition.Target),
+				transitionLabel(transition))
+		}
+		if state.Terminate {
+			d.end = true
+			d.edge(path, "__end", nil)
+		}
+	}
+}
+
+// edge writes the edge between the states. Graphviz doesn't have edges
+// between clusters, and that's why the edges of the composite states are
+// drawn from and to their initial states, and clipped to the cluster borders.
+func (d *dotWriter) edge(from, to string, label []string) {
+	var attrs []string
+	if label != nil {
+		attrs = append(attrs, "label="+dotQuote(strings.Join(label, "\n")))
+	}
+	node := func(path, attr string) string {
+		if state := d.m.State(path); state != nil && state.IsComposite() {
+			attrs = append(attrs, attr+"="+dotQuote("cluster_"+path))
+			return d.m.leafPath(path)
+		}
+		return path
+	}
+	from = node(from, "ltail")
+	to = node(to, "lhead")
+	fmt.Fprintf(d.w, "%s -> %s", dotQuote(from), dotQuote(to))
+	if len(attrs) > 0 {
+		fmt.Fprintf(d.w, " [%s]", strings.Join(attrs, ", "))
+	}
+	fmt.Fprintln(d.w)
+}
+
+// stateLabel returns the state name with its entry and exit sends.
+func stateLabel(name string, state *State) string {
+	lines := []string{name}
+	for _, send := range state.OnEntry {
+		lines = append(lines, "entry / "+send.String())
+	}
+	for _, send := range state.OnExit {
+		lines = append(lines, "exit / "+send.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+var dotReplacer = strings.NewReplacer(
+	"\\", "\\\\",
+	"\"", "\\\"",
+	"\n", "\\n",
+)
+
+func dotQuote(s string) string {
+	return "\"" + dotReplacer.Replace(s) + "\""
+}
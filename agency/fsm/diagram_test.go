@@ -0,0 +1,78 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+)
+
+func TestMachine_Mermaid(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "global.yaml", Data: []byte(globalMachineYAML)})
+	assert.Equal(m.Mermaid(), `---
+title: global machine
+---
+stateDiagram-v2
+[*] --> IDLE
+state "DONE" as DONE
+DONE --> [*]
+state "IDLE" as IDLE
+IDLE --> WAITING_PIN : basic_message{== #quot;start#quot;}
+state "WAITING_PIN" as WAITING_PIN
+WAITING_PIN --> WAITING_PIN : basic_message{== #quot;help#quot;}<br>{basic_message{ #quot;Please enter#quot;}} ==>
+WAITING_PIN --> DONE : basic_message{== #quot;123#quot;}
+state "global transitions" as global_transitions
+global_transitions --> IDLE : basic_message{== #quot;reset#quot;}
+global_transitions --> global_transitions : basic_message{== #quot;help#quot;}<br>{basic_message{ #quot;Say start.#quot;}} ==>
+`)
+
+	m = NewMachine(MachineData{FType: "nested.yaml", Data: []byte(nestedMachineYAML)})
+	s := m.Mermaid()
+	assert.That(strings.Contains(s, "state REGISTER {\n[*] --> REGISTER_ASK_EMAIL\n"), s)
+	assert.That(strings.Contains(s, "REGISTER_DONE --> [*]\n}\n"), s)
+}
+
+func TestMachine_DOT(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "global.yaml", Data: []byte(globalMachineYAML)})
+	assert.Equal(m.DOT(), `digraph fsm {
+label="global machine"
+labelloc=t
+compound=true
+node [shape=box, style=rounded]
+__start [shape=point, width=0.2]
+"__start" -> "IDLE"
+"DONE" [label="DONE", peripheries=2]
+"DONE" -> "__end"
+"IDLE" [label="IDLE"]
+"IDLE" -> "WAITING_PIN" [label="basic_message{== \"start\"}"]
+"WAITING_PIN" [label="WAITING_PIN"]
+"WAITING_PIN" -> "WAITING_PIN" [label="basic_message{== \"help\"}\n{basic_message{ \"Please enter\"}} ==>"]
+"WAITING_PIN" -> "DONE" [label="basic_message{== \"123\"}"]
+"global_transitions" [label="global transitions", style=dashed]
+"global_transitions" -> "IDLE" [label="basic_message{== \"reset\"}"]
+"global_transitions" -> "global_transitions" [label="basic_message{== \"help\"}\n{basic_message{ \"Say start.\"}} ==>"]
+__end [shape=doublecircle, label="", width=0.2]
+}
+`)
+
+	m = NewMachine(MachineData{FType: "nested.yaml", Data: []byte(nestedMachineYAML)})
+	s := m.DOT()
+	assert.That(strings.Contains(s, `"IDLE" -> "REGISTER/ASK_EMAIL" [label="basic_message{== \"register\"}", lhead="cluster_REGISTER"]`), s)
+	assert.That(strings.Contains(s, `ltail="cluster_REGISTER"`), s)
+}
+
+func TestMachine_DiagramsDeterministic(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	for i := 0; i < 10; i++ {
+		m1 := NewMachine(MachineData{FType: "nested.yaml", Data: []byte(nestedMachineYAML)})
+		m2 := NewMachine(MachineData{FType: "nested.yaml", Data: []byte(nestedMachineYAML)})
+		assert.Equal(m1.String(), m2.String())
+		assert.Equal(m1.Mermaid(), m2.Mermaid())
+		assert.Equal(m1.DOT(), m2.DOT())
+	}
+}
@@ -2,8 +2,8 @@ package fsm
 
 import (
 	"encoding/json"
+	"time"
 
-	"github.com/Shopify/go-lua"
 	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
 	"github.com/golang/glog"
 	"github.com/lainio/err2"
@@ -13,6 +13,15 @@ import (
 
 type NotificationType int32
 
+// QuestionType returns the question type if the notification type is given
+// with one of the QuestionTypeID names.
+func (t NotificationType) QuestionType() (agency.Question_Type, bool) {
+	if t < questionTypeFactor || t%questionTypeFactor != 0 {
+		return agency.Question_NONE, false
+	}
+	return agency.Question_Type(t / questionTypeFactor), true
+}
+
 type Event struct {
 	// TODO: questions could be protocols here, then TypeID would not be needed?
 	// we will continue with this when other protocol QAs will be implemented
@@ -36,9 +45,31 @@ type Event struct {
 	*EventData `json:"event_data,omitempty"`
 
 	NoEcho bool `json:"no_echo,omitempty"`
+	// Route of the backend send, see RouteConn. The room is the send's
+	// Subject, or the SUBJECT register if it isn't given.
+	Route string `json:"route,omitempty"`
+	// Service is the name of the backend machine the conversation's backend
+	// send is for. The default backend machine has no name.
+	Service string `json:"service,omitempty"`
 
 	ProtocolType     agency.Protocol_Type `json:"-"`
 	NotificationType NotificationType     `json:"-"`
+
+	// duration of the timer trigger parsed from Data
+	duration time.Duration
+	// luaScript is the LUA rule's script where file links are already read.
+	// It's set by Initialize and ReloadLua.
+	luaScript string
+	// proof is the structured proof request of the send given in the machine
+	// file, see buildProofSend.
+	proof *Proof
+	// issuing is the structured issuing of the send given in the machine
+	// file, see buildIssuingSend.
+	issuing *Issuing
+	// backend is the backend data of the send given in the machine file.
+	backend *BackendData
+	// constraints are the parsed data of the verify rules, see AttrConstraint.
+	constraints []AttrConstraint
 	// NotificationType agency.Notification_Type `json:"-"`
 
 	*agency.ProtocolStatus `json:"-"`
@@ -61,6 +92,10 @@ func (e *Event) filterEnvs() {
 	case agency.Protocol_PRESENT_PROOF:
 		if e.EventData != nil && e.EventData.Proof != nil {
 			e.EventData.Proof.ProofJSON = filterEnvs(e.EventData.Proof.ProofJSON)
+			for i := range e.EventData.Proof.Attributes {
+				attr := &e.EventData.Proof.Attributes[i]
+				attr.CredDefID = filterEnvs(attr.CredDefID)
+			}
 		}
 		e.Data = filterEnvs(e.Data)
 	default:
@@ -82,11 +117,14 @@ func (e Event) TriggersByBackendData(data *BackendData) (ok bool, tgt string) {
 	case TriggerTypeInputEqual:
 		return content == e.Data, ""
 	case TriggerTypeData, TriggerTypeUseInput, TriggerTypeUseInputSave,
+		TriggerTypeTransient,
 		TriggerTypeUseInputSaveConnID, TriggerTypeUseInputSaveSessionID:
 		return true, ""
 	case TriggerTypeLua:
 		_, target, ok := e.ExecLua(content)
 		return ok, target
+	case TriggerTypeRoomJoin, TriggerTypeRoomLeave, TriggerTypeRoomList:
+		return e.triggersRoom(data), ""
 	}
 	return false, ""
 }
@@ -105,6 +143,29 @@ func (e *Event) copyBackendDataValuesToMemory(data *BackendData) {
 	}
 }
 
+// data returns the data of the input event, which can be nil when the sends
+// are built without input, e.g. on_entry sends.
+func (e *Event) data() string {
+	if e == nil {
+		return ""
+	}
+	return e.Data
+}
+
+// content returns the content of the input event for the USE_INPUT sends. It's
+// the message of the basic message and the backend inputs, otherwise the data.
+func (e *Event) content() string {
+	switch {
+	case e == nil:
+		return ""
+	case e.EventData != nil && e.BasicMessage != nil:
+		return e.BasicMessage.Content
+	case e.EventData != nil && e.Backend != nil:
+		return e.Backend.Content
+	}
+	return e.Data
+}
+
 func (e Event) TriggersByHook() bool {
 	return true
 }
@@ -113,6 +174,9 @@ func (e Event) Triggers(status *agency.ProtocolStatus) (ok bool, tgt string) {
 	if status == nil {
 		return true, ""
 	}
+	if _, ok := e.NotificationType.QuestionType(); ok {
+		return false, "" // answers only the questions
+	}
 	switch status.GetState().ProtocolID.TypeID {
 	case agency.Protocol_ISSUE_CREDENTIAL, agency.Protocol_DIDEXCHANGE, agency.Protocol_PRESENT_PROOF:
 		return true, ""
@@ -137,6 +201,10 @@ func (e Event) Triggers(status *agency.ProtocolStatus) (ok bool, tgt string) {
 	return false, ""
 }
 
+// ExecLua executes the event's Lua script with the content as an INPUT. If the
+// script fails, the error is stored to the ERR register and the target is the
+// error target of the machine's LuaConfig if it's set. With LUA_ALL_OK, i.e.
+// in sends, ok is false when the script fails.
 func (e Event) ExecLua(content string, a ...string) (out, tgt string, ok bool) {
 	defer err2.Catch(err2.Err(func(err error) {
 		ok = false
@@ -147,8 +215,19 @@ func (e Event) ExecLua(content string, a ...string) (out, tgt string, ok bool) {
 		okStr = a[0]
 	}
 	e.Machine.Memory[LUA_INPUT] = content
-	luaScript := filterFilelink(e.Data)
-	try.To(lua.DoString(e.Machine.luaState, luaScript))
+	luaScript := e.luaScript
+	if luaScript == "" {
+		luaScript = filterFilelink(e.Data)
+	}
+	if err := e.Machine.runLua(luaScript); err != nil {
+		glog.Errorln("lua error:", err)
+		e.Machine.Memory[LUA_ERROR] = err.Error()
+		tgt = e.Machine.Lua.errorTarget()
+		if okStr == LUA_ALL_OK {
+			return "", tgt, false
+		}
+		return "", tgt, tgt != ""
+	}
 	out, ok = e.Machine.Memory[LUA_OUTPUT]
 	if !ok {
 		glog.Warning("lua script: no output. Trying to get error")
@@ -163,46 +242,223 @@ func (e Event) ExecLua(content string, a ...string) (out, tgt string, ok bool) {
 	return out, tgt, ok
 }
 
-func (e Event) Answers(status *agency.Question) bool {
-	switch status.TypeID {
-	case agency.Question_PING_WAITS:
-	case agency.Question_ISSUE_PROPOSE_WAITS:
-	case agency.Question_PROOF_PROPOSE_WAITS:
-	case agency.Question_PROOF_VERIFY_WAITS:
-		assert.Equal(e.ProtocolType, agency.Protocol_PRESENT_PROOF)
+// Answers tells if the trigger answers the question. It returns the target if
+// the trigger's Lua script gives one. The question type is given with the
+// type_id, e.g. ANSWER_NEEDED_ISSUE_PROPOSE. Without it, present_proof
+// triggers answer the proof verifications for backward compatibility.
+//
+// VERIFY_AND_INPUT_VALUES and NOT_VERIFY_VALUES check the values against the
+// constraints, see verifies. Otherwise the proof verifications are answered
+// with the proof attributes in the data, see answersProofVerify. For the
+// other questions the data is optional:
+//
+//	ACCEPT_AND_INPUT_VALUES triggers if the proposal matches the data, and it
+//	  copies the proposed values to the memory.
+//	NOT_ACCEPT_VALUES triggers if the proposal doesn't match the data.
+//	LUA triggers if the script accepts the proposal JSON given as INPUT.
+//	"" triggers always, e.g. to decline all.
+//
+// The connection ID and the cred def ID of the proposal are copied to the
+// memory when the trigger answers.
+func (e Event) Answers(q *agency.Question) (ok bool, tgt string) {
+	if e.QuestionType() != q.TypeID {
+		return false, ""
+	}
+	if e.Rule == TriggerTypeVerifyAndInputValues ||
+		e.Rule == TriggerTypeNotVerifyValues {
+		return e.verifies(newProposal(q)), ""
+	}
+	if q.TypeID == agency.Question_PROOF_VERIFY_WAITS {
+		return e.answersProofVerify(q), ""
+	}
+	p := newProposal(q)
+	switch e.Rule {
+	case TriggerTypeAcceptAndInputValues:
+		if !e.acceptsProposal(p) {
+			return false, ""
+		}
+		p.copyToMemory(e.Machine.Memory, true)
+		return true, ""
+	case TriggerTypeNotAcceptValues:
+		if e.acceptsProposal(p) {
+			return false, ""
+		}
+		p.copyToMemory(e.Machine.Memory, false)
+		return true, ""
+	case TriggerTypeData:
+		p.copyToMemory(e.Machine.Memory, false)
+		return true, ""
+	case TriggerTypeLua:
+		p.copyToMemory(e.Machine.Memory, false)
+		_, tgt, ok = e.ExecLua(p.String())
+		return ok, tgt
+	}
+	return false, ""
+}
+
+// QuestionType returns the type of the questions which the trigger answers, or
+// NONE if it doesn't answer questions.
+func (e Event) QuestionType() agency.Question_Type {
+	if qt, ok := e.NotificationType.QuestionType(); ok {
+		return qt
+	}
+	if e.ProtocolType == agency.Protocol_PRESENT_PROOF {
+		return agency.Question_PROOF_VERIFY_WAITS
+	}
+	return agency.Question_NONE
+}
 
-		var attrValues []ProofAttr
-		try.To(json.Unmarshal([]byte(e.Data), &attrValues))
+// answersProofVerify answers the proof values. ACCEPT_AND_INPUT_VALUES
+// triggers if all the values are listed in the data, and it copies the values
+// to the memory. NOT_ACCEPT_VALUES triggers if the values aren't exactly the
+// ones listed in the data. The data items with a predicate are the requested
+// predicates. The agency has verified them with the proof, and the accept
+// stores "true" to the memory by their names.
+func (e Event) answersProofVerify(status *agency.Question) bool {
+	assert.Equal(e.ProtocolType, agency.Protocol_PRESENT_PROOF)
 
-		switch e.Rule {
-		case TriggerTypeNotAcceptValues:
-			if len(attrValues) != len(status.GetProofVerify().Attributes) {
-				return true
-			}
-			for _, attr := range status.GetProofVerify().Attributes {
-				for i, value := range attrValues {
-					if value.Name == attr.Name && value.CredDefID == attr.CredDefID {
-						attrValues[i].found = true
-					}
+	if e.Rule != TriggerTypeNotAcceptValues &&
+		e.Rule != TriggerTypeAcceptAndInputValues {
+		return false // e.g. status triggers of present_proof
+	}
+
+	var attrValues, predicates []ProofAttr
+	try.To(json.Unmarshal([]byte(e.Data), &attrValues))
+	attrValues, predicates = splitPredicates(attrValues)
+
+	switch e.Rule {
+	case TriggerTypeNotAcceptValues:
+		if len(attrValues) != len(status.GetProofVerify().Attributes) {
+			return true
+		}
+		for _, attr := range status.GetProofVerify().Attributes {
+			for i, value := range attrValues {
+				if value.Name == attr.Name && value.CredDefID == attr.CredDefID {
+					attrValues[i].found = true
 				}
 			}
-			for _, value := range attrValues {
-				if !value.found {
-					return true
-				}
+		}
+		for _, value := range attrValues {
+			if !value.found {
+				return true
 			}
-		case TriggerTypeAcceptAndInputValues:
-			count := 0
-			for _, attr := range status.GetProofVerify().Attributes {
-				for _, value := range attrValues {
-					if value.Name == attr.Name {
-						e.Machine.Memory[value.Name] = attr.Value
-						count++
-					}
+		}
+	case TriggerTypeAcceptAndInputValues:
+		count := 0
+		for _, attr := range status.GetProofVerify().Attributes {
+			for _, value := range attrValues {
+				if value.Name == attr.Name {
+					e.Machine.Memory[value.Name] = attr.Value
+					count++
 				}
 			}
-			return count == len(status.GetProofVerify().Attributes)
 		}
+		if count != len(status.GetProofVerify().Attributes) {
+			return false
+		}
+		// the agency doesn't give the predicates' values, but the proof is
+		// verified only if all the requested predicates hold
+		for _, predicate := range predicates {
+			e.Machine.Memory[predicate.Name] = "true"
+		}
+		return true
 	}
 	return false
 }
+
+// splitPredicates splits the predicates from the attributes.
+func splitPredicates(all []ProofAttr) (attrs, predicates []ProofAttr) {
+	for _, a := range all {
+		if a.Predicate != "" {
+			predicates = append(predicates, a)
+		} else {
+			attrs = append(attrs, a)
+		}
+	}
+	return attrs, predicates
+}
+
+// acceptsProposal tells if every proposed value is listed in the trigger's
+// data by its name, and by its cred def ID if the data has it. Empty data
+// accepts all.
+func (e Event) acceptsProposal(p *proposal) bool {
+	if e.Data == "" {
+		return true
+	}
+	var attrs []ProofAttr
+	if err := json.Unmarshal([]byte(e.Data), &attrs); err != nil {
+		glog.Errorln("proposal attributes:", err)
+		return false
+	}
+	for _, value := range p.Values {
+		found := false
+		for _, attr := range attrs {
+			if attr.Name == value.Name &&
+				(attr.CredDefID == "" || attr.CredDefID == value.CredDefID) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// proposal is the payload of the question. The agency gives the values only
+// for the issue proposals, and for the proof proposals if it has them.
+type proposal struct {
+	ConnID    string          `json:"conn_id,omitempty"`
+	CredDefID string          `json:"cred_def_id,omitempty"`
+	Values    []proposedValue `json:"values,omitempty"`
+}
+
+type proposedValue struct {
+	Name      string `json:"name"`
+	Value     string `json:"value"`
+	CredDefID string `json:"cred_def_id,omitempty"`
+}
+
+func newProposal(q *agency.Question) *proposal {
+	p := &proposal{ConnID: q.GetStatus().GetNotification().GetConnectionID()}
+	if ip := q.GetIssuePropose(); ip != nil {
+		p.CredDefID = ip.CredDefID
+		if ip.ValuesJSON != "" {
+			if err := json.Unmarshal([]byte(ip.ValuesJSON), &p.Values); err != nil {
+				glog.Errorln("issue proposal values:", err)
+			}
+		}
+		for i := range p.Values {
+			p.Values[i].CredDefID = ip.CredDefID
+		}
+	}
+	for _, attr := range q.GetProofVerify().GetAttributes() {
+		p.Values = append(p.Values, proposedValue{
+			Name:      attr.Name,
+			Value:     attr.Value,
+			CredDefID: attr.CredDefID,
+		})
+	}
+	return p
+}
+
+// copyToMemory copies the IDs, and the values if asked, to the memory.
+func (p *proposal) copyToMemory(memory map[string]string, values bool) {
+	if p.ConnID != "" {
+		memory[LUA_CONN_ID] = p.ConnID
+	}
+	if p.CredDefID != "" {
+		memory[LUA_CRED_DEF_ID] = p.CredDefID
+	}
+	if values {
+		for _, value := range p.Values {
+			memory[value.Name] = value.Value
+		}
+	}
+}
+
+func (p *proposal) String() string {
+	data, _ := json.Marshal(p) // strings cannot fail
+	return string(data)
+}
@@ -69,8 +69,27 @@ const (
 	// not accept present proof protocol
 	TriggerTypeNotAcceptValues = "NOT_ACCEPT_VALUES"
 
+	// these two verify the proof values, or the proposed values, against the
+	// constraints given in the data, see AttrConstraint. The first accepts
+	// and stores the values to FSM memory map, the second rejects them.
+	TriggerTypeVerifyAndInputValues = "VERIFY_AND_INPUT_VALUES"
+	TriggerTypeNotVerifyValues      = "NOT_VERIFY_VALUES"
+
 	// transient state, just executes without any triggering checks
 	TriggerTypeTransient = "TRANSIENT"
+
+	// these are the room broker rules of the backend machines, see Rooms.
+	// The room is the Subject of the backend data, or the SessionID if it's
+	// empty. The first three are triggers: the sender joins the room with
+	// the callsign of the content, leaves it, or lists the members. If the
+	// trigger has data, the content must start with it, e.g. "/join", and
+	// the rest is the callsign. The last one is a backend send, which
+	// forwards the input to the members of the sender's room with the
+	// sender's callsign.
+	TriggerTypeRoomJoin    = "ROOM_JOIN"
+	TriggerTypeRoomLeave   = "ROOM_LEAVE"
+	TriggerTypeRoomList    = "ROOM_LIST"
+	TriggerTypeRoomForward = "ROOM_FORWARD"
 )
 
 const (
@@ -84,14 +103,21 @@ const (
 
 	MessageAnswer = "answer"
 
-	MessageEmail = "email" // not supported yet
-	MessageHook  = "hook"  // internal program call back
+	MessageHook = "hook" // internal program call back
+
+	// email sends are delivered by the runner of the machine, and email
+	// triggers when the delivery fails. The error is in the ERR register.
+	MessageEmail = "email"
 
 	// these are internal messages send between Backend (service) FSM and
 	// conversation (pairwise connection) FSM
 	MessageBackend = "backend"
 
 	MessageTransient = "transient"
+
+	// timer triggers after the duration given in trigger's data, e.g. "10m",
+	// if the machine is still in the same state.
+	MessageTimer = "timer"
 )
 
 const (
@@ -101,8 +127,14 @@ const (
 
 	BackendProtocol   = 103 // see MessageBackend
 	TransientProtocol = 104 // see MessageTransient
+	TimerProtocol     = 105 // see MessageTimer
 )
 
+// TargetCurrent is a special transition target which keeps the machine in its
+// current state. It's mostly useful in global transitions, e.g. for help
+// replies, which don't know the state where they are triggered.
+const TargetCurrent = "."
+
 const (
 	digitsInPIN = 6
 
@@ -110,9 +142,22 @@ const (
 	LUA_CONN_ID = "CONN_ID" // pairwise ID
 	LUA_SUBJECT = "SUBJECT" // reserved
 
+	// cred def ID of the issue proposal, see Event.Answers
+	LUA_CRED_DEF_ID = "CRED_DEF_ID"
+
+	// invitation of the connection send, see Invitation
+	LUA_INVITATION     = "INVITATION"
+	LUA_INVITATION_URL = "INVITATION_URL"
+
 	// this is in use generally, not only in lua
 	LUA_SESSION_ID = "SESSION_ID"
 
+	// room broker's registers, see Rooms
+	LUA_ROOM         = "ROOM"
+	LUA_CALLSIGN     = "CALLSIGN"
+	LUA_ROOM_MEMBERS = "ROOM_MEMBERS" // callsigns separated by comma
+	LUA_ROOMS        = "ROOMS"        // room names separated by comma
+
 	LUA_INPUT  = "INPUT"  // current incoming data like basic_message.content
 	LUA_OUTPUT = "OUTPUT" // lua scripts output register name
 	LUA_TARGET = "TARGET" // lua scripts target register name
@@ -146,19 +191,29 @@ type State struct {
 
 	Terminate bool `json:"terminate,omitempty"`
 
+	// OnEntry sends are executed when the machine enters the state from
+	// another state, and OnExit sends when it leaves the state. Self
+	// transitions don't execute them. Because there is no input event, only
+	// rules which don't need input are supported, e.g. data and FORMAT_MEM.
+	OnEntry []*Event `json:"on_entry,omitempty"`
+	OnExit  []*Event `json:"on_exit,omitempty"`
+
+	// States makes the state a composite state. Its transitions apply to all
+	// of its children, but the children's own transitions are checked first.
+	// Initial is the name of the child which is entered when the composite
+	// state is the target of a transition. The children's on_entry and
+	// on_exit sends are executed inside the parent's ones.
+	States  map[string]*State `json:"states,omitempty"`
+	Initial string            `json:"initial,omitempty"`
+
+	entry *Transition
+	exit  *Transition
+
 	// TODO: transient state (empedding Lua is tested) + new rules
 	// - we should find proper use case to develop these
-	// - chat room could be a good case
-	//   + use credential to get in. Email credential is need. Or callsign
-	//     cred.
-	//   + login happens by presenting proof of callsign
-	//   + PW-chatbot keeps track of callsigns and the room user is connected
-	//   + backend-chatbot uses room when forwarding msgs
-	//   + end user sends only message. callsign is only added by PW-chatbot
-	//   + pairwise FSM sends room and callsign to backend with msg
-	//   + backend FSM forwards msgs per room and and keeps: callsign
-
-	// we could have onEntry and OnExit ? If that would help, we shall see
+	// - the chat room is done with the backend machine's room broker, see
+	//   the ROOM_ rules. The login by presenting proof of callsign is still
+	//   up to the pairwise machine.
 }
 
 var ruleMap = map[string]string{
@@ -180,6 +235,14 @@ var ruleMap = map[string]string{
 
 	TriggerTypeAcceptAndInputValues: "ACCEPT",
 	TriggerTypeNotAcceptValues:      "DECLINE",
+
+	TriggerTypeVerifyAndInputValues: "VERIFY",
+	TriggerTypeNotVerifyValues:      "REJECT",
+
+	TriggerTypeRoomJoin:    "JOIN",
+	TriggerTypeRoomLeave:   "LEAVE",
+	TriggerTypeRoomList:    "LIST",
+	TriggerTypeRoomForward: "FORWARD",
 }
 
 func removeLF(s string) string {
@@ -198,6 +261,7 @@ type EventData struct {
 	Email        *Email        `json:"email,omitempty"`
 	Proof        *Proof        `json:"proof,omitempty"`
 	Hook         *Hook         `json:"hook,omitempty"`
+	Invitation   *Invitation   `json:"invitation,omitempty"`
 
 	Backend *BackendData `json:"backend,omitempty"`
 }
@@ -212,10 +276,22 @@ type Email struct {
 type Issuing struct {
 	CredDefID string
 	AttrsJSON string
+
+	// Attributes are the structured credential values which are used
+	// instead of the AttrsJSON if given. The FORMAT_MEM rule formats the
+	// values. The names are checked against the cred def by CheckIssuings.
+	Attributes []IssuingAttr `json:"attributes,omitempty"`
 }
 
 type Proof struct {
 	ProofJSON string `json:"proof_json"`
+
+	// Attributes and Predicates are the structured proof request which is
+	// used instead of the ProofJSON if given. Attributes are restricted by
+	// their cred defs if given. The FORMAT_MEM rule formats the names, the
+	// cred def IDs and the predicate values.
+	Attributes []ProofAttr      `json:"attributes,omitempty"`
+	Predicates []ProofPredicate `json:"predicates,omitempty"`
 }
 
 type ProofAttr struct {
@@ -302,6 +378,7 @@ var ProtocolType = map[string]agency.Protocol_Type{
 	MessageHook:         HookProtocol,
 	MessageBackend:      BackendProtocol,
 	MessageTransient:    TransientProtocol,
+	MessageTimer:        TimerProtocol,
 }
 
 var toFileProtocolType = map[agency.Protocol_Type]string{
@@ -316,13 +393,14 @@ var toFileProtocolType = map[agency.Protocol_Type]string{
 	HookProtocol:                     MessageHook,
 	BackendProtocol:                  MessageBackend,
 	TransientProtocol:                MessageTransient,
+	TimerProtocol:                    MessageTimer,
 }
 
 func NotificationTypeID(typeName string) NotificationType {
 	if _, ok := notificationTypeID[typeName]; ok {
 		return NotificationType(notificationTypeID[typeName])
 	} else if _, ok := QuestionTypeID[typeName]; ok {
-		return NotificationType(10) * NotificationType(QuestionTypeID[typeName])
+		return questionTypeFactor * NotificationType(QuestionTypeID[typeName])
 	}
 	glog.V(10).Infof("unknown type: \"%v\" setting zero", typeName)
 	return 0
@@ -333,6 +411,10 @@ var notificationTypeID = map[string]agency.Notification_Type{
 	"ACTION_NEEDED": agency.Notification_PROTOCOL_PAUSED,
 }
 
+// questionTypeFactor separates the question types from the notification types
+// in NotificationType.
+const questionTypeFactor NotificationType = 10
+
 var QuestionTypeID = map[string]agency.Question_Type{
 	"ANSWER_NEEDED_PING":          agency.Question_PING_WAITS,
 	"ANSWER_NEEDED_ISSUE_PROPOSE": agency.Question_ISSUE_PROPOSE_WAITS,
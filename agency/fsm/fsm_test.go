@@ -2,6 +2,7 @@ package fsm
 
 import (
 	"os"
+	"strings"
 	"testing"
 
 	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
@@ -381,3 +382,196 @@ func Test_filterEnvs(t *testing.T) {
 		})
 	}
 }
+
+const entryExitMachineYAML = `
+name: entry exit machine
+initial:
+  target: IDLE
+  sends:
+  - protocol: basic_message
+    data: Hello!
+states:
+  IDLE:
+    on_entry:
+    - protocol: basic_message
+      data: Say something.
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_SAVE
+        data: LINE
+      target: TALKING
+  TALKING:
+    on_entry:
+    - protocol: basic_message
+      rule: FORMAT_MEM
+      data: "You said: {{.LINE}}"
+    on_exit:
+    - protocol: basic_message
+      data: Bye!
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_EQUAL
+        data: stop
+      target: IDLE
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_SAVE
+        data: LINE
+      sends:
+      - protocol: basic_message
+        rule: INPUT
+      target: TALKING
+`
+
+func TestMachine_StepEntryExit(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "entry.yaml", Data: []byte(entryExitMachineYAML)})
+	assert.SLen(m.Validate(), 0)
+	try.To(m.Initialize())
+	sends := m.Start(nil)
+	assert.SLen(sends, 2)
+	assert.Equal(sends[0].BasicMessage.Content, "Hello!")
+	assert.Equal(sends[1].BasicMessage.Content, "Say something.")
+
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE, "hi")
+	transition := m.Triggers(status)
+	assert.SLen(transition.BuildSendEvents(status), 0)
+	sends = m.Step(transition)
+	assert.SLen(sends, 1)
+	assert.Equal(sends[0].BasicMessage.Content, "You said: hi")
+
+	// self transition doesn't execute entry and exit sends
+	status = protocolStatus(agency.Protocol_BASIC_MESSAGE, "again")
+	transition = m.Triggers(status)
+	assert.SLen(transition.BuildSendEvents(status), 1)
+	assert.SLen(m.Step(transition), 0)
+	assert.Equal(m.Current, "TALKING")
+
+	status = protocolStatus(agency.Protocol_BASIC_MESSAGE, "stop")
+	sends = m.Step(m.Triggers(status))
+	assert.SLen(sends, 2)
+	assert.Equal(sends[0].BasicMessage.Content, "Bye!")
+	assert.Equal(sends[1].BasicMessage.Content, "Say something.")
+	assert.Equal(m.Current, "IDLE")
+}
+
+func TestMachine_ValidateEntryNeedsNoInput(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "entry.json", Data: []byte(`{
+"initial":{"target":"IDLE"},
+"states":{"IDLE":{"terminate":true,
+  "on_entry":[{"protocol":"basic_message","rule":"INPUT"}]}}}`)})
+	ds := m.Validate()
+	assert.SLen(ds, 1)
+	assert.Equal(ds[0].Event, "on_entry[0]")
+
+	// the machines loaded without the validator fail already at Initialize
+	err := m.Initialize()
+	assert.Error(err)
+	assert.That(strings.Contains(err.Error(), "needs input"), err.Error())
+}
+
+const globalMachineYAML = `
+name: global machine
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_EQUAL
+        data: start
+      target: WAITING_PIN
+  WAITING_PIN:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_EQUAL
+        data: help
+      sends:
+      - protocol: basic_message
+        data: Please enter the PIN.
+      target: WAITING_PIN
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_VALIDATE_EQUAL
+        data: "123"
+      target: DONE
+  DONE:
+    terminate: true
+global_transitions:
+- trigger:
+    protocol: basic_message
+    rule: INPUT_EQUAL
+    data: reset
+  target: IDLE
+- trigger:
+    protocol: basic_message
+    rule: INPUT_EQUAL
+    data: help
+  sends:
+  - protocol: basic_message
+    data: Say start.
+  target: .
+`
+
+func TestMachine_GlobalTransitions(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "global.yaml", Data: []byte(globalMachineYAML)})
+	assert.SLen(m.Validate(), 0)
+	try.To(m.Initialize())
+	m.Start(nil)
+
+	// global help keeps the machine in the current state
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE, "help")
+	transition := m.Triggers(status)
+	assert.NotNil(transition)
+	assert.Equal(transition.Target, "IDLE")
+	sends := transition.BuildSendEvents(status)
+	assert.SLen(sends, 1)
+	assert.Equal(sends[0].BasicMessage.Content, "Say start.")
+	m.Step(transition)
+	assert.Equal(m.Current, "IDLE")
+
+	status = protocolStatus(agency.Protocol_BASIC_MESSAGE, "start")
+	m.Step(m.Triggers(status))
+	assert.Equal(m.Current, "WAITING_PIN")
+
+	// state's own transition overrides the global one
+	status = protocolStatus(agency.Protocol_BASIC_MESSAGE, "help")
+	transition = m.Triggers(status)
+	sends = transition.BuildSendEvents(status)
+	assert.SLen(sends, 1)
+	assert.Equal(sends[0].BasicMessage.Content, "Please enter the PIN.")
+	m.Step(transition)
+	assert.Equal(m.Current, "WAITING_PIN")
+
+	status = protocolStatus(agency.Protocol_BASIC_MESSAGE, "reset")
+	m.Step(m.Triggers(status))
+	assert.Equal(m.Current, "IDLE")
+}
+
+func TestMachine_ValidateGlobalTransitions(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "global.json", Data: []byte(`{
+"initial":{"target":"IDLE"},
+"states":{"IDLE":{"transitions":[]},"HELP":{"transitions":[]}},
+"global_transitions":[
+  {"trigger":{"protocol":"basic_message","rule":"INPUT_EQUAL","data":"help"},
+   "target":"HELP"},
+  {"trigger":{"protocol":"basic_message","rule":"NO_SUCH_RULE"},
+   "target":"NOWHERE"}]}`)})
+	ds := m.Validate()
+	assert.SLen(ds, 2)
+	assert.Equal(ds[0].String(),
+		`ERROR: machine.global_transitions[1]: unknown target state "NOWHERE"`)
+	assert.Equal(ds[1].String(),
+		`ERROR: machine.global_transitions[1].trigger: unknown rule "NO_SUCH_RULE"`)
+}
@@ -0,0 +1,235 @@
+package fsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// Include includes the states of another machine file to the machine. This
+// way the same sub-flows, e.g. verifying an email, can be shared by several
+// machines. Only the states and the initial target of the included machine
+// are used, e.g. its initial sends and global transitions are ignored.
+//
+//	includes:
+//	- file: verify_email.yaml
+//	  prefix: "VERIFY_"
+//	  entry: VERIFY_EMAIL
+//	  exits:
+//	    DONE: ISSUE
+//	    FAILED: IDLE
+type Include struct {
+	// File is the machine file to include. Relative paths are resolved from
+	// the directory of the including file.
+	File string `json:"file"`
+
+	// Prefix is added to the names of the included states that they don't
+	// collide with the states of the including machine.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Entry is an optional state name which the including machine can use as
+	// a target to enter the included machine's initial state.
+	Entry string `json:"entry,omitempty"`
+
+	// Exits maps the states of the included machine to the states of the
+	// including machine. The mapped states aren't included, but the
+	// transitions to them go to the including machine's states instead.
+	Exits map[string]string `json:"exits,omitempty"`
+}
+
+// ResolveIncludes returns the machine data where the includes are already
+// resolved, i.e. NewMachine doesn't read the included files anymore. The
+// runners call it once when they load the machine data, instead of reading
+// the files for every conversation. The resolved data is JSON.
+func (md MachineData) ResolveIncludes() (_ MachineData, err error) {
+	defer err2.Handle(&err, "includes of %s", md.FType)
+
+	var machine Machine
+	if filepath.Ext(md.FType) == ".json" {
+		try.To(json.Unmarshal(md.Data, &machine))
+	} else {
+		try.To(yaml.Unmarshal(md.Data, &machine))
+	}
+	if len(machine.Includes) == 0 {
+		return md, nil
+	}
+	try.To(machine.ResolveIncludes(filepath.Dir(md.FType)))
+	fType := strings.TrimSuffix(md.FType, filepath.Ext(md.FType)) + ".json"
+	return MachineData{FType: fType, Data: try.To1(json.Marshal(&machine))}, nil
+}
+
+// ResolveIncludes loads the included machine files and merges their states to
+// the machine. Relative file names are resolved from dir, which is usually the
+// directory of the machine file. Included machines can include other
+// machines, but not cyclically. The Lua file links of the included machines
+// are rebased to their directories. After resolving Includes is nil.
+// NewMachine and NewBackendMachine call it, and it must be called before
+// Initialize.
+func (m *Machine) ResolveIncludes(dir string) (err error) {
+	defer err2.Handle(&err, "includes")
+
+	return m.resolveIncludes(dir, nil)
+}
+
+func (m *Machine) resolveIncludes(dir string, stack []string) (err error) {
+	if len(m.Includes) == 0 {
+		return nil
+	}
+	if m.States == nil {
+		m.States = make(map[string]*State)
+	}
+	entries := make(map[string]string, len(m.Includes))
+	for _, inc := range m.Includes {
+		target := try.To1(m.include(dir, inc, stack))
+		if inc.Entry != "" {
+			if _, exists := m.States[inc.Entry]; exists {
+				return fmt.Errorf("%s: entry (%s) is a state name",
+					inc.File, inc.Entry)
+			}
+			entries[inc.Entry] = target
+		}
+	}
+	m.Includes = nil
+
+	rewrite := func(t *Transition) {
+		if t == nil {
+			return
+		}
+		if target, ok := entries[t.Target]; ok {
+			t.Target = target
+		}
+	}
+	rewrite(m.Initial)
+	m.walkStates(func(_ string, state *State) {
+		for _, t := range state.Transitions {
+			rewrite(t)
+		}
+	})
+	for _, t := range m.GlobalTransitions {
+		rewrite(t)
+	}
+	return nil
+}
+
+// include merges the states of the included machine to the machine and
+// returns the full path of the included initial state.
+func (m *Machine) include(dir string, inc *Include, stack []string) (initial string, err error) {
+	defer err2.Handle(&err, "%s", inc.File)
+
+	fName := inc.File
+	if !filepath.IsAbs(fName) {
+		fName = filepath.Join(dir, fName)
+	}
+	fName = try.To1(filepath.Abs(fName))
+	for _, f := range stack {
+		if f == fName {
+			return "", fmt.Errorf("include cycle: %s -> %s",
+				strings.Join(stack, " -> "), fName)
+		}
+	}
+	glog.V(3).Infoln("including machine:", fName)
+
+	var sub Machine
+	data := try.To1(os.ReadFile(fName))
+	if filepath.Ext(fName) == ".json" {
+		try.To(json.Unmarshal(data, &sub))
+	} else {
+		try.To(yaml.Unmarshal(data, &sub))
+	}
+	try.To(sub.resolveIncludes(filepath.Dir(fName), append(stack, fName)))
+	sub.rebaseFilelinks(filepath.Dir(fName))
+	if sub.Initial == nil {
+		return "", fmt.Errorf("machine doesn't have initial state")
+	}
+	for name := range inc.Exits {
+		if _, ok := sub.States[name]; !ok {
+			return "", fmt.Errorf("unknown exit state (%s)", name)
+		}
+	}
+
+	// rename resolves the target of the included machine to its full path,
+	// and maps it to the including machine's namespace.
+	rename := func(scope, target string) string {
+		path, ok := sub.resolvePath(scope, target)
+		if !ok {
+			return target // dynamic or unknown target, see Validate
+		}
+		if exit, ok := inc.Exits[path]; ok {
+			return exit
+		}
+		return inc.Prefix + path
+	}
+	sub.walkStates(func(path string, state *State) {
+		if state == nil {
+			return
+		}
+		for _, t := range state.Transitions {
+			if t != nil && t.Target != TargetCurrent {
+				t.Target = rename(path, t.Target)
+			}
+		}
+	})
+	for name, state := range sub.States {
+		if _, ok := inc.Exits[name]; ok {
+			continue
+		}
+		if _, exists := m.States[inc.Prefix+name]; exists {
+			return "", fmt.Errorf("state (%s) already exists", inc.Prefix+name)
+		}
+		m.States[inc.Prefix+name] = state
+	}
+	return rename("", sub.Initial.Target), nil
+}
+
+var filelinkRe = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// rebaseFilelinks makes the relative Lua file links of the machine relative
+// to dir, i.e. the directory of the included file. The links are in the LUA
+// rules' data and in the constraints of the verify rules.
+func (m *Machine) rebaseFilelinks(dir string) {
+	rebase := func(e *Event) {
+		if e == nil {
+			return
+		}
+		switch e.Rule {
+		case TriggerTypeLua, TriggerTypeVerifyAndInputValues,
+			TriggerTypeNotVerifyValues:
+		default:
+			return
+		}
+		e.Data = filelinkRe.ReplaceAllStringFunc(e.Data, func(link string) string {
+			name := filelinkRe.FindStringSubmatch(link)[1]
+			if filepath.IsAbs(name) {
+				return link
+			}
+			return "${" + filepath.Join(dir, name) + "}"
+		})
+	}
+	m.walkStates(func(_ string, state *State) {
+		if state == nil {
+			return
+		}
+		for _, t := range state.Transitions {
+			if t != nil {
+				rebase(t.Trigger)
+				for _, send := range t.Sends {
+					rebase(send)
+				}
+			}
+		}
+		for _, send := range state.OnEntry {
+			rebase(send)
+		}
+		for _, send := range state.OnExit {
+			rebase(send)
+		}
+	})
+}
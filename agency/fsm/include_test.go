@@ -0,0 +1,172 @@
+package fsm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const includingMachineYAML = `
+name: including machine
+initial:
+  target: IDLE
+includes:
+- file: sub/verify.yaml
+  prefix: VERIFY_
+  entry: VERIFY
+  exits:
+    DONE: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_EQUAL
+        data: verify
+      target: VERIFY
+`
+
+const verifyMachineYAML = `
+initial:
+  target: ASK
+states:
+  ASK:
+    on_entry:
+    - protocol: basic_message
+      data: Code?
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_EQUAL
+        data: "123"
+      target: DONE
+  DONE:
+    terminate: true
+`
+
+func writeFile(t *testing.T, name, data string) {
+	t.Helper()
+	try.To(os.MkdirAll(filepath.Dir(name), 0700))
+	try.To(os.WriteFile(name, []byte(data), 0600))
+}
+
+func TestMachine_Includes(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	dir := t.TempDir()
+	fName := filepath.Join(dir, "main.yaml")
+	writeFile(t, fName, includingMachineYAML)
+	writeFile(t, filepath.Join(dir, "sub", "verify.yaml"), verifyMachineYAML)
+
+	m := NewMachine(MachineData{FType: fName, Data: []byte(includingMachineYAML)})
+	assert.SLen(m.Includes, 0)
+	assert.MLen(m.States, 2)
+	assert.Equal(m.States["IDLE"].Transitions[0].Target, "VERIFY_ASK")
+	assert.Equal(m.States["VERIFY_ASK"].Transitions[0].Target, "IDLE")
+	assert.SLen(m.Validate(), 0)
+	try.To(m.Initialize())
+
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE, "verify")
+	sends := m.Step(m.Triggers(status))
+	assert.Equal(m.Current, "VERIFY_ASK")
+	assert.DeepEqual(contents(sends), []string{"Code?"})
+
+	status = protocolStatus(agency.Protocol_BASIC_MESSAGE, "123")
+	m.Step(m.Triggers(status))
+	assert.Equal(m.Current, "IDLE")
+}
+
+func TestMachine_IncludesErrors(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	dir := t.TempDir()
+	cycle := `
+initial:
+  target: A
+includes:
+- file: b.yaml
+  prefix: B_
+states:
+  A:
+    terminate: true
+`
+	writeFile(t, filepath.Join(dir, "a.yaml"), cycle)
+	writeFile(t, filepath.Join(dir, "b.yaml"),
+		`{"initial":{"target":"A"},"includes":[{"file":"a.yaml"}],"states":{}}`)
+	m := new(Machine)
+	m.Includes = []*Include{{File: "a.yaml"}}
+	err := m.ResolveIncludes(dir)
+	assert.Error(err)
+	assert.That(strings.Contains(err.Error(), "include cycle"), err.Error())
+
+	m = new(Machine)
+	m.Includes = []*Include{{File: "missing.yaml"}}
+	assert.Error(m.ResolveIncludes(dir))
+
+	// included states cannot override existing ones
+	writeFile(t, filepath.Join(dir, "verify.yaml"), verifyMachineYAML)
+	m = &Machine{States: map[string]*State{"ASK": {Terminate: true}}}
+	m.Includes = []*Include{{File: "verify.yaml"}}
+	assert.Error(m.ResolveIncludes(dir))
+
+	m = new(Machine)
+	m.Includes = []*Include{{File: "verify.yaml", Exits: map[string]string{"X": "Y"}}}
+	assert.Error(m.ResolveIncludes(dir))
+}
+
+func TestMachineData_ResolveIncludes(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const luaMachineYAML = `
+initial:
+  target: ASK
+states:
+  ASK:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: LUA
+        data: ${check.lua}
+      target: DONE
+  DONE:
+    terminate: true
+`
+	dir := t.TempDir()
+	fName := filepath.Join(dir, "main.yaml")
+	writeFile(t, fName, includingMachineYAML)
+	writeFile(t, filepath.Join(dir, "sub", "verify.yaml"), luaMachineYAML)
+	writeFile(t, filepath.Join(dir, "sub", "check.lua"),
+		`if getRegValue("MEM", "INPUT") == "123" then setRegValue("MEM", "OUTPUT", "OK") end`)
+
+	md := try.To1(MachineData{FType: fName, Data: []byte(includingMachineYAML)}.ResolveIncludes())
+	assert.Equal(md.FType, filepath.Join(dir, "main.json"))
+	// the resolved data doesn't need the included file anymore
+	try.To(os.Remove(filepath.Join(dir, "sub", "verify.yaml")))
+
+	for i := 0; i < 2; i++ {
+		m := NewMachine(md)
+		assert.MLen(m.States, 2)
+		// the file link is relative to the included file
+		assert.Equal(m.States["VERIFY_ASK"].Transitions[0].Trigger.Data,
+			"${"+filepath.Join(dir, "sub", "check.lua")+"}")
+		try.To(m.Initialize())
+		m.InitLua()
+		m.Start(nil)
+
+		status := protocolStatus(agency.Protocol_BASIC_MESSAGE, "verify")
+		m.Step(m.Triggers(status))
+		assert.Equal(m.Current, "VERIFY_ASK")
+		status = protocolStatus(agency.Protocol_BASIC_MESSAGE, "123")
+		m.Step(m.Triggers(status))
+		assert.Equal(m.Current, "IDLE")
+	}
+
+	// the data without the includes is returned as is
+	plain := MachineData{FType: "plain.yaml", Data: []byte(verifyMachineYAML)}
+	assert.DeepEqual(try.To1(plain.ResolveIncludes()), plain)
+}
@@ -0,0 +1,56 @@
+package fsm
+
+import (
+	"errors"
+
+	"github.com/golang/glog"
+)
+
+// Inviter creates the out-of-band invitations of the connection sends. It's
+// set by the runner of the machine, e.g. the chat package creates the
+// invitations with the agency.
+type Inviter interface {
+	Invite(label string) (*Invitation, error)
+}
+
+// Invitation is the out-of-band invitation of the connection send. It's
+// stored to the INVITATION and INVITATION_URL registers that the following
+// sends can use it, e.g. with FORMAT_MEM.
+type Invitation struct {
+	Label string `json:"label,omitempty"`
+	JSON  string `json:"json,omitempty"`
+	URL   string `json:"url,omitempty"`
+}
+
+var errNoInviter = errors.New("machine doesn't have inviter")
+
+// buildConnectionSend creates the invitation with the send's data as a label.
+// If it fails, the error is stored to the ERR register and the send is without
+// the invitation.
+func (t *Transition) buildConnectionSend(send *Event) {
+	label := send.Data
+	if send.Rule == TriggerTypeFormatFromMem {
+		label = t.FmtFromMem(send)
+	}
+	send.EventData = &EventData{Invitation: &Invitation{Label: label}}
+
+	inviter := t.Machine.Inviter
+	if inviter == nil {
+		t.invitationFailed(errNoInviter)
+		return
+	}
+	invitation, err := inviter.Invite(label)
+	if err != nil {
+		t.invitationFailed(err)
+		return
+	}
+	invitation.Label = label
+	send.EventData.Invitation = invitation
+	t.Machine.Memory[LUA_INVITATION] = invitation.JSON
+	t.Machine.Memory[LUA_INVITATION_URL] = invitation.URL
+}
+
+func (t *Transition) invitationFailed(err error) {
+	glog.Errorln("connection send:", err)
+	t.Machine.Memory[LUA_ERROR] = err.Error()
+}
@@ -0,0 +1,117 @@
+package fsm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const inviterMachineYAML = `
+name: inviter machine
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_SAVE
+        data: NAME
+      sends:
+      - protocol: trust_ping
+      - protocol: connection
+        rule: FORMAT_MEM
+        data: "Invitation for {{.NAME}}"
+      - protocol: basic_message
+        rule: FORMAT_MEM
+        data: "Use {{.INVITATION_URL}}"
+      target: IDLE
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_EQUAL
+        data: bye
+      target: DONE
+  DONE:
+    terminate: true
+`
+
+type testInviter struct {
+	labels []string
+	err    error
+}
+
+func (i *testInviter) Invite(label string) (*Invitation, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+	i.labels = append(i.labels, label)
+	return &Invitation{JSON: `{"label":"` + label + `"}`, URL: "didcomm://invitation"}, nil
+}
+
+func TestMachine_ConnectionSends(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "inviter.yaml", Data: []byte(inviterMachineYAML)})
+	assert.SLen(m.Validate(), 0)
+	try.To(m.Initialize())
+	inviter := &testInviter{}
+	m.Inviter = inviter
+	m.Start(nil)
+
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE, "Alice")
+	transition := m.Triggers(status)
+	sends := transition.BuildSendEvents(status)
+	assert.SLen(sends, 3)
+	assert.Equal(sends[0].ProtocolType, agency.Protocol_TRUST_PING)
+	assert.That(sends[0].WantStatus)
+	assert.Equal(sends[1].ProtocolType, agency.Protocol_DIDEXCHANGE)
+	assert.DeepEqual(sends[1].Invitation, &Invitation{
+		Label: "Invitation for Alice",
+		JSON:  `{"label":"Invitation for Alice"}`,
+		URL:   "didcomm://invitation",
+	})
+	assert.Equal(m.Memory[LUA_INVITATION], `{"label":"Invitation for Alice"}`)
+	assert.Equal(sends[2].BasicMessage.Content, "Use didcomm://invitation")
+	assert.DeepEqual(inviter.labels, []string{"Invitation for Alice"})
+
+	// failing invitation doesn't drop the other sends
+	m.Inviter = &testInviter{err: errors.New("agency down")}
+	delete(m.Memory, LUA_INVITATION_URL)
+	sends = transition.BuildSendEvents(status)
+	assert.SLen(sends, 3)
+	assert.Equal(sends[1].Invitation.JSON, "")
+	assert.Equal(m.Memory[LUA_ERROR], "agency down")
+	assert.Equal(sends[2].BasicMessage.Content, "Use <no value>")
+
+	m.Inviter = nil
+	sends = transition.BuildSendEvents(status)
+	assert.SLen(sends, 3)
+	assert.Equal(m.Memory[LUA_ERROR], errNoInviter.Error())
+}
+
+func TestMachine_UnknownSends(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	data := strings.Replace(inviterMachineYAML, "protocol: trust_ping", "protocol: timer", 1)
+	m := NewMachine(MachineData{FType: "inviter.yaml", Data: []byte(data)})
+	err := m.Initialize()
+	assert.Error(err)
+	assert.That(strings.Contains(err.Error(), `sending "timer" isn't supported`), err.Error())
+
+	// sends added after Initialize are skipped at runtime
+	m = NewMachine(MachineData{FType: "inviter.yaml", Data: []byte(inviterMachineYAML)})
+	try.To(m.Initialize())
+	m.Inviter = &testInviter{}
+	m.Start(nil)
+	transition := m.CurrentState().Transitions[0]
+	transition.Sends = append([]*Event{{Protocol: "unknown", Transition: transition}},
+		transition.Sends...)
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE, "Bob")
+	sends := m.Triggers(status).BuildSendEvents(status)
+	assert.SLen(sends, 3)
+	assert.Equal(sends[2].BasicMessage.Content, "Use didcomm://invitation")
+}
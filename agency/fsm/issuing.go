@@ -0,0 +1,113 @@
+package fsm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2"
+)
+
+// IssuingAttr is the name/value pair of the structured issuing.
+type IssuingAttr struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// CredDefResolver returns the attribute names of the cred def. It's given by
+// the runner of the machine to CheckIssuings, e.g. the chat package gets the
+// cred defs from the agency.
+type CredDefResolver interface {
+	CredDefAttrs(credDefID string) ([]string, error)
+}
+
+// IsStructured tells if the issuing has the attributes instead of the JSON.
+func (i *Issuing) IsStructured() bool {
+	return i != nil && len(i.Attributes) > 0
+}
+
+// Protocol returns the attributes of the structured issuing for the agency
+// API.
+func (i *Issuing) Protocol() *agency.Protocol_IssuingAttributes {
+	attrs := make([]*agency.Protocol_IssuingAttributes_Attribute, 0,
+		len(i.Attributes))
+	for _, a := range i.Attributes {
+		attrs = append(attrs, &agency.Protocol_IssuingAttributes_Attribute{
+			Name:  a.Name,
+			Value: a.Value,
+		})
+	}
+	return &agency.Protocol_IssuingAttributes{Attributes: attrs}
+}
+
+// buildIssuingSend builds the issuing of the send. The structured issuing is
+// built from the machine file's attributes, and the FORMAT_MEM rule formats
+// their values from the memory. The JSON issuing is formatted as before.
+func (t *Transition) buildIssuingSend(send *Event) {
+	if send.issuing == nil {
+		switch send.Rule {
+		case TriggerTypeFormatFromMem:
+			send.EventData = &EventData{Issuing: &Issuing{
+				CredDefID: send.EventData.Issuing.CredDefID,
+				AttrsJSON: t.FmtFromMem(send),
+			}}
+		}
+		return
+	}
+	issuing := &Issuing{CredDefID: send.issuing.CredDefID}
+	for _, a := range send.issuing.Attributes {
+		value := a.Value
+		if send.Rule == TriggerTypeFormatFromMem {
+			value = t.fmtFromMem(value)
+		}
+		issuing.Attributes = append(issuing.Attributes,
+			IssuingAttr{Name: a.Name, Value: value})
+	}
+	send.EventData = &EventData{Issuing: issuing}
+}
+
+// CheckIssuings checks the attribute names of the structured issuing sends
+// against their cred defs. It must be called after Initialize, which doesn't
+// check the cred defs, because it's called for every conversation and it
+// mustn't do I/O. The runner of the machine calls it once at the startup
+// instead, e.g. the chat multiplexer. The cred defs given as templates cannot
+// be checked before the sends are built, and the cred defs which cannot be
+// resolved are errors as well.
+func (m *Machine) CheckIssuings(credDefs CredDefResolver) error {
+	for _, send := range m.allEvents() {
+		issuing := send.issuing
+		if issuing == nil || strings.Contains(issuing.CredDefID, "{{") {
+			continue
+		}
+		names, err := credDefs.CredDefAttrs(issuing.CredDefID)
+		if err != nil {
+			return fmt.Errorf("issuing with cred def %s: %w",
+				issuing.CredDefID, err)
+		}
+		if err := checkIssuing(names, issuing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkIssuing returns error if the attributes aren't exactly the attributes
+// of the cred def, because the credential must have them all.
+func checkIssuing(names []string, issuing *Issuing) (err error) {
+	defer err2.Handle(&err, "issuing with cred def %s", issuing.CredDefID)
+
+	given := make([]string, 0, len(issuing.Attributes))
+	for _, a := range issuing.Attributes {
+		if !slices.Contains(names, a.Name) {
+			return fmt.Errorf("unknown attribute \"%s\"", a.Name)
+		}
+		given = append(given, a.Name)
+	}
+	for _, name := range names {
+		if !slices.Contains(given, name) {
+			return fmt.Errorf("missing attribute \"%s\"", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package fsm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const issuerMachineYAML = `
+name: issuer machine
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_SAVE
+        data: EMAIL
+      sends:
+      - protocol: issue_cred
+        rule: FORMAT_MEM
+        event_data:
+          issuing:
+            CredDefID: EMAIL_CRED_DEF
+            attributes:
+            - name: email
+              value: "{{.EMAIL}}"
+            - name: verified
+              value: "yes"
+      target: WAITING_ISSUING
+  WAITING_ISSUING:
+    transitions:
+    - trigger:
+        protocol: issue_cred
+      target: DONE
+  DONE:
+    terminate: true
+`
+
+type testCredDefs map[string][]string
+
+func (c testCredDefs) CredDefAttrs(credDefID string) ([]string, error) {
+	names, ok := c[credDefID]
+	if !ok {
+		return nil, errors.New("cred def not found")
+	}
+	return names, nil
+}
+
+func TestMachine_StructuredIssuing(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "issuer.yaml", Data: []byte(issuerMachineYAML)})
+	assert.SLen(m.Validate(), 0)
+	try.To(m.Initialize())
+	try.To(m.CheckIssuings(testCredDefs{"EMAIL_CRED_DEF": {"email", "verified"}}))
+	m.Start(nil)
+
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE, `me@example.com","x`)
+	sends := m.Triggers(status).BuildSendEvents(status)
+	assert.SLen(sends, 1)
+	issuing := sends[0].Issuing
+	assert.That(issuing.IsStructured())
+	assert.Equal(issuing.CredDefID, "EMAIL_CRED_DEF")
+	assert.DeepEqual(issuing.Attributes, []IssuingAttr{
+		{Name: "email", Value: `me@example.com","x`},
+		{Name: "verified", Value: "yes"},
+	})
+	attrs := issuing.Protocol()
+	assert.SLen(attrs.Attributes, 2)
+	assert.Equal(attrs.Attributes[0].Value, `me@example.com","x`)
+
+	// templates are kept for the next send
+	status = protocolStatus(agency.Protocol_BASIC_MESSAGE, "other@example.com")
+	sends = m.Triggers(status).BuildSendEvents(status)
+	assert.Equal(sends[0].Issuing.Attributes[0].Value, "other@example.com")
+}
+
+func TestMachine_StructuredIssuingInvalid(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	tests := []struct {
+		name     string
+		credDefs testCredDefs
+		err      string
+	}{
+		{"unknown", testCredDefs{"EMAIL_CRED_DEF": {"email"}},
+			`unknown attribute "verified"`},
+		{"missing", testCredDefs{"EMAIL_CRED_DEF": {"email", "name", "verified"}},
+			`missing attribute "name"`},
+		{"not found", testCredDefs{}, "cred def not found"},
+		{"ok", testCredDefs{"EMAIL_CRED_DEF": {"verified", "email"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer assert.PushTester(t)()
+
+			m := NewMachine(MachineData{FType: "issuer.yaml", Data: []byte(issuerMachineYAML)})
+			try.To(m.Initialize())
+			err := m.CheckIssuings(tt.credDefs)
+			if tt.err == "" {
+				assert.NoError(err)
+				return
+			}
+			assert.Error(err)
+			assert.That(strings.Contains(err.Error(), tt.err), err.Error())
+		})
+	}
+
+	data := strings.Replace(issuerMachineYAML, "name: verified", "name: email", 1)
+	m := NewMachine(MachineData{FType: "issuer.yaml", Data: []byte(data)})
+	ds := m.Validate()
+	assert.SLen(ds, 1)
+	assert.Equal(ds[0].Msg, `duplicate issuing attribute "email"`)
+}
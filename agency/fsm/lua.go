@@ -0,0 +1,284 @@
+package fsm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/go-lua"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+const (
+	// DefaultLuaMaxSteps is the step budget of one Lua execution in the
+	// sandbox mode if the machine doesn't set it.
+	DefaultLuaMaxSteps = 1_000_000
+
+	// DefaultLuaTimeout is the wall-clock limit of one Lua execution in the
+	// sandbox mode if the machine doesn't set it.
+	DefaultLuaTimeout = time.Second
+
+	// luaChunksKey is the registry table of the compiled scripts.
+	luaChunksKey = "fsm_lua_chunks"
+
+	// luaHookCount is how many VM instructions are executed between our
+	// debug hook calls, i.e. the resolution of the limits.
+	luaHookCount = 1000
+)
+
+var (
+	errLuaStepBudget = errors.New("lua: step budget exceeded")
+	errLuaTimeout    = errors.New("lua: timeout")
+)
+
+// luaLibraries are the Lua standard libraries by their names used in
+// LuaConfig.Libraries.
+var luaLibraries = map[string]lua.RegistryFunction{
+	"base":    {Name: "_G", Function: lua.BaseOpen},
+	"package": {Name: "package", Function: lua.PackageOpen},
+	"table":   {Name: "table", Function: lua.TableOpen},
+	"io":      {Name: "io", Function: lua.IOOpen},
+	"os":      {Name: "os", Function: lua.OSOpen},
+	"string":  {Name: "string", Function: lua.StringOpen},
+	"bit32":   {Name: "bit32", Function: lua.Bit32Open},
+	"math":    {Name: "math", Function: lua.MathOpen},
+	"debug":   {Name: "debug", Function: lua.DebugOpen},
+}
+
+// defaultSandboxLibraries don't give any access outside of the Lua state.
+var defaultSandboxLibraries = []string{"base", "table", "string", "bit32", "math"}
+
+// sandboxRemovedGlobals are base library functions which can load code from
+// files or load precompiled chunks.
+var sandboxRemovedGlobals = []string{"dofile", "loadfile", "load"}
+
+// LuaConfig is the machine level configuration of the Lua execution. Without
+// it, scripts have all the standard libraries and no limits.
+type LuaConfig struct {
+	// Sandbox opens only the whitelisted Libraries and removes the functions
+	// which can load code outside of the FSM file, i.e. dofile, loadfile, and
+	// load. It also sets the default limits if they aren't given.
+	Sandbox bool `json:"sandbox,omitempty"`
+
+	// Libraries is a whitelist of the standard libraries in the sandbox mode:
+	// base, package, table, io, os, string, bit32, math, and debug. The
+	// default is base, table, string, bit32, and math.
+	Libraries []string `json:"libraries,omitempty"`
+
+	// MaxSteps is the instruction budget of one script execution. Zero means
+	// no limit outside of the sandbox mode.
+	MaxSteps int `json:"max_steps,omitempty"`
+
+	// Timeout is the wall-clock limit of one script execution, e.g. "100ms".
+	// Empty means no limit outside of the sandbox mode.
+	Timeout string `json:"timeout,omitempty"`
+
+	// ErrorTarget is the state where a LUA trigger transits if its script
+	// fails, e.g. exceeds the limits. The error message is stored to the
+	// memory register ERR. Without it the failing trigger doesn't trigger.
+	// A failing LUA send is skipped, and its transition transits to the
+	// ErrorTarget if it's set. Initialize fails if the state is unknown.
+	ErrorTarget string `json:"error_target,omitempty"`
+
+	timeout time.Duration
+}
+
+func (c *LuaConfig) initialize() (err error) {
+	defer err2.Handle(&err, "lua config")
+
+	if c.Timeout != "" {
+		c.timeout = try.To1(time.ParseDuration(c.Timeout))
+		if c.timeout <= 0 {
+			return fmt.Errorf("timeout must be positive: %s", c.Timeout)
+		}
+	}
+	if c.MaxSteps < 0 {
+		return fmt.Errorf("max_steps cannot be negative: %d", c.MaxSteps)
+	}
+	for _, name := range c.Libraries {
+		if _, ok := luaLibraries[name]; !ok {
+			return fmt.Errorf("unknown library: %s", name)
+		}
+	}
+	if c.Sandbox {
+		if c.MaxSteps == 0 {
+			c.MaxSteps = DefaultLuaMaxSteps
+		}
+		if c.timeout == 0 {
+			c.timeout = DefaultLuaTimeout
+		}
+	}
+	return nil
+}
+
+func (c *LuaConfig) limited() bool {
+	return c != nil && (c.MaxSteps > 0 || c.timeout > 0)
+}
+
+func (c *LuaConfig) errorTarget() string {
+	if c == nil {
+		return ""
+	}
+	return c.ErrorTarget
+}
+
+// openLibraries opens the Lua libraries allowed by the config.
+func (c *LuaConfig) openLibraries(l *lua.State) {
+	if c == nil || !c.Sandbox {
+		lua.OpenLibraries(l)
+		return
+	}
+	names := c.Libraries
+	if len(names) == 0 {
+		names = defaultSandboxLibraries
+	}
+	for _, name := range names {
+		lib := luaLibraries[name]
+		lua.Require(l, lib.Name, lib.Function, true)
+		l.Pop(1)
+	}
+	for _, name := range sandboxRemovedGlobals {
+		l.PushNil()
+		l.SetGlobal(name)
+	}
+}
+
+// setLuaHook installs the debug hook which enforces the limits of the
+// LuaConfig. The counters are reset by runLua for every execution.
+func (m *Machine) setLuaHook() {
+	if !m.Lua.limited() {
+		return
+	}
+	count := luaHookCount
+	if m.Lua.MaxSteps > 0 && m.Lua.MaxSteps < count {
+		count = m.Lua.MaxSteps
+	}
+	lua.SetDebugHook(m.luaState, func(l *lua.State, _ lua.Debug) {
+		m.luaSteps += count
+		if m.Lua.MaxSteps > 0 && m.luaSteps > m.Lua.MaxSteps {
+			lua.Errorf(l, errLuaStepBudget.Error())
+		}
+		if m.Lua.timeout > 0 && time.Now().After(m.luaDeadline) {
+			lua.Errorf(l, errLuaTimeout.Error())
+		}
+	}, lua.MaskCount, count)
+}
+
+// runLua executes the script within the limits of the machine's LuaConfig.
+// The script is compiled only once per Lua state and the compiled chunk is
+// reused after that.
+func (m *Machine) runLua(script string) (err error) {
+	l := m.luaState
+	if err = m.pushLuaChunk(script); err != nil {
+		return err
+	}
+	m.luaSteps = 0
+	if m.Lua.limited() && m.Lua.timeout > 0 {
+		m.luaDeadline = time.Now().Add(m.Lua.timeout)
+	}
+	if err = l.ProtectedCall(0, 0, 0); err != nil {
+		l.Pop(1) // error object
+	}
+	return err
+}
+
+// pushLuaChunk pushes the compiled script to the stack. Compiled chunks are
+// cached to the registry table by their source.
+func (m *Machine) pushLuaChunk(script string) error {
+	l := m.luaState
+	lua.SubTable(l, lua.RegistryIndex, luaChunksKey)
+	l.Field(-1, script)
+	if l.IsNil(-1) {
+		l.Pop(1)
+		if err := lua.LoadString(l, script); err != nil {
+			l.Pop(2) // error object and chunk table
+			return err
+		}
+		l.PushValue(-1)
+		l.SetField(-3, script)
+	}
+	l.Remove(-2) // chunk table
+	return nil
+}
+
+// luaSource is a Lua script of the machine: the data of the LUA rule or the
+// lua of the verify rule's constraint. The script is where the script read
+// from the file link is stored.
+type luaSource struct {
+	data   string
+	script *string
+}
+
+// luaSources returns all the Lua scripts of the machine.
+func (m *Machine) luaSources() (sources []luaSource) {
+	for _, e := range m.allEvents() {
+		if e.Rule == TriggerTypeLua {
+			sources = append(sources, luaSource{e.Data, &e.luaScript})
+		}
+		for i := range e.constraints {
+			if c := &e.constraints[i]; c.Lua != "" {
+				sources = append(sources, luaSource{c.Lua, &c.luaScript})
+			}
+		}
+	}
+	return sources
+}
+
+// compileLua reads the file links of the Lua scripts and checks that the
+// scripts compile. The actual compiling to the machine's Lua state is done
+// by InitLua.
+func (m *Machine) compileLua() error {
+	l := lua.NewState()
+	for _, src := range m.luaSources() {
+		script := filterFilelink(src.data)
+		if err := lua.LoadString(l, script); err != nil {
+			return fmt.Errorf("lua script (%.32s): %w", removeLF(src.data), err)
+		}
+		l.Pop(1)
+		*src.script = script
+	}
+	return nil
+}
+
+// loadLuaChunks compiles all the scripts of the machine to its Lua state.
+func (m *Machine) loadLuaChunks() {
+	l := m.luaState
+	l.PushNil()
+	l.SetField(lua.RegistryIndex, luaChunksKey)
+	for _, src := range m.luaSources() {
+		if *src.script == "" {
+			continue
+		}
+		if err := m.pushLuaChunk(*src.script); err != nil {
+			glog.Errorln("lua compile:", err)
+			continue
+		}
+		l.Pop(1)
+	}
+}
+
+// ReloadLua reads the Lua script files again and compiles them. If a script
+// doesn't compile, the previous scripts are kept. Otherwise scripts aren't
+// read from the disk after Initialize.
+func (m *Machine) ReloadLua() (err error) {
+	defer err2.Handle(&err, "reload lua")
+
+	sources := m.luaSources()
+	prev := make([]string, len(sources))
+	for i, src := range sources {
+		prev[i] = *src.script
+	}
+	if err = m.compileLua(); err != nil {
+		for i, src := range sources {
+			*src.script = prev[i]
+		}
+		return err
+	}
+	if m.luaState != nil {
+		m.loadLuaChunks()
+	}
+	glog.V(1).Infof("machine (%s) lua scripts reloaded", m.Name)
+	return nil
+}
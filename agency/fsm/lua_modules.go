@@ -0,0 +1,309 @@
+package fsm
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/Shopify/go-lua"
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/findy-network/findy-common-go/utils"
+)
+
+// maxLuaJSONDepth protects json.encode against self referencing tables.
+const maxLuaJSONDepth = 64
+
+// registerModules registers the built-in modules for the scripts as global
+// tables:
+//
+//	json.encode(value) -> string, json.decode(string) -> value
+//	base64.encode(string) -> string, base64.decode(string) -> string
+//	regex.match(pattern, s) -> bool, regex.find(pattern, s) -> {match, ...}
+//	regex.replace(pattern, s, replacement) -> string
+//	uuid.new() -> string
+//	time.now() -> unix seconds, time.format([seconds], [layout]) -> string
+//	status.conn_id(), status.protocol(), status.protocol_id(), status.role()
+//
+// Functions which parse their input return nil and an error message on
+// failure like Lua's own functions do. The status functions return the fields
+// of the protocol status which is currently processed, or nil if there is
+// none.
+func (m *Machine) registerModules() {
+	l := m.luaState
+	modules := []struct {
+		name      string
+		functions []lua.RegistryFunction
+	}{
+		{"json", luaJSONFuncs},
+		{"base64", luaBase64Funcs},
+		{"regex", luaRegexFuncs},
+		{"uuid", luaUUIDFuncs},
+		{"time", luaTimeFuncs},
+		{"status", m.luaStatusFuncs()},
+	}
+	for _, module := range modules {
+		lua.NewLibrary(l, module.functions)
+		l.SetGlobal(module.name)
+	}
+}
+
+var luaJSONFuncs = []lua.RegistryFunction{
+	{Name: "encode", Function: func(l *lua.State) int {
+		lua.CheckAny(l, 1)
+		v, err := luaToGo(l, 1, 0)
+		if err != nil {
+			return pushLuaError(l, err)
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return pushLuaError(l, err)
+		}
+		l.PushString(string(data))
+		return 1
+	}},
+	{Name: "decode", Function: func(l *lua.State) int {
+		var v any
+		if err := json.Unmarshal([]byte(lua.CheckString(l, 1)), &v); err != nil {
+			return pushLuaError(l, err)
+		}
+		pushGo(l, v)
+		return 1
+	}},
+}
+
+var luaBase64Funcs = []lua.RegistryFunction{
+	{Name: "encode", Function: func(l *lua.State) int {
+		l.PushString(base64.StdEncoding.EncodeToString(
+			[]byte(lua.CheckString(l, 1))))
+		return 1
+	}},
+	{Name: "decode", Function: func(l *lua.State) int {
+		data, err := base64.StdEncoding.DecodeString(lua.CheckString(l, 1))
+		if err != nil {
+			return pushLuaError(l, err)
+		}
+		l.PushString(string(data))
+		return 1
+	}},
+}
+
+var luaRegexFuncs = []lua.RegistryFunction{
+	{Name: "match", Function: func(l *lua.State) int {
+		re, err := regexp.Compile(lua.CheckString(l, 1))
+		if err != nil {
+			return pushLuaError(l, err)
+		}
+		l.PushBoolean(re.MatchString(lua.CheckString(l, 2)))
+		return 1
+	}},
+	{Name: "find", Function: func(l *lua.State) int {
+		re, err := regexp.Compile(lua.CheckString(l, 1))
+		if err != nil {
+			return pushLuaError(l, err)
+		}
+		matches := re.FindStringSubmatch(lua.CheckString(l, 2))
+		if matches == nil {
+			l.PushNil()
+			return 1
+		}
+		l.CreateTable(len(matches), 0)
+		for i, match := range matches {
+			l.PushString(match)
+			l.RawSetInt(-2, i+1)
+		}
+		return 1
+	}},
+	{Name: "replace", Function: func(l *lua.State) int {
+		re, err := regexp.Compile(lua.CheckString(l, 1))
+		if err != nil {
+			return pushLuaError(l, err)
+		}
+		l.PushString(re.ReplaceAllString(lua.CheckString(l, 2),
+			lua.CheckString(l, 3)))
+		return 1
+	}},
+}
+
+var luaUUIDFuncs = []lua.RegistryFunction{
+	{Name: "new", Function: func(l *lua.State) int {
+		l.PushString(utils.UUID())
+		return 1
+	}},
+}
+
+var luaTimeFuncs = []lua.RegistryFunction{
+	{Name: "now", Function: func(l *lua.State) int {
+		l.PushInteger(int(time.Now().Unix()))
+		return 1
+	}},
+	{Name: "format", Function: func(l *lua.State) int {
+		t := time.Now()
+		if !l.IsNoneOrNil(1) {
+			t = time.Unix(int64(lua.CheckNumber(l, 1)), 0)
+		}
+		l.PushString(t.UTC().Format(lua.OptString(l, 2, time.RFC3339)))
+		return 1
+	}},
+}
+
+func (m *Machine) luaStatusFuncs() []lua.RegistryFunction {
+	protocolID := func() *agency.ProtocolID {
+		if m.status == nil || m.status.State == nil {
+			return nil
+		}
+		return m.status.State.ProtocolID
+	}
+	return []lua.RegistryFunction{
+		{Name: "conn_id", Function: func(l *lua.State) int {
+			connID := m.ConnID
+			if connID == "" {
+				connID = m.Memory[LUA_CONN_ID]
+			}
+			pushOptString(l, connID)
+			return 1
+		}},
+		{Name: "protocol", Function: func(l *lua.State) int {
+			if id := protocolID(); id != nil {
+				pushOptString(l, toFileProtocolType[id.TypeID])
+			} else {
+				l.PushNil()
+			}
+			return 1
+		}},
+		{Name: "protocol_id", Function: func(l *lua.State) int {
+			pushOptString(l, protocolID().GetID())
+			return 1
+		}},
+		{Name: "role", Function: func(l *lua.State) int {
+			if id := protocolID(); id != nil {
+				l.PushString(id.Role.String())
+			} else {
+				l.PushNil()
+			}
+			return 1
+		}},
+	}
+}
+
+func pushOptString(l *lua.State, s string) {
+	if s == "" {
+		l.PushNil()
+		return
+	}
+	l.PushString(s)
+}
+
+func pushLuaError(l *lua.State, err error) int {
+	l.PushNil()
+	l.PushString(err.Error())
+	return 2
+}
+
+// pushGo pushes the value decoded by encoding/json to the Lua stack.
+func pushGo(l *lua.State, v any) {
+	switch v := v.(type) {
+	case nil:
+		l.PushNil()
+	case bool:
+		l.PushBoolean(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			l.PushInteger(int(v))
+		} else {
+			l.PushNumber(v)
+		}
+	case string:
+		l.PushString(v)
+	case []any:
+		l.CreateTable(len(v), 0)
+		for i, item := range v {
+			pushGo(l, item)
+			l.RawSetInt(-2, i+1)
+		}
+	case map[string]any:
+		l.CreateTable(0, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			pushGo(l, v[k])
+			l.SetField(-2, k)
+		}
+	default:
+		l.PushString(fmt.Sprint(v))
+	}
+}
+
+// luaToGo converts the Lua value to a Go value which encoding/json can
+// marshal. Tables with keys 1..n are arrays, other tables are objects.
+func luaToGo(l *lua.State, index, depth int) (v any, err error) {
+	if depth > maxLuaJSONDepth {
+		return nil, fmt.Errorf("json: too deep or cyclic table")
+	}
+	index = l.AbsIndex(index)
+	switch l.TypeOf(index) {
+	case lua.TypeNil, lua.TypeNone:
+		return nil, nil
+	case lua.TypeBoolean:
+		return l.ToBoolean(index), nil
+	case lua.TypeNumber:
+		n, _ := l.ToNumber(index)
+		return n, nil
+	case lua.TypeString:
+		s, _ := l.ToString(index)
+		return s, nil
+	case lua.TypeTable:
+		return luaTableToGo(l, index, depth)
+	default:
+		return nil, fmt.Errorf("json: cannot encode %s",
+			lua.TypeNameOf(l, index))
+	}
+}
+
+func luaTableToGo(l *lua.State, index, depth int) (v any, err error) {
+	length := l.RawLength(index)
+	count := 0
+	obj := make(map[string]any)
+	l.PushNil()
+	for l.Next(index) {
+		count++
+		var key string
+		if l.TypeOf(-2) == lua.TypeNumber {
+			n, _ := l.ToNumber(-2)
+			key = fmt.Sprint(n)
+		} else if l.TypeOf(-2) == lua.TypeString {
+			key, _ = l.ToString(-2)
+		} else {
+			typeName := lua.TypeNameOf(l, -2)
+			l.Pop(2)
+			return nil, fmt.Errorf("json: unsupported key type %s", typeName)
+		}
+		value, err := luaToGo(l, -1, depth+1)
+		if err != nil {
+			l.Pop(2)
+			return nil, err
+		}
+		obj[key] = value
+		l.Pop(1)
+	}
+	if length > 0 && count == length {
+		arr := make([]any, length)
+		for i := 1; i <= length; i++ {
+			l.RawGetInt(index, i)
+			value, err := luaToGo(l, -1, depth+1)
+			l.Pop(1)
+			if err != nil {
+				return nil, err
+			}
+			arr[i-1] = value
+		}
+		return arr, nil
+	}
+	return obj, nil
+}
@@ -1,6 +1,9 @@
 package fsm
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
@@ -170,3 +173,249 @@ setRegValue("MEM", "OUTPUT", retval)
 		},
 	}
 )
+
+const luaSandboxMachineYAML = `
+name: lua sandbox
+lua:
+  sandbox: true
+  max_steps: 10000
+  error_target: FAILED
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: LUA
+        data: |
+          local input = getRegValue("MEM", "INPUT")
+          if input == "loop" then
+            while true do end
+          elseif input == "os" then
+            setRegValue("MEM", "OUTPUT", os.getenv("HOME"))
+          elseif input == "dofile" then
+            dofile("/etc/passwd")
+          else
+            setRegValue("MEM", "OUTPUT", "OK")
+          end
+      target: DONE
+  DONE:
+    terminate: true
+  FAILED:
+    terminate: true
+`
+
+func TestLuaSandbox(t *testing.T) {
+	tests := []struct {
+		content string
+		target  string
+		err     string
+	}{
+		{"ok", "DONE", ""},
+		{"loop", "FAILED", "step budget exceeded"},
+		{"os", "FAILED", "a nil value"},
+		{"dofile", "FAILED", "attempt to call a nil value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			defer assert.PushTester(t)()
+
+			m := NewMachine(MachineData{FType: "sandbox.yaml",
+				Data: []byte(luaSandboxMachineYAML)})
+			assert.SLen(m.Validate(), 0)
+			try.To(m.Initialize())
+			m.InitLua()
+
+			transition := m.Triggers(
+				protocolStatus(agency.Protocol_BASIC_MESSAGE, tt.content))
+			assert.NotNil(transition)
+			assert.Equal(transition.Target, tt.target)
+			if tt.err != "" {
+				assert.That(strings.Contains(m.Memory[LUA_ERROR], tt.err), m.Memory[LUA_ERROR])
+			}
+		})
+	}
+}
+
+func TestLuaTimeout(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "timeout.json", Data: []byte(`{
+"lua":{"timeout":"20ms"},
+"initial":{"target":"IDLE"},
+"states":{"IDLE":{"transitions":[{"trigger":{"protocol":"basic_message",
+  "rule":"LUA","data":"while true do end"},"target":"IDLE"}]}}}`)})
+	try.To(m.Initialize())
+	m.InitLua()
+
+	// without error target the failing trigger doesn't trigger
+	assert.Nil(m.Triggers(protocolStatus(agency.Protocol_BASIC_MESSAGE, "")))
+	assert.That(strings.Contains(m.Memory[LUA_ERROR], "lua: timeout"), m.Memory[LUA_ERROR])
+}
+
+func TestLuaSendError(t *testing.T) {
+	tests := []struct {
+		name   string
+		lua    string
+		target string
+	}{
+		{"without error target", `{"timeout":"20ms"}`, "DONE"},
+		{"with error target", `{"timeout":"20ms","error_target":"FAILED"}`, "FAILED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer assert.PushTester(t)()
+
+			m := NewMachine(MachineData{FType: "send.json", Data: []byte(`{
+"lua":` + tt.lua + `,
+"initial":{"target":"IDLE"},
+"states":{"IDLE":{"transitions":[{"trigger":{"protocol":"basic_message"},
+  "sends":[{"protocol":"basic_message","rule":"LUA","data":"while true do end"},
+    {"protocol":"basic_message","rule":"FORMAT_MEM","data":"{{.ERR}}"}],
+  "target":"DONE"}]},
+  "DONE":{"terminate":true},"FAILED":{"terminate":true}}}`)})
+			try.To(m.Initialize())
+			m.InitLua()
+
+			status := protocolStatus(agency.Protocol_BASIC_MESSAGE, "input")
+			transition := m.Triggers(status)
+			assert.NotNil(transition)
+			sends := transition.BuildSendEvents(status)
+			assert.SLen(sends, 1) // the failing send is skipped
+			assert.That(strings.Contains(sends[0].BasicMessage.Content, "lua: timeout"),
+				sends[0].BasicMessage.Content)
+			m.Step(transition)
+			assert.Equal(m.Current, tt.target)
+		})
+	}
+}
+
+func TestLuaErrorTargetInitialize(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "bad.json", Data: []byte(`{
+"lua":{"error_target":"NOWHERE"},
+"initial":{"target":"IDLE"},
+"states":{"IDLE":{"terminate":true}}}`)})
+	err := m.Initialize()
+	assert.Error(err)
+	assert.That(strings.HasSuffix(err.Error(),
+		`lua config: unknown error target state "NOWHERE"`), err.Error())
+}
+
+func TestLuaConfigValidate(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "bad.json", Data: []byte(`{
+"lua":{"sandbox":true,"libraries":["base","net"],"error_target":"NOWHERE"},
+"initial":{"target":"IDLE"},
+"states":{"IDLE":{"terminate":true}}}`)})
+	ds := m.Validate()
+	assert.SLen(ds, 2)
+	assert.Equal(ds[0].String(), "ERROR: machine.lua: lua config: unknown library: net")
+	assert.Equal(ds[1].String(), `ERROR: machine.lua: unknown error target state "NOWHERE"`)
+	assert.Error(m.Initialize())
+}
+
+func TestLuaCompiledOnce(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	script := filepath.Join(t.TempDir(), "script.lua")
+	writeScript := func(out string) {
+		try.To(os.WriteFile(script, []byte(
+			`setRegValue("MEM", "OUTPUT", "`+out+`")`), 0600))
+	}
+	writeScript("first")
+	m := NewMachine(MachineData{FType: "compiled.json", Data: []byte(`{
+"initial":{"target":"IDLE"},
+"states":{"IDLE":{"transitions":[{"trigger":{"protocol":"basic_message"},
+  "sends":[{"protocol":"basic_message","rule":"LUA","data":"${` + script + `}"}],
+  "target":"IDLE"}]}}}`)})
+	try.To(m.Initialize())
+	m.InitLua()
+
+	send := func() string {
+		status := protocolStatus(agency.Protocol_BASIC_MESSAGE)
+		sends := m.Triggers(status).BuildSendEvents(status)
+		assert.SLen(sends, 1)
+		return sends[0].BasicMessage.Content
+	}
+	assert.Equal(send(), "first")
+
+	// editing the file doesn't change the running machine before reload
+	writeScript("second")
+	assert.Equal(send(), "first")
+	try.To(m.ReloadLua())
+	assert.Equal(send(), "second")
+
+	// failing reload keeps the previous scripts
+	try.To(os.WriteFile(script, []byte("this isn't lua"), 0600))
+	assert.Error(m.ReloadLua())
+	assert.Equal(send(), "second")
+}
+
+func TestLuaCompileError(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "bad.json", Data: []byte(`{
+"initial":{"target":"IDLE"},
+"states":{"IDLE":{"transitions":[{"trigger":{"protocol":"basic_message",
+  "rule":"LUA","data":"if then"},"target":"IDLE"}]}}}`)})
+	assert.Error(m.Initialize())
+}
+
+func TestLuaModules(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"json", `local v = json.decode('{"name":"Alice","age":42,"tags":["a","b"]}')
+			setRegValue("MEM", "OUTPUT", v.name .. v.age .. v.tags[2] .. ":" ..
+				json.encode({attrs = {name = v.name}, list = {1, 2}}))`,
+			`Alice42b:{"attrs":{"name":"Alice"},"list":[1,2]}`},
+		{"json error", `local v, err = json.decode("{")
+			setRegValue("MEM", "OUTPUT", tostring(v) .. " " .. err)`,
+			"nil unexpected end of JSON input"},
+		{"base64", `setRegValue("MEM", "OUTPUT",
+			base64.encode("hello") .. base64.decode("IHdvcmxk"))`,
+			"aGVsbG8= world"},
+		{"regex", `local m = regex.find("^(\\w+)@(\\w+)\\.com$", "me@example.com")
+			setRegValue("MEM", "OUTPUT", tostring(regex.match("^\\d+$", "123")) ..
+				m[2] .. m[3] .. regex.replace("\\d", "a1b2", "#"))`,
+			"truemeexamplea#b#"},
+		{"uuid", `setRegValue("MEM", "OUTPUT", tostring(#uuid.new()))`, "36"},
+		{"time", `setRegValue("MEM", "OUTPUT", time.format(0) ..
+			tostring(time.now() > 0))`, "1970-01-01T00:00:00Ztrue"},
+		{"status", `setRegValue("MEM", "OUTPUT", status.conn_id() .. " " ..
+			status.protocol() .. " " .. status.role())`,
+			"conn-id basic_message INITIATOR"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer assert.PushTester(t)()
+
+			m := &Machine{
+				Initial: &Transition{Target: "IDLE"},
+				States: map[string]*State{"IDLE": {Transitions: []*Transition{{
+					Trigger: &Event{Protocol: MessageBasicMessage},
+					Sends: []*Event{{
+						Protocol: MessageBasicMessage,
+						Rule:     TriggerTypeLua,
+						Data:     tt.script,
+					}},
+					Target: "IDLE",
+				}}}},
+			}
+			try.To(m.Initialize())
+			m.ConnID = "conn-id"
+			m.InitLua()
+			status := protocolStatus(agency.Protocol_BASIC_MESSAGE)
+			status.State.ProtocolID.Role = agency.Protocol_INITIATOR
+			sends := m.Triggers(status).BuildSendEvents(status)
+			assert.SLen(sends, 1)
+			assert.Equal(sends[0].BasicMessage.Content, tt.want)
+		})
+	}
+}
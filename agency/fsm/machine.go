@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/Shopify/go-lua"
 	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
@@ -32,6 +34,7 @@ func NewBackendMachine(data MachineData) *Machine {
 	} else {
 		try.To(yaml.Unmarshal(data.Data, &machine))
 	}
+	try.To(machine.ResolveIncludes(filepath.Dir(data.FType)))
 	machine.Type = MachineTypeBackend
 	return &machine
 }
@@ -43,6 +46,7 @@ func NewMachine(data MachineData) *Machine {
 	} else {
 		try.To(yaml.Unmarshal(data.Data, &machine))
 	}
+	try.To(machine.ResolveIncludes(filepath.Dir(data.FType)))
 	return &machine
 }
 
@@ -58,6 +62,17 @@ type Machine struct {
 
 	States map[string]*State `json:"states"`
 
+	// Includes are the machine files whose states are included to the
+	// machine, see ResolveIncludes.
+	Includes []*Include `json:"includes,omitempty"`
+
+	// GlobalTransitions are valid in every state. They are checked only when
+	// the current state doesn't have a matching transition, which means that
+	// states can override them. Use TargetCurrent as a target when the
+	// transition should keep the machine in the state where it was, e.g.
+	// help replies.
+	GlobalTransitions []*Transition `json:"global_transitions,omitempty"`
+
 	Current     string `json:"-"`
 	Initialized bool   `json:"-"`
 
@@ -67,19 +82,57 @@ type Machine struct {
 	// SessionID is kept in Memory[LUA_SESSION_ID].
 	ConnID string `json:"-"`
 
-	termChan TerminateOutChan `json:"-"`
-	luaState *lua.State       `json:"-"`
+	// DB is the persistent register of Lua scripts, see REG_DB. It's set by
+	// the runner of the machine, e.g. with NewDBRegister.
+	DB Register `json:"-"`
+
+	// Lua configures the sandbox and the limits of the Lua scripts.
+	Lua *LuaConfig `json:"lua,omitempty"`
+
+	termChan    TerminateOutChan `json:"-"`
+	luaState    *lua.State       `json:"-"`
+	luaSteps    int              `json:"-"`
+	luaDeadline time.Time        `json:"-"`
+
+	// status is the protocol status currently processed, Lua scripts can
+	// read it with the status module.
+	status *agency.ProtocolStatus `json:"-"`
+
+	// Clock is the time source of the timer triggers. If it's nil the real
+	// time is used.
+	Clock     Clock        `json:"-"`
+	timerChan TimerOutChan `json:"-"`
+	timers    []Stopper    `json:"-"`
+	timerSeq  int          `json:"-"`
+
+	// Inviter creates the invitations of the connection sends. Without it
+	// the connection sends fail, see Invitation.
+	Inviter Inviter `json:"-"`
+
+	// luaErrorTarget is set when a send's Lua script fails and the LuaConfig
+	// has the error target. The next Step transits there, see luaSendFailed.
+	luaErrorTarget string
+
+	// Rooms is the room broker of the backend machine. The runner sets it to
+	// persist the rooms, otherwise they are only in memory, see NewRooms.
+	Rooms *Rooms `json:"-"`
+
+	// coverage is nil if it isn't enabled, see EnableCoverage
+	coverage *Coverage `json:"-"`
 
 	// log only once, otherwise annoying
 	KeepMemoryReported bool `json:"-"`
 }
 
-func (m *Machine) register(name string) map[string]string {
+func (m *Machine) register(name string) Register {
 	switch name {
-	case REG_MEMORY:
-		return m.Memory
+	case REG_DB:
+		assert.INotNil(m.DB, "machine doesn't have DB register")
+		return m.DB
+	case REG_PROCESS:
+		return procRegister{}
 	default:
-		return m.Memory
+		return memRegister(m.Memory)
 	}
 }
 
@@ -94,7 +147,8 @@ func (m *Machine) registerMemFuncs() {
 		k, ok := l.ToString(2)
 		assert.That(ok)
 		glog.V(6).Infoln("k:", k)
-		v := assert.MKeyExists(m.register(r), k)
+		v, found := m.register(r).Get(k)
+		assert.That(found, "register %s doesn't have key %s", r, k)
 		glog.V(6).Infoln("v:", v)
 		l.PushString(v)
 		return 1
@@ -111,7 +165,7 @@ func (m *Machine) registerMemFuncs() {
 		assert.That(ok)
 		v, ok := l.ToString(3)
 		assert.That(ok)
-		m.register(r)[k] = v
+		try.To(m.register(r).Set(k, v))
 		glog.V(6).Infof("[%s] = '%v'", k, v)
 		return 0
 	})
@@ -127,69 +181,217 @@ func (m *Machine) Initialize() (err error) {
 		m.Type = MachineTypeConversation
 	}
 	m.Memory = make(map[string]string)
-	initSet := false
-	for id := range m.States {
-		for _, transition := range m.States[id].Transitions {
-			transition.Machine = m
-			transition.Trigger.Transition = transition
-			transition.Trigger.ProtocolType =
-				ProtocolType[transition.Trigger.Protocol]
-			transition.Trigger.NotificationType =
-				NotificationTypeID(transition.Trigger.TypeID)
-			trEvent := transition.Trigger
-			trEvent.filterEnvs()
-			for _, send := range transition.Sends {
-				send.Transition = transition
-				send.ProtocolType =
-					ProtocolType[send.Protocol]
-				send.NotificationType =
-					NotificationTypeID(send.TypeID)
-				if send.Protocol == MessageIssueCred && (send.EventData == nil ||
-					send.EventData.Issuing == nil) {
-					glog.Errorln("missing EventData of issue_cred msg. Target:",
-						send.Target)
-					return fmt.Errorf("bad format in (%s) missing Issuing data",
-						send.Data)
-				}
-				sEvent := send
-				sEvent.filterEnvs()
-
-				setSendDefs(sEvent)
-			}
-		}
-		if m.Initial == nil {
-			return errors.New("machine doesn't have initial state")
-		}
-		if id == m.Initial.Target {
-			if initSet {
-				return errors.New("machine has multiple initial states")
-			}
-			m.Current = m.Initial.Target
-			initSet = true
+	if m.Lua != nil {
+		try.To(m.Lua.initialize())
+	}
+	if m.Initial == nil {
+		return errors.New("machine doesn't have initial state")
+	}
+	try.To(m.initNestedStates())
+	try.To(m.initLuaErrorTarget())
+	m.walkStates(func(path string, state *State) {
+		for _, transition := range state.Transitions {
+			try.To(m.initTransition(path, transition))
 		}
+		state.entry = m.newStateTransition(path, state.OnEntry)
+		state.exit = m.newStateTransition(path, state.OnExit)
+		try.To(initSends(state.entry))
+		try.To(initSends(state.exit))
+		try.To(checkSendsWithoutInput(state.entry))
+		try.To(checkSendsWithoutInput(state.exit))
+	})
+	for _, transition := range m.GlobalTransitions {
+		try.To(m.initTransition("", transition))
+	}
+	if initial, ok := m.resolvePath("", m.Initial.Target); ok {
+		m.Initial.Target = initial
+		m.Current = m.leafPath(initial)
 	}
 	m.Initial.Machine = m
+	try.To(checkSendsWithoutInput(m.Initial))
 	for _, initSend := range m.Initial.Sends {
+		try.To(checkSendProtocol(initSend))
 		initSend.Transition = m.Initial
 		initSend.ProtocolType = ProtocolType[initSend.Protocol]
+		keepTemplates(initSend)
+		try.To(checkProof(initSend))
 		setSendDefs(initSend)
 	}
 
+	try.To(m.initTemplates())
+	try.To(m.initConstraints())
+	try.To(m.compileLua())
+
 	m.Initialized = true
 	return nil
 }
 
+// initLuaErrorTarget resolves the error target of the LuaConfig to the full
+// path of the state. Validate reports the unknown error target too, but the
+// machines aren't always validated.
+func (m *Machine) initLuaErrorTarget() error {
+	if m.Lua == nil || m.Lua.ErrorTarget == "" {
+		return nil
+	}
+	target, ok := m.resolvePath("", m.Lua.ErrorTarget)
+	if !ok {
+		return fmt.Errorf("lua config: unknown error target state \"%s\"",
+			m.Lua.ErrorTarget)
+	}
+	m.Lua.ErrorTarget = target
+	return nil
+}
+
+// initTransition initializes the transition of the state in the path. Target
+// is resolved to the full path of the target state. See resolvePath.
+func (m *Machine) initTransition(path string, transition *Transition) (err error) {
+	defer err2.Handle(&err)
+
+	if target, ok := m.resolvePath(path, transition.Target); ok {
+		transition.Target = target
+	}
+	transition.Machine = m
+	transition.Trigger.Transition = transition
+	transition.Trigger.ProtocolType =
+		ProtocolType[transition.Trigger.Protocol]
+	transition.Trigger.NotificationType =
+		NotificationTypeID(transition.Trigger.TypeID)
+	if transition.Trigger.ProtocolType == TimerProtocol {
+		transition.Trigger.duration =
+			try.To1(parseTimerDuration(transition.Trigger.Data))
+	}
+	trEvent := transition.Trigger
+	trEvent.filterEnvs()
+	return initSends(transition)
+}
+
+func initSends(transition *Transition) (err error) {
+	for _, send := range transition.Sends {
+		if err := checkSendProtocol(send); err != nil {
+			return err
+		}
+		send.Transition = transition
+		send.ProtocolType =
+			ProtocolType[send.Protocol]
+		send.NotificationType =
+			NotificationTypeID(send.TypeID)
+		if send.Protocol == MessageIssueCred && (send.EventData == nil ||
+			send.EventData.Issuing == nil) {
+			glog.Errorln("missing EventData of issue_cred msg. Target:",
+				send.Target)
+			return fmt.Errorf("bad format in (%s) missing Issuing data",
+				send.Data)
+		}
+		sEvent := send
+		sEvent.filterEnvs()
+		keepTemplates(send)
+		if err := checkProof(send); err != nil {
+			return err
+		}
+
+		setSendDefs(sEvent)
+	}
+	return nil
+}
+
+// keepTemplates keeps the structured sends given in the machine file, because
+// building the send replaces its EventData.
+func keepTemplates(send *Event) {
+	if send.EventData == nil {
+		return
+	}
+	if send.Proof.IsStructured() {
+		send.proof = send.EventData.Proof
+	}
+	if send.Issuing.IsStructured() {
+		send.issuing = send.EventData.Issuing
+	}
+	if send.Backend != nil {
+		send.backend = send.EventData.Backend
+	}
+}
+
+// checkSendProtocol returns error if the send's protocol cannot be sent.
+func checkSendProtocol(send *Event) error {
+	if _, ok := sendRules[send.Protocol]; !ok {
+		return fmt.Errorf("sending \"%s\" isn't supported", send.Protocol)
+	}
+	return nil
+}
+
+// checkSendWithoutInput returns error if the send is built without an input
+// event, like the initial and the on_entry and on_exit sends, but its rule
+// needs one.
+func checkSendWithoutInput(send *Event) error {
+	switch send.Rule {
+	case TriggerTypeUseInput, TriggerTypeFormat, TriggerTypeLua:
+		return fmt.Errorf("rule \"%s\" needs input which isn't available here",
+			send.Rule)
+	}
+	return nil
+}
+
+func checkSendsWithoutInput(transition *Transition) error {
+	for _, send := range transition.Sends {
+		if err := checkSendWithoutInput(send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allEvents returns all the trigger and send events of the machine.
+func (m *Machine) allEvents() (events []*Event) {
+	add := func(transitions ...*Transition) {
+		for _, t := range transitions {
+			if t == nil {
+				continue
+			}
+			if t.Trigger != nil {
+				events = append(events, t.Trigger)
+			}
+			events = append(events, t.Sends...)
+		}
+	}
+	add(m.Initial)
+	m.walkStates(func(_ string, state *State) {
+		add(state.Transitions...)
+		add(state.entry, state.exit)
+	})
+	add(m.GlobalTransitions...)
+	return events
+}
+
+// newStateTransition builds a pseudo transition for state's entry and exit
+// sends that they can be built with the same logic as Transition.Sends.
+func (m *Machine) newStateTransition(target string, sends []*Event) *Transition {
+	return &Transition{
+		Trigger: &Event{},
+		Sends:   sends,
+		Target:  target,
+		Machine: m,
+	}
+}
+
+// InitLua initializes the Lua state of the machine and compiles the scripts
+// to it. The libraries and the limits are set by the machine's LuaConfig, and
+// the built-in modules are always available, see registerModules. It
+// must be called after Initialize.
 func (m *Machine) InitLua() {
 	// intitialize lua stuff in own function to help tests
 	m.luaState = lua.NewState()
 	m.registerMemFuncs()
-	lua.OpenLibraries(m.luaState)
+	m.Lua.openLibraries(m.luaState)
+	m.registerModules()
+	m.setLuaHook()
+	m.loadLuaChunks()
 }
 
 func setSendDefs(e *Event) {
 	pType := e.ProtocolType
 	switch pType {
-	case agency.Protocol_ISSUE_CREDENTIAL, agency.Protocol_PRESENT_PROOF:
+	case agency.Protocol_ISSUE_CREDENTIAL, agency.Protocol_PRESENT_PROOF,
+		agency.Protocol_TRUST_PING:
 		e.WantStatus = true
 	default:
 		e.WantStatus = false
@@ -197,36 +399,66 @@ func setSendDefs(e *Event) {
 }
 
 func (m *Machine) CurrentState() *State {
-	return m.States[m.Current]
+	return m.State(m.Current)
 }
 
-// Triggers returns a transition if machine has it in its current state. If not
-// it returns nil.
+// transitions returns the transitions of the current state followed by the
+// transitions of its parent states and the global transitions, i.e. the order
+// in which they are checked.
+func (m *Machine) transitions() []*Transition {
+	var transitions []*Transition
+	for p := m.Current; p != ""; p = parentPath(p) {
+		if state := m.State(p); state != nil {
+			transitions = append(transitions, state.Transitions...)
+		}
+	}
+	return append(transitions, m.GlobalTransitions...)
+}
+
+// resolveTarget resolves TargetCurrent to the current state.
+func (m *Machine) resolveTarget(t *Transition) *Transition {
+	if t.Target != TargetCurrent {
+		return t
+	}
+	nt := new(Transition)
+	*nt = *t
+	nt.Target = m.Current
+	return nt
+}
+
+// Triggers returns a transition if machine has it in its current state or in
+// the global transitions. If not it returns nil.
 func (m *Machine) Triggers(status *agency.ProtocolStatus) *Transition {
-	for _, transition := range m.CurrentState().Transitions {
+	m.status = status
+	for _, transition := range m.transitions() {
 		if transition.Trigger.ProtocolType == status.State.ProtocolID.TypeID {
 			if ok, tgt := transition.Trigger.Triggers(status); ok {
-				return transition.withNewTarget(tgt)
+				return m.resolveTarget(transition.withNewTarget(tgt))
 			}
 		}
 	}
 	return nil
 }
 
-// TriggersByHook returns a transition if machine has it in its current state.
-// If not it returns nil.
+// TriggersByHook returns a transition if machine has it in its current state
+// or in the global transitions. If not it returns nil.
 func (m *Machine) TriggersByHook() *Transition {
-	for _, transition := range m.CurrentState().Transitions {
+	m.status = nil
+	for _, transition := range m.transitions() {
 		if transition.Trigger.ProtocolType == HookProtocol &&
 			transition.Trigger.TriggersByHook() {
-			return transition
+			return m.resolveTarget(transition)
 		}
 	}
 	return nil
 }
 
 func (m *Machine) TriggersByStep() *Transition {
-	for _, transition := range m.CurrentState().Transitions {
+	state := m.CurrentState()
+	if state == nil {
+		return nil
+	}
+	for _, transition := range state.Transitions {
 		if transition.Trigger.ProtocolType == TransientProtocol {
 			return transition
 		}
@@ -234,27 +466,78 @@ func (m *Machine) TriggersByStep() *Transition {
 	return nil
 }
 
+// TriggersByTimer returns a transition of the expired timer if the timer is
+// still valid, i.e. machine hasn't stepped after the timer was armed. If not
+// it returns nil.
+func (m *Machine) TriggersByTimer(td *TimerData) *Transition {
+	if td == nil || td.Seq != m.timerSeq {
+		glog.V(3).Infoln("discarding cancelled timer")
+		return nil
+	}
+	for _, transition := range m.transitions() {
+		if transition == td.Transition {
+			return m.resolveTarget(transition)
+		}
+	}
+	return nil
+}
+
+// TriggersByEmailError returns an email transition if machine has it in its
+// current state or in the global transitions. The runner of the machine calls
+// it when email delivery fails. The error message is stored to the ERR
+// register. If there isn't transition it returns nil.
+func (m *Machine) TriggersByEmailError(err error) *Transition {
+	m.status = nil
+	m.Memory[LUA_ERROR] = err.Error()
+	for _, transition := range m.transitions() {
+		if transition.Trigger.ProtocolType == EmailProtocol {
+			return m.resolveTarget(transition)
+		}
+	}
+	return nil
+}
+
 func (m *Machine) TriggersByBackendData(data *BackendData) *Transition {
 	glog.V(3).Infof("MachineType: %v", m.Type)
-	for _, transition := range m.CurrentState().Transitions {
+	m.status = nil
+	for _, transition := range m.transitions() {
 		if transition.Trigger.ProtocolType == BackendProtocol {
 			if ok, tgt := transition.Trigger.TriggersByBackendData(data); ok {
-				return transition.withNewTarget(tgt)
+				return m.resolveTarget(transition.withNewTarget(tgt))
 			}
 		}
 	}
 	return nil
 }
 
-func (m *Machine) Step(t *Transition) {
+// Step moves the machine to the transition's target state. If the target is
+// a composite state, the machine moves to its initial leaf state. Step returns
+// the on_exit sends of the states left and the on_entry sends of the states
+// entered. They are built only when the state really changes, i.e. not for
+// self transitions. The caller must send them after the transition's own
+// sends.
+func (m *Machine) Step(t *Transition) (sends []*Event) {
 	glog.V(1).Infoln(m.Current, "->", t.Target)
-	m.Current = t.Target
+	prev := m.Current
+	target := t.Target
+	if m.luaErrorTarget != "" {
+		target = m.luaErrorTarget
+	}
+	if m.State(target) == nil { // dynamic targets, e.g. by Lua
+		target, _ = m.resolvePath(m.Current, target)
+	}
+	m.Current = m.leafPath(target)
+	m.coverStep(t)
+	stateChanged := prev != m.Current
+	if stateChanged {
+		sends = append(sends, m.exitSends(prev, m.Current)...)
+	}
 
 	// coming to Initial state default is to clear the memory map
 	// TODO: when we will come back to initial state the memory is cleared, it
 	// seems that this should be done in a specific transition, which means
 	// that the rule isn't completely right, but maybe it's good enough.
-	if m.Current == m.Initial.Target {
+	if m.Current == m.leafPath(m.Initial.Target) {
 		if !m.KeepMemory && !m.KeepMemoryReported {
 			m.Memory = make(map[string]string)
 			glog.V(1).Infoln("--- clearing memory map")
@@ -263,14 +546,24 @@ func (m *Machine) Step(t *Transition) {
 		}
 		m.KeepMemoryReported = true
 	}
+	if stateChanged {
+		sends = append(sends, m.entrySends(prev, m.Current)...)
+	}
+	m.luaErrorTarget = "" // the entry and exit sends cannot redirect anymore
+	m.armTimers()
 	m.checkTerm()
+	return sends
 }
 
+// Answers returns a transition which answers the question if machine has it in
+// its current state or in the global transitions. If not it returns nil. See
+// Event.Answers for the question triggers.
 func (m *Machine) Answers(q *agency.Question) *Transition {
-	for _, transition := range m.CurrentState().Transitions {
-		if transition.Trigger.ProtocolType == q.Status.Notification.ProtocolType &&
-			transition.Trigger.Answers(q) {
-			return transition
+	for _, transition := range m.transitions() {
+		if transition.Trigger.ProtocolType == q.Status.Notification.ProtocolType {
+			if ok, tgt := transition.Trigger.Answers(q); ok {
+				return m.resolveTarget(transition.withNewTarget(tgt))
+			}
 		}
 	}
 	return nil
@@ -302,10 +595,13 @@ func (m *Machine) checkTerm() {
 func (m *Machine) Start(termChan TerminateOutChan) []*Event {
 	t := m.Initial
 	m.termChan = termChan
+	m.coverStep(nil)
+	m.armTimers()
+	var sends []*Event
 	if t.Sends != nil {
-		return t.BuildSendEvents(nil)
+		sends = t.BuildSendEvents(nil)
 	}
-	return nil
+	return append(sends, m.entrySends("", m.Current)...)
 }
 
 const stateWidthInChar = 100
@@ -317,29 +613,105 @@ func padStr(s string) string {
 	return fmt.Sprintf("%*s", stateWidthInChar, s)
 }
 
+// String returns the machine as a PlantUML state diagram. States are in
+// alphabetical order that the output is the same for the same machine. See
+// Mermaid and DOT for the other formats.
 func (m *Machine) String() string {
+	return m.plantUML(nil)
+}
+
+// PlantUMLCoverage returns the PlantUML state diagram like String, but the
+// states and transitions not covered are highlighted.
+func (m *Machine) PlantUMLCoverage(c *Coverage) string {
+	if c == nil {
+		c = NewCoverage()
+	}
+	return m.plantUML(c)
+}
+
+func (m *Machine) plantUML(c *Coverage) string {
 	w := new(bytes.Buffer)
 	fsmName := m.Name
 	if fsmName != "" {
 		fmt.Fprintf(w, "title %s\n", fsmName)
 	}
-	fmt.Fprintf(w, "[*] --> %s\n", m.Initial.Target)
-	for stateName, state := range m.States {
-		fmt.Fprintf(w, "state \"%s\" as %s\n", padStr(stateName), stateName)
-		for _, transition := range state.Transitions {
-			fmt.Fprintf(w, "%s --> %s: **%s**\\n", stateName,
-				transition.Target, transition.Trigger.String())
+	fmt.Fprintf(w, "[*] --> %s\n", stateAlias(m.diagramTarget("", m.Initial.Target)))
+	m.writeStates(w, c, "", m.States)
+	if len(m.GlobalTransitions) > 0 {
+		fmt.Fprintf(w, "state \"%s\" as %s\n", padStr("global transitions"), globalState)
+		for i, transition := range m.GlobalTransitions {
+			fmt.Fprintf(w, "%s %s %s: **%s**\\n", globalState,
+				plantUMLArrow(c, transitionID("", i)),
+				stateAlias(m.diagramTarget("", transition.Target)),
+				transition.Trigger.String())
 			for _, send := range transition.Sends {
 				fmt.Fprintf(w, "{%s} ==>\\n", send)
 			}
 			fmt.Fprintln(w)
 		}
-		glog.V(10).Infof("terminate: %s -> %v", stateName, state.Terminate)
+	}
+	return w.String()
+}
+
+// writeStates writes the states of the parent to the PlantUML diagram.
+// Composite states are written as nested state blocks, and their children are
+// referred by aliases built from their paths, see stateAlias. If the coverage
+// is given, the states and transitions not covered are highlighted.
+func (m *Machine) writeStates(w *bytes.Buffer, c *Coverage, parent string, states map[string]*State) {
+	for _, stateName := range sortedStateNames(states) {
+		state := states[stateName]
+		path := joinPath(parent, stateName)
+		alias := stateAlias(path)
+		color := ""
+		if c != nil && c.States[path] == 0 {
+			color = " " + uncoveredColor
+		}
+		if state.IsComposite() {
+			fmt.Fprintf(w, "state \"%s\" as %s%s {\n", stateName, alias, color)
+			fmt.Fprintf(w, "[*] --> %s\n", stateAlias(joinPath(path, state.Initial)))
+			m.writeStates(w, c, path, state.States)
+			fmt.Fprintln(w, "}")
+		} else {
+			fmt.Fprintf(w, "state \"%s\" as %s%s\n", padStr(stateName), alias, color)
+		}
+		for _, send := range state.OnEntry {
+			fmt.Fprintf(w, "%s : entry / %s\n", alias, send)
+		}
+		for _, send := range state.OnExit {
+			fmt.Fprintf(w, "%s : exit / %s\n", alias, send)
+		}
+		for i, transition := range state.Transitions {
+			fmt.Fprintf(w, "%s %s %s: **%s**\\n", alias,
+				plantUMLArrow(c, transitionID(path, i)),
+				stateAlias(m.diagramTarget(path, transition.Target)),
+				transition.Trigger.String())
+			for _, send := range transition.Sends {
+				fmt.Fprintf(w, "{%s} ==>\\n", send)
+			}
+			fmt.Fprintln(w)
+		}
+		glog.V(10).Infof("terminate: %s -> %v", path, state.Terminate)
 		if state.Terminate {
-			fmt.Fprintf(w, "%s --> [*]\n", stateName)
+			fmt.Fprintf(w, "%s --> [*]\n", alias)
 		} else {
 			fmt.Fprintln(w)
 		}
 	}
-	return w.String()
+}
+
+// uncoveredColor is the color of the states and transitions not covered in
+// the PlantUML diagrams.
+const uncoveredColor = "#FF6666"
+
+func plantUMLArrow(c *Coverage, id string) string {
+	if c != nil && c.Transitions[id] == 0 {
+		return "-[" + uncoveredColor + ",bold]->"
+	}
+	return "-->"
+}
+
+// stateAlias returns the PlantUML alias of the state path. Top level states
+// are referred by their names.
+func stateAlias(path string) string {
+	return strings.ReplaceAll(path, PathSeparator, "_")
 }
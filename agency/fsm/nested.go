@@ -0,0 +1,166 @@
+package fsm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PathSeparator separates the state names in the path of a nested state, e.g.
+// "REGISTER/WAITING_PIN". Machine.Current is always a full path to a leaf
+// state, i.e. a state without child states.
+const PathSeparator = "/"
+
+func joinPath(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + PathSeparator + name
+}
+
+// parentPath returns the path of the parent state or empty string for the top
+// level states.
+func parentPath(path string) string {
+	i := strings.LastIndex(path, PathSeparator)
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// isSelfOrAncestor tells if the state of the path is the same or an ancestor
+// of the state of the other path.
+func isSelfOrAncestor(path, other string) bool {
+	return path == other || strings.HasPrefix(other, path+PathSeparator)
+}
+
+// commonAncestor returns the path of the least common ancestor of the two
+// states, or empty string if they don't have one.
+func commonAncestor(a, b string) string {
+	for p := a; p != ""; p = parentPath(p) {
+		if isSelfOrAncestor(p, b) {
+			return p
+		}
+	}
+	return ""
+}
+
+// IsComposite tells if the state has child states.
+func (s *State) IsComposite() bool {
+	return len(s.States) > 0
+}
+
+// State returns the state by its full path, or nil if there isn't one.
+func (m *Machine) State(path string) *State {
+	if path == "" {
+		return nil
+	}
+	states := m.States
+	var state *State
+	for _, name := range strings.Split(path, PathSeparator) {
+		state = states[name]
+		if state == nil {
+			return nil
+		}
+		states = state.States
+	}
+	return state
+}
+
+// walkStates calls f for every state of the machine in the order of their
+// paths. Parents are visited before their children.
+func (m *Machine) walkStates(f func(path string, state *State)) {
+	var walk func(parent string, states map[string]*State)
+	walk = func(parent string, states map[string]*State) {
+		for _, name := range sortedStateNames(states) {
+			path := joinPath(parent, name)
+			f(path, states[name])
+			if states[name] != nil {
+				walk(path, states[name].States)
+			}
+		}
+	}
+	walk("", m.States)
+}
+
+func sortedStateNames(states map[string]*State) []string {
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolvePath resolves the target state name to a full path. The name is
+// looked up first from the children of the scope state, then from its
+// siblings, and so on up to the top level states. The name can be a relative
+// path itself, e.g. "REGISTER/WAITING_PIN".
+func (m *Machine) resolvePath(scope, target string) (string, bool) {
+	for s := scope; ; s = parentPath(s) {
+		path := joinPath(s, target)
+		if m.State(path) != nil {
+			return path, true
+		}
+		if s == "" {
+			return target, false
+		}
+	}
+}
+
+// leafPath descends from the state to the leaf state thru the initial states
+// of the composite states.
+func (m *Machine) leafPath(path string) string {
+	for state := m.State(path); state != nil && state.IsComposite(); state = m.State(path) {
+		path = joinPath(path, state.Initial)
+	}
+	return path
+}
+
+// initNestedStates checks that the composite states have valid initial
+// states.
+func (m *Machine) initNestedStates() (err error) {
+	m.walkStates(func(path string, state *State) {
+		if err != nil || state == nil || !state.IsComposite() {
+			return
+		}
+		if state.Initial == "" {
+			err = fmt.Errorf("composite state (%s) doesn't have initial state", path)
+		} else if state.States[state.Initial] == nil {
+			err = fmt.Errorf("composite state (%s) doesn't have initial state: %s",
+				path, state.Initial)
+		}
+	})
+	return err
+}
+
+// exitSends returns the on_exit sends of the states left when moving from
+// the state to the other, innermost first.
+func (m *Machine) exitSends(from, to string) (sends []*Event) {
+	lca := commonAncestor(from, to)
+	for p := from; p != lca && p != ""; p = parentPath(p) {
+		if state := m.State(p); state != nil && state.exit != nil {
+			sends = append(sends, state.exit.BuildSendEvents(nil)...)
+		}
+	}
+	return sends
+}
+
+// entrySends returns the on_entry sends of the states entered when moving
+// from the state to the other, outermost first. from can be empty when the
+// machine starts.
+func (m *Machine) entrySends(from, to string) (sends []*Event) {
+	lca := commonAncestor(from, to)
+	var entered []*State
+	for p := to; p != lca && p != ""; p = parentPath(p) {
+		if state := m.State(p); state != nil {
+			entered = append(entered, state)
+		}
+	}
+	for i := len(entered) - 1; i >= 0; i-- {
+		if entered[i].entry != nil {
+			sends = append(sends, entered[i].entry.BuildSendEvents(nil)...)
+		}
+	}
+	return sends
+}
@@ -0,0 +1,138 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const nestedMachineYAML = `
+name: nested machine
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_EQUAL
+        data: register
+      target: REGISTER
+  REGISTER:
+    initial: ASK_EMAIL
+    on_entry:
+    - protocol: basic_message
+      data: Registering.
+    on_exit:
+    - protocol: basic_message
+      data: Registering done.
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_EQUAL
+        data: cancel
+      target: IDLE
+    states:
+      ASK_EMAIL:
+        on_entry:
+        - protocol: basic_message
+          data: Email?
+        on_exit:
+        - protocol: basic_message
+          data: Email ok.
+        transitions:
+        - trigger:
+            protocol: basic_message
+            rule: INPUT_SAVE
+            data: EMAIL
+          target: ASK_PIN
+      ASK_PIN:
+        on_entry:
+        - protocol: basic_message
+          data: PIN?
+        transitions:
+        - trigger:
+            protocol: basic_message
+            rule: INPUT_EQUAL
+            data: "123"
+          target: DONE
+      DONE:
+        terminate: true
+`
+
+func contents(sends []*Event) []string {
+	s := make([]string, 0, len(sends))
+	for _, send := range sends {
+		s = append(s, send.BasicMessage.Content)
+	}
+	return s
+}
+
+func TestMachine_NestedStates(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "nested.yaml", Data: []byte(nestedMachineYAML)})
+	assert.SLen(m.Validate(), 0)
+	try.To(m.Initialize())
+	assert.SLen(m.Start(nil), 0)
+	assert.Equal(m.Current, "IDLE")
+
+	// composite target descends to its initial state
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE, "register")
+	sends := m.Step(m.Triggers(status))
+	assert.Equal(m.Current, "REGISTER/ASK_EMAIL")
+	assert.DeepEqual(contents(sends), []string{"Registering.", "Email?"})
+	assert.That(m.State("REGISTER").IsComposite())
+	assert.Equal(m.CurrentState(), m.State("REGISTER/ASK_EMAIL"))
+
+	// sibling transition doesn't exit the parent
+	status = protocolStatus(agency.Protocol_BASIC_MESSAGE, "me@example.com")
+	transition := m.Triggers(status)
+	assert.Equal(transition.Target, "REGISTER/ASK_PIN")
+	transition.BuildSendEvents(status)
+	sends = m.Step(transition)
+	assert.Equal(m.Current, "REGISTER/ASK_PIN")
+	assert.DeepEqual(contents(sends), []string{"Email ok.", "PIN?"})
+
+	// parent's transition applies to the children
+	status = protocolStatus(agency.Protocol_BASIC_MESSAGE, "cancel")
+	sends = m.Step(m.Triggers(status))
+	assert.Equal(m.Current, "IDLE")
+	assert.DeepEqual(contents(sends), []string{"Registering done."})
+}
+
+func TestMachine_NestedStatesInvalid(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	data := strings.Replace(nestedMachineYAML, "initial: ASK_EMAIL",
+		"initial: MISSING", 1)
+	m := NewMachine(MachineData{FType: "nested.yaml", Data: []byte(data)})
+	ds := m.Validate()
+	assert.That(ds.HasErrors())
+	assert.Equal(ds[0].State, "REGISTER")
+	assert.Error(m.Initialize())
+
+	data = strings.Replace(nestedMachineYAML, "target: ASK_PIN",
+		"target: MISSING", 1)
+	m = NewMachine(MachineData{FType: "nested.yaml", Data: []byte(data)})
+	ds = m.Validate()
+	assert.That(ds.HasErrors())
+	assert.Equal(ds[0].String(),
+		"ERROR: REGISTER/ASK_EMAIL.transitions[0]: unknown target state \"MISSING\"")
+}
+
+func TestMachine_NestedStatesString(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "nested.yaml", Data: []byte(nestedMachineYAML)})
+	try.To(m.Initialize())
+	s := m.String()
+	assert.That(strings.Contains(s, "state \"REGISTER\" as REGISTER {\n"+
+		"[*] --> REGISTER_ASK_EMAIL\n"), s)
+	assert.That(strings.Contains(s, "REGISTER_ASK_EMAIL --> REGISTER_ASK_PIN"), s)
+	assert.That(strings.Contains(s, "REGISTER_ASK_PIN --> REGISTER_DONE"), s)
+	assert.That(strings.Contains(s, "REGISTER_DONE --> [*]"), s)
+}
@@ -0,0 +1,132 @@
+package fsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+)
+
+// ProofPredicate is the predicate of the structured proof request, e.g. age
+// >= 18. The agency API doesn't have restrictions for the predicates, only
+// for the attributes.
+type ProofPredicate struct {
+	ID    string         `json:"id,omitempty"`
+	Name  string         `json:"name"`
+	Type  string         `json:"p_type"`
+	Value PredicateValue `json:"p_value"`
+}
+
+// PredicateValue is the integer value of the predicate. It can be given as a
+// number or as a string, which is needed for the FORMAT_MEM templates.
+type PredicateValue string
+
+func (v *PredicateValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = PredicateValue(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("predicate value: %w", err)
+	}
+	*v = PredicateValue(n.String())
+	return nil
+}
+
+// predicateTypes are the predicate types supported by the agency.
+var predicateTypes = map[string]struct{}{
+	">=": {}, ">": {}, "<=": {}, "<": {},
+}
+
+// IsStructured tells if the proof request is given with the attributes and
+// the predicates instead of the ProofJSON.
+func (p *Proof) IsStructured() bool {
+	return p != nil && (len(p.Attributes) > 0 || len(p.Predicates) > 0)
+}
+
+// Protocol returns the structured proof request in the format of the agency
+// API, see async.Pairwise.ReqProofWithPredicates.
+func (p *Proof) Protocol() (
+	attrs *agency.Protocol_Proof,
+	preds *agency.Protocol_Predicates,
+	err error,
+) {
+	attrs = &agency.Protocol_Proof{}
+	for _, a := range p.Attributes {
+		attrs.Attributes = append(attrs.Attributes, &agency.Protocol_Proof_Attribute{
+			ID:        a.ID,
+			Name:      a.Name,
+			CredDefID: a.CredDefID,
+		})
+	}
+	preds = &agency.Protocol_Predicates{}
+	for _, pred := range p.Predicates {
+		value, err := strconv.ParseInt(string(pred.Value), 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("predicate %s: %w", pred.Name, err)
+		}
+		preds.Predicates = append(preds.Predicates, &agency.Protocol_Predicates_Predicate{
+			ID:     pred.ID,
+			Name:   pred.Name,
+			PType:  pred.Type,
+			PValue: value,
+		})
+	}
+	return attrs, preds, nil
+}
+
+// checkProof returns error if the structured proof request of the send has
+// unknown predicate type. Validate tells the same, but the machine must not
+// be loaded without the validation either.
+func checkProof(send *Event) error {
+	if send.proof == nil {
+		return nil
+	}
+	for _, p := range send.proof.Predicates {
+		if _, ok := predicateTypes[p.Type]; !ok {
+			return fmt.Errorf("predicate %s: unknown type \"%s\"", p.Name, p.Type)
+		}
+	}
+	return nil
+}
+
+// buildProofSend builds the proof request of the send. The structured
+// request is read from the definition given in the machine file, because the
+// send's EventData is replaced when it's built.
+func (t *Transition) buildProofSend(send *Event) {
+	if send.proof == nil {
+		switch send.Rule {
+		case TriggerTypeData:
+			send.EventData = &EventData{Proof: &Proof{ProofJSON: send.Data}}
+		case TriggerTypeFormatFromMem:
+			send.EventData = &EventData{Proof: &Proof{ProofJSON: t.FmtFromMem(send)}}
+		}
+		return
+	}
+	format := func(s string) string {
+		if send.Rule != TriggerTypeFormatFromMem {
+			return s
+		}
+		return t.fmtFromMem(s)
+	}
+	proof := &Proof{}
+	for _, a := range send.proof.Attributes {
+		proof.Attributes = append(proof.Attributes, ProofAttr{
+			ID:        a.ID,
+			Name:      format(a.Name),
+			CredDefID: format(a.CredDefID),
+		})
+	}
+	for _, p := range send.proof.Predicates {
+		proof.Predicates = append(proof.Predicates, ProofPredicate{
+			ID:    p.ID,
+			Name:  format(p.Name),
+			Type:  p.Type,
+			Value: PredicateValue(format(string(p.Value))),
+		})
+	}
+	send.EventData = &EventData{Proof: proof}
+}
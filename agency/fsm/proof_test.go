@@ -0,0 +1,140 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const proofMachineYAML = `
+name: proof machine
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_SAVE
+        data: AGE
+      sends:
+      - protocol: present_proof
+        rule: FORMAT_MEM
+        event_data:
+          proof:
+            attributes:
+            - name: email
+              credDefId: "{{.CRED_DEF}}"
+            predicates:
+            - name: age
+              p_type: ">="
+              p_value: "{{.AGE}}"
+            - name: score
+              p_type: ">"
+              p_value: 10
+      target: WAITING_PROOF
+  WAITING_PROOF:
+    transitions:
+    - trigger:
+        protocol: present_proof
+        type_id: ANSWER_NEEDED_PROOF_VERIFY
+        rule: ACCEPT_AND_INPUT_VALUES
+        data: '[{"name":"email"},{"name":"age","predicate":">="}]'
+      sends:
+      - protocol: answer
+        data: ACK
+      target: DONE
+  DONE:
+    terminate: true
+`
+
+func TestMachine_StructuredProof(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "proof.yaml", Data: []byte(proofMachineYAML)})
+	assert.SLen(m.Validate(), 0)
+	try.To(m.Initialize())
+	m.Start(nil)
+	m.Memory["CRED_DEF"] = "EMAIL_CRED_DEF"
+
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE, "18")
+	transition := m.Triggers(status)
+	sends := transition.BuildSendEvents(status)
+	assert.SLen(sends, 1)
+	proof := sends[0].Proof
+	assert.That(proof.IsStructured())
+	assert.DeepEqual(proof.Attributes, []ProofAttr{{Name: "email", CredDefID: "EMAIL_CRED_DEF"}})
+	assert.DeepEqual(proof.Predicates, []ProofPredicate{
+		{Name: "age", Type: ">=", Value: "18"},
+		{Name: "score", Type: ">", Value: "10"},
+	})
+	attrs, preds := try.To2(proof.Protocol())
+	assert.SLen(attrs.Attributes, 1)
+	assert.Equal(attrs.Attributes[0].CredDefID, "EMAIL_CRED_DEF")
+	assert.SLen(preds.Predicates, 2)
+	assert.Equal(preds.Predicates[0].PValue, int64(18))
+	assert.Equal(preds.Predicates[1].PType, ">")
+
+	// templates are kept for the next send
+	status = protocolStatus(agency.Protocol_BASIC_MESSAGE, "21")
+	sends = m.Triggers(status).BuildSendEvents(status)
+	assert.Equal(sends[0].Proof.Predicates[0].Value, PredicateValue("21"))
+	m.Step(transition)
+
+	q := &agency.Question{
+		TypeID: agency.Question_PROOF_VERIFY_WAITS,
+		Status: &agency.AgentStatus{Notification: &agency.Notification{
+			ProtocolType: agency.Protocol_PRESENT_PROOF,
+		}},
+		Question: &agency.Question_ProofVerify{ProofVerify: &agency.Question_ProofVerifyMsg{
+			Attributes: []*agency.Question_ProofVerifyMsg_Attribute{
+				{Name: "email", Value: "me@example.com", CredDefID: "EMAIL_CRED_DEF"},
+			},
+		}},
+	}
+	transition = m.Answers(q)
+	assert.NotNil(transition)
+	assert.Equal(m.Memory["email"], "me@example.com")
+	// the attributes of the verifier don't have the predicates
+	assert.SLen(q.GetProofVerify().Attributes, 1)
+	assert.Equal(m.Memory["age"], "true")
+
+	_, _, err := (&Proof{Predicates: []ProofPredicate{{Name: "age", Value: "old"}}}).Protocol()
+	assert.Error(err)
+}
+
+func TestMachine_StructuredProofInvalid(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const fsm = `
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+      sends:
+      - protocol: present_proof
+        event_data:
+          proof:
+            predicates:
+            - name: age
+              p_type: "=="
+              p_value: "{{.AGE}}"
+      target: DONE
+  DONE:
+    terminate: true
+`
+	m := NewMachine(MachineData{FType: "proof.yaml", Data: []byte(fsm)})
+	ds := m.Validate()
+	assert.SLen(ds, 2)
+	assert.Equal(ds[0].Msg, `unknown predicate type "=="`)
+	assert.Equal(ds[1].Msg, `predicate age value must be integer, not "{{.AGE}}"`)
+	err := m.Initialize()
+	assert.Error(err)
+	assert.That(strings.HasSuffix(err.Error(), `predicate age: unknown type "=="`), err.Error())
+}
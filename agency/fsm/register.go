@@ -0,0 +1,135 @@
+package fsm
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/findy-network/findy-common-go/crypto"
+	"github.com/findy-network/findy-common-go/crypto/db"
+	"github.com/findy-network/findy-common-go/x"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// Register is a key-value store which Lua scripts can access by its name with
+// getRegValue and setRegValue functions. See REG_MEMORY, REG_DB and
+// REG_PROCESS.
+type Register interface {
+	Get(key string) (value string, found bool)
+	Set(key, value string) error
+}
+
+// RegisterBucket is the bucket name where DB registers keep their values.
+// Remember to add it to db.Cfg.Buckets when creating the database.
+var RegisterBucket = []byte("fsm_registers")
+
+type processMap = map[string]string
+
+// processRegister is shared by all the machines of the process. It's safe to
+// use from the conversation goroutines.
+var processRegister = x.NewRWMap[processMap]()
+
+type procRegister struct{}
+
+func (procRegister) Get(key string) (value string, found bool) {
+	processRegister.Rx(func(m processMap) {
+		value, found = m[key]
+	})
+	return value, found
+}
+
+func (procRegister) Set(key, value string) error {
+	processRegister.Set(key, value)
+	return nil
+}
+
+// memRegister is the machine's own memory map.
+type memRegister map[string]string
+
+func (r memRegister) Get(key string) (value string, found bool) {
+	value, found = r[key]
+	return value, found
+}
+
+func (r memRegister) Set(key, value string) error {
+	r[key] = value
+	return nil
+}
+
+type dbRegister struct {
+	db     db.Handle
+	cipher *crypto.Cipher
+	prefix string
+}
+
+// NewDBRegister creates a persistent register backed by the database. Values
+// are stored to the RegisterBucket, and the keys are prefixed with the name,
+// e.g. the machine name, that registers of the different bots don't collide.
+// The values are encrypted with the cipher and the keys are hashed, because
+// the scripts can store personal data. The cipher can be nil if the database
+// takes care of the encryption itself, e.g. in tests.
+func NewDBRegister(h db.Handle, c *crypto.Cipher, name string) Register {
+	return &dbRegister{db: h, cipher: c, prefix: name + "/"}
+}
+
+func (r *dbRegister) Get(key string) (value string, found bool) {
+	defer err2.Catch(err2.Err(func(error) {
+		value, found = "", false
+	}))
+
+	keyValue := &db.Data{Write: copyBytes}
+	found = try.To1(r.db.GetKeyValueFromBucket(RegisterBucket,
+		&db.Data{Data: []byte(r.prefix + key), Read: hashKey},
+		keyValue,
+	))
+	if !found {
+		return "", false
+	}
+	return string(try.To1(decrypt(r.cipher, keyValue.Data))), true
+}
+
+func (r *dbRegister) Set(key, value string) (err error) {
+	defer err2.Handle(&err, "db register")
+
+	return r.db.AddKeyValueToBucket(RegisterBucket,
+		&db.Data{Data: []byte(value), Read: func(value []byte) []byte {
+			return encrypt(r.cipher, value)
+		}},
+		&db.Data{Data: []byte(r.prefix + key), Read: hashKey},
+	)
+}
+
+func copyBytes(b []byte) []byte {
+	return append(b[:0:0], b...)
+}
+
+// encrypt encrypts the value stored to the database. Without the cipher the
+// value is stored as is.
+func encrypt(c *crypto.Cipher, value []byte) []byte {
+	if c == nil {
+		return copyBytes(value)
+	}
+	return c.TryEncrypt(value)
+}
+
+// decrypt decrypts the value read from the database. It returns error instead
+// of panicking, because the value can be corrupted or stored without the
+// cipher.
+func decrypt(c *crypto.Cipher, value []byte) (out []byte, err error) {
+	if c == nil {
+		return copyBytes(value), nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decrypt: %v", r)
+		}
+	}()
+	return c.TryDecrypt(value), nil
+}
+
+// hashKey makes the hash of the key that we don't store the keys, e.g. the
+// connection IDs, as plain.
+func hashKey(key []byte) []byte {
+	h := sha256.Sum256(key)
+	return h[:]
+}
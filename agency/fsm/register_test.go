@@ -0,0 +1,105 @@
+package fsm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/findy-network/findy-common-go/crypto"
+	"github.com/findy-network/findy-common-go/crypto/db"
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const counterMachineYAML = `
+name: counter machine
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_SAVE
+        data: REG
+      sends:
+      - protocol: basic_message
+        rule: LUA
+        data: |
+          local reg = getRegValue("MEM", "REG")
+          local count = tonumber(getRegValue(reg, "COUNT"))
+          setRegValue(reg, "COUNT", tostring(count + 1))
+          setRegValue("MEM", "OUTPUT", reg .. ":" .. (count + 1))
+      target: IDLE
+`
+
+func TestDBRegister(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	h := db.NewMemDB([][]byte{RegisterBucket}, "MEMORY_registers")
+	r := NewDBRegister(h, nil, "bot")
+	_, found := r.Get("KEY")
+	assert.ThatNot(found)
+	try.To(r.Set("KEY", "value"))
+	v, found := r.Get("KEY")
+	assert.That(found)
+	assert.Equal(v, "value")
+
+	// registers of the other bots don't see the value
+	_, found = NewDBRegister(h, nil, "other").Get("KEY")
+	assert.ThatNot(found)
+}
+
+func TestDBRegister_encrypted(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	h := db.NewMemDB([][]byte{RegisterBucket}, "MEMORY_encrypted_registers")
+	r := NewDBRegister(h, crypto.NewCipher(make([]byte, 32)), "bot")
+	try.To(r.Set("EMAIL", "me@example.com"))
+	v, found := r.Get("EMAIL")
+	assert.That(found)
+	assert.Equal(v, "me@example.com")
+
+	// neither the value nor the key is stored as plain
+	values := try.To1(h.GetAllValuesFromBucket(RegisterBucket))
+	assert.SLen(values, 1)
+	assert.ThatNot(bytes.Contains(values[0], []byte("example")))
+	_, found = NewDBRegister(h, crypto.NewCipher(bytes.Repeat([]byte{1}, 32)), "bot").Get("EMAIL")
+	assert.ThatNot(found)
+}
+
+func TestLuaRegisters(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	h := db.NewMemDB([][]byte{RegisterBucket}, "MEMORY_lua_registers")
+	newMachine := func() *Machine {
+		m := NewMachine(MachineData{FType: "counter.yaml",
+			Data: []byte(counterMachineYAML)})
+		try.To(m.Initialize())
+		m.DB = NewDBRegister(h, nil, m.Name)
+		m.InitLua()
+		m.Start(nil)
+		m.Memory["COUNT"] = "0"
+		return m
+	}
+	count := func(m *Machine, reg string) string {
+		status := protocolStatus(agency.Protocol_BASIC_MESSAGE, reg)
+		sends := m.Triggers(status).BuildSendEvents(status)
+		assert.SLen(sends, 1)
+		return sends[0].BasicMessage.Content
+	}
+	try.To(NewDBRegister(h, nil, "counter machine").Set("COUNT", "0"))
+	try.To(procRegister{}.Set("COUNT", "0"))
+	m1, m2 := newMachine(), newMachine()
+
+	// machines have their own memories but they share DB and PROC
+	assert.Equal(count(m1, REG_MEMORY), "MEM:1")
+	assert.Equal(count(m2, REG_MEMORY), "MEM:1")
+	assert.Equal(count(m1, REG_DB), "DB:1")
+	assert.Equal(count(m2, REG_DB), "DB:2")
+	assert.Equal(count(m1, REG_PROCESS), "PROC:1")
+	assert.Equal(count(m2, REG_PROCESS), "PROC:2")
+
+	// DB register persists over the machine instances
+	assert.Equal(count(newMachine(), REG_DB), "DB:3")
+}
@@ -0,0 +1,316 @@
+package fsm
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/findy-network/findy-common-go/crypto"
+	"github.com/findy-network/findy-common-go/crypto/db"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// RoomBucket is the bucket name where the room brokers keep their rooms.
+// Remember to add it to db.Cfg.Buckets when creating the database.
+var RoomBucket = []byte("fsm_rooms")
+
+// Rooms is the room broker of the backend machine, see the ROOM_ rules. The
+// members of the rooms are the conversations' connection IDs with their
+// callsigns. The rooms are persisted to the database if it's given. Rooms is
+// thread-safe, because it's shared with the Router.
+type Rooms struct {
+	mu    sync.RWMutex
+	rooms map[string]map[string]string // room -> connID -> callsign
+
+	db     db.Handle
+	cipher *crypto.Cipher
+	broker string
+}
+
+// room is the persisted room. The broker name is stored with it because the
+// bucket is shared with the other brokers.
+type room struct {
+	Broker  string            `json:"broker"`
+	Name    string            `json:"name"`
+	Members map[string]string `json:"members"`
+}
+
+// NewRooms creates the room broker and loads its rooms from the database. The
+// name of the broker, e.g. the machine name, separates the rooms of the
+// different bots. The database can be nil, and then the rooms are only in
+// memory. The rooms are encrypted with the cipher and their keys are hashed
+// like the DB register's, see NewDBRegister. The records which cannot be
+// read are skipped.
+func NewRooms(h db.Handle, c *crypto.Cipher, name string) (r *Rooms, err error) {
+	defer err2.Handle(&err, "load rooms")
+
+	r = &Rooms{rooms: make(map[string]map[string]string), db: h, cipher: c,
+		broker: name}
+	if h == nil {
+		return r, nil
+	}
+	values := try.To1(h.GetAllValuesFromBucket(RoomBucket))
+	for _, value := range values {
+		rm, err := r.load(value)
+		if err != nil {
+			glog.Warningln("skipping room record:", err)
+			continue
+		}
+		if rm.Broker == name && len(rm.Members) > 0 {
+			r.rooms[rm.Name] = rm.Members
+		}
+	}
+	return r, nil
+}
+
+func (r *Rooms) load(value []byte) (rm room, err error) {
+	data, err := decrypt(r.cipher, value)
+	if err != nil {
+		return rm, err
+	}
+	err = json.Unmarshal(data, &rm)
+	return rm, err
+}
+
+// Join adds the connection to the room with the callsign, or changes its
+// callsign.
+func (r *Rooms) Join(name, connID, callsign string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.join(name, connID, callsign)
+}
+
+// add adds the connection to the room without a callsign if it isn't a
+// member already.
+func (r *Rooms) add(name, connID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.rooms[name][connID]; ok {
+		return nil
+	}
+	return r.join(name, connID, "")
+}
+
+func (r *Rooms) join(name, connID, callsign string) error {
+	members, ok := r.rooms[name]
+	if !ok {
+		members = make(map[string]string)
+		r.rooms[name] = members
+	}
+	members[connID] = callsign
+	return r.save(name)
+}
+
+// Leave removes the connection from the room.
+func (r *Rooms) Leave(name, connID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.rooms[name], connID)
+	if len(r.rooms[name]) == 0 {
+		delete(r.rooms, name)
+	}
+	return r.save(name)
+}
+
+// Callsign returns the callsign of the connection in the room.
+func (r *Rooms) Callsign(name, connID string) (callsign string, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	callsign, ok = r.rooms[name][connID]
+	return callsign, ok
+}
+
+// Members returns the connection IDs of the room in order.
+func (r *Rooms) Members(name string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	members := make([]string, 0, len(r.rooms[name]))
+	for connID := range r.rooms[name] {
+		members = append(members, connID)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Callsigns returns the callsigns of the room in order. The members without
+// a callsign, i.e. joined by the join route, aren't listed.
+func (r *Rooms) Callsigns(name string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	callsigns := make([]string, 0, len(r.rooms[name]))
+	for _, callsign := range r.rooms[name] {
+		if callsign != "" {
+			callsigns = append(callsigns, callsign)
+		}
+	}
+	sort.Strings(callsigns)
+	return callsigns
+}
+
+// List returns the names of the rooms having members in order.
+func (r *Rooms) List() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.rooms))
+	for name := range r.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *Rooms) save(name string) (err error) {
+	if r.db == nil {
+		return nil
+	}
+	defer err2.Handle(&err, "save room %s", name)
+
+	key := &db.Data{Data: []byte(r.broker + "/" + name), Read: hashKey}
+	members, ok := r.rooms[name]
+	if !ok {
+		return r.db.RmKeyValueFromBucket(RoomBucket, key)
+	}
+	data := try.To1(json.Marshal(room{Broker: r.broker, Name: name, Members: members}))
+	return r.db.AddKeyValueToBucket(RoomBucket,
+		&db.Data{Data: encrypt(r.cipher, data)}, key)
+}
+
+// UsesRooms tells if the machine has the room rules. The runners persist the
+// rooms only for these machines, and the database needs RoomBucket only then.
+func (m *Machine) UsesRooms() bool {
+	for _, e := range m.allEvents() {
+		switch e.Rule {
+		case TriggerTypeRoomJoin, TriggerTypeRoomLeave, TriggerTypeRoomList,
+			TriggerTypeRoomForward:
+			return true
+		}
+	}
+	return false
+}
+
+// rooms returns the machine's room broker. If the runner hasn't set it, the
+// rooms are only in memory.
+func (m *Machine) rooms() *Rooms {
+	if m.Rooms == nil {
+		m.Rooms = try.To1(NewRooms(nil, nil, m.Name))
+	}
+	return m.Rooms
+}
+
+// roomOf returns the room of the backend data, i.e. its Subject or SessionID.
+func roomOf(data *BackendData) string {
+	if data.Subject != "" {
+		return data.Subject
+	}
+	return data.SessionID
+}
+
+// triggersRoom executes the room rules of the trigger. The room and the
+// callsign of the sender are stored to the ROOM and CALLSIGN registers.
+func (e Event) triggersRoom(data *BackendData) bool {
+	arg := data.Content
+	if e.Data != "" {
+		if !strings.HasPrefix(arg, e.Data) {
+			return false
+		}
+		arg = strings.TrimSpace(strings.TrimPrefix(arg, e.Data))
+	}
+	name := roomOf(data)
+	if name == "" || data.ConnID == "" {
+		glog.Warningln("room rule without room or connection:", e.Rule)
+		return false
+	}
+	rooms := e.Machine.rooms()
+	memory := e.Machine.Memory
+	memory[LUA_ROOM] = name
+
+	var err error
+	switch e.Rule {
+	case TriggerTypeRoomJoin:
+		if arg == "" {
+			glog.Warningln("room join without callsign:", data.ConnID)
+			return false
+		}
+		memory[LUA_CALLSIGN] = arg
+		err = rooms.Join(name, data.ConnID, arg)
+	case TriggerTypeRoomLeave:
+		callsign, ok := rooms.Callsign(name, data.ConnID)
+		if !ok {
+			return false
+		}
+		memory[LUA_CALLSIGN] = callsign
+		err = rooms.Leave(name, data.ConnID)
+	case TriggerTypeRoomList:
+		memory[LUA_CALLSIGN], _ = rooms.Callsign(name, data.ConnID)
+	}
+	if err != nil {
+		glog.Errorln("room broker:", err)
+		memory[LUA_ERROR] = err.Error()
+	}
+	memory[LUA_ROOM_MEMBERS] = strings.Join(rooms.Callsigns(name), ",")
+	memory[LUA_ROOMS] = strings.Join(rooms.List(), ",")
+	return true
+}
+
+// buildRoomForward builds the ROOM_FORWARD send to the backend data for every
+// member of the sender's room. If the sender isn't a member, nothing is
+// forwarded, unless it has just left the room. The content is the input with
+// the sender's callsign if it has one, or the send's data formatted from the
+// memory if it's given. The no_echo skips the sender.
+func (t *Transition) buildRoomForward(input *Event, send *Event) (sends []*Event) {
+	if input == nil || input.EventData == nil || input.Backend == nil {
+		glog.Warningln("room forward without backend input")
+		return nil
+	}
+	data := input.Backend
+	name := roomOf(data)
+	rooms := t.Machine.rooms()
+	callsign, ok := rooms.Callsign(name, data.ConnID)
+	if !ok && t.Trigger != nil && t.Trigger.Rule == TriggerTypeRoomLeave {
+		// the sender has just left, and it's told to the rest of the room
+		callsign, ok = t.Machine.Memory[LUA_CALLSIGN], true
+	}
+	if !ok {
+		glog.V(1).Infoln("room forward: not member of", name)
+		return nil
+	}
+	t.Machine.Memory[LUA_ROOM] = name
+	t.Machine.Memory[LUA_CALLSIGN] = callsign
+	content := data.Content
+	if callsign != "" {
+		content = callsign + ": " + content
+	}
+	if send.Data != "" {
+		content = t.FmtFromMem(send)
+	}
+	for _, connID := range rooms.Members(name) {
+		if connID == data.ConnID && (send.NoEcho || data.NoEcho) {
+			continue
+		}
+		sends = append(sends, &Event{
+			Protocol:     send.Protocol,
+			Rule:         send.Rule,
+			Data:         send.Data,
+			ProtocolType: send.ProtocolType,
+			EventData: &EventData{Backend: &BackendData{
+				ConnID:    connID,
+				Protocol:  MessageBackend,
+				SessionID: data.SessionID,
+				Subject:   name,
+				Content:   content,
+			}},
+			Transition: t,
+		})
+	}
+	return sends
+}
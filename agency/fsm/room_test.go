@@ -0,0 +1,190 @@
+package fsm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/findy-network/findy-common-go/crypto"
+	"github.com/findy-network/findy-common-go/crypto/db"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const roomMachineYAML = `
+name: room broker
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: backend
+        rule: ROOM_JOIN
+        data: /join
+      sends:
+      - protocol: backend
+        rule: ROOM_FORWARD
+        data: "{{.CALLSIGN}} joined {{.ROOM}}: {{.ROOM_MEMBERS}}"
+      target: IDLE
+    - trigger:
+        protocol: backend
+        rule: ROOM_LEAVE
+        data: /leave
+      sends:
+      - protocol: backend
+        rule: ROOM_FORWARD
+        no_echo: true
+        data: "{{.CALLSIGN}} left"
+      target: IDLE
+    - trigger:
+        protocol: backend
+        rule: ROOM_LIST
+        data: /list
+      sends:
+      - protocol: backend
+        rule: FORMAT_MEM
+        data: "{{.ROOMS}}"
+        event_data:
+          backend:
+            ConnID: "{{.CONN_ID}}"
+      target: IDLE
+    - trigger:
+        protocol: backend
+        rule: INPUT_EQUAL
+        data: /quit
+      target: DONE
+    - trigger:
+        protocol: backend
+      sends:
+      - protocol: backend
+        rule: ROOM_FORWARD
+        no_echo: true
+      target: IDLE
+  DONE:
+    terminate: true
+`
+
+func TestRooms(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	h := db.NewMemDB([][]byte{RoomBucket})
+	r := try.To1(NewRooms(h, nil, "broker"))
+	try.To(r.Join("lobby", "c2", "bob"))
+	try.To(r.Join("lobby", "c1", "alice"))
+	try.To(r.Join("hall", "c1", "alice"))
+	other := try.To1(NewRooms(h, nil, "other"))
+	try.To(other.Join("lobby", "c3", "eve"))
+
+	r = try.To1(NewRooms(h, nil, "broker"))
+	assert.DeepEqual(r.List(), []string{"hall", "lobby"})
+	assert.DeepEqual(r.Members("lobby"), []string{"c1", "c2"})
+	assert.DeepEqual(r.Callsigns("lobby"), []string{"alice", "bob"})
+	callsign, ok := r.Callsign("hall", "c1")
+	assert.That(ok)
+	assert.Equal(callsign, "alice")
+
+	try.To(r.Leave("hall", "c1"))
+	r = try.To1(NewRooms(h, nil, "broker"))
+	assert.DeepEqual(r.List(), []string{"lobby"})
+	_, ok = r.Callsign("hall", "c1")
+	assert.ThatNot(ok)
+	assert.DeepEqual(try.To1(NewRooms(h, nil, "other")).Members("lobby"), []string{"c3"})
+}
+
+func TestRooms_encrypted(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	h := db.NewMemDB([][]byte{RoomBucket})
+	c := crypto.NewCipher(make([]byte, 32))
+	r := try.To1(NewRooms(h, c, "broker"))
+	try.To(r.Join("lobby", "conn-id", "alice"))
+
+	// neither the connection IDs nor the names are stored as plain
+	values := try.To1(h.GetAllValuesFromBucket(RoomBucket))
+	assert.SLen(values, 1)
+	for _, plain := range []string{"conn-id", "alice", "lobby", "broker"} {
+		assert.ThatNot(bytes.Contains(values[0], []byte(plain)), plain)
+	}
+
+	// the corrupt records are skipped
+	try.To(h.AddKeyValueToBucket(RoomBucket, &db.Data{Data: []byte("{")},
+		&db.Data{Data: []byte("corrupt")}))
+	r = try.To1(NewRooms(h, c, "broker"))
+	assert.DeepEqual(r.Members("lobby"), []string{"conn-id"})
+	assert.SLen(try.To1(NewRooms(h, nil, "broker")).List(), 0)
+}
+
+func TestMachine_RoomBroker(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewBackendMachine(MachineData{FType: "room.yaml", Data: []byte(roomMachineYAML)})
+	ds := m.Validate()
+	assert.SLen(ds, 0, ds)
+	try.To(m.Initialize())
+	assert.That(m.UsesRooms())
+	m.Rooms = try.To1(NewRooms(db.NewMemDB([][]byte{RoomBucket}), nil, m.Name))
+	m.InitLua()
+
+	step := func(connID, subject, content string) []*Event {
+		data := &BackendData{ConnID: connID, Subject: subject, Content: content}
+		transition := m.TriggersByBackendData(data)
+		if transition == nil {
+			return nil
+		}
+		return transition.BuildSendEventsFromBackendData(data)
+	}
+	contents := func(sends []*Event) (s []string) {
+		for _, send := range sends {
+			s = append(s, send.Backend.ConnID+" "+send.Backend.Content)
+		}
+		return s
+	}
+
+	m.Start(nil)
+	sends := step("c1", "lobby", "/join alice")
+	assert.DeepEqual(contents(sends), []string{"c1 alice joined lobby: alice"})
+	sends = step("c2", "lobby", "/join bob")
+	assert.DeepEqual(contents(sends), []string{
+		"c1 bob joined lobby: alice,bob",
+		"c2 bob joined lobby: alice,bob",
+	})
+	assert.Equal(sends[0].Backend.Subject, "lobby")
+	assert.Equal(m.Memory[LUA_ROOMS], "lobby")
+
+	// the list goes only to the sender
+	sends = step("c2", "lobby", "/list")
+	assert.DeepEqual(contents(sends), []string{"c2 lobby"})
+
+	// the messages are forwarded with the callsign without echo
+	sends = step("c1", "lobby", "hello")
+	assert.DeepEqual(contents(sends), []string{"c2 alice: hello"})
+
+	// the non-members can't leave or send to the room
+	assert.SLen(step("c3", "lobby", "/leave"), 0)
+	assert.SLen(step("c3", "lobby", "hello"), 0)
+	assert.DeepEqual(m.Rooms.Members("lobby"), []string{"c1", "c2"})
+
+	sends = step("c1", "lobby", "/leave")
+	assert.DeepEqual(contents(sends), []string{"c2 alice left"})
+	assert.Equal(m.Memory[LUA_ROOM_MEMBERS], "bob")
+
+	// the room is by the session if there's no subject
+	sends = step("c1", "", "/join alice")
+	assert.SLen(sends, 0)
+	data := &BackendData{ConnID: "c1", SessionID: "s1", Content: "/join alice"}
+	sends = m.TriggersByBackendData(data).BuildSendEventsFromBackendData(data)
+	assert.DeepEqual(contents(sends), []string{"c1 alice joined s1: alice"})
+}
+
+func TestMachine_RoomRuleInConversation(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	data := strings.ReplaceAll(roomMachineYAML, "protocol: backend", "protocol: basic_message")
+	ds := NewMachine(MachineData{FType: "room.yaml", Data: []byte(data)}).Validate()
+	found := false
+	for _, d := range ds {
+		found = found || d.Msg == `rule "ROOM_JOIN" is only for backend machines`
+	}
+	assert.That(found)
+}
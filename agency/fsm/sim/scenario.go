@@ -0,0 +1,474 @@
+package sim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/findy-network/findy-common-go/agency/fsm"
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/ghodss/yaml"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// Scenario is a scripted conversation with the machine. It's usually loaded
+// from a YAML file next to the machine file:
+//
+//	name: email is verified
+//	machine: email.yaml
+//	start:
+//	  state: IDLE
+//	steps:
+//	- message: hello
+//	  expect:
+//	    state: WAITING_EMAIL
+//	    sends:
+//	    - protocol: basic_message
+//	      data: What is your email?
+//	- wait: 10m
+//	  expect:
+//	    state: IDLE
+type Scenario struct {
+	Name string `json:"name,omitempty"`
+
+	// Machine and Backend are the machine files. Relative paths are resolved
+	// from the directory of the scenario file. Backend is optional.
+	Machine string `json:"machine"`
+	Backend string `json:"backend,omitempty"`
+
+	ConnID string `json:"conn_id,omitempty"`
+
+	// DB has the initial values of the conversation machine's DB register.
+	DB map[string]string `json:"db,omitempty"`
+
+	// Start has the expectations after the machines are started.
+	Start *Expect `json:"start,omitempty"`
+
+	Steps []*Step `json:"steps"`
+
+	// Coverage and BackendCoverage are the coverages of the machines after
+	// Run, see Reports.
+	Coverage        *fsm.Coverage `json:"-"`
+	BackendCoverage *fsm.Coverage `json:"-"`
+
+	dir string
+}
+
+// Step is the single input of the scenario and the expected results. Exactly
+// one of the inputs must be given.
+type Step struct {
+	Name string `json:"name,omitempty"`
+
+	Message  *string           `json:"message,omitempty"`
+	Status   *Status           `json:"status,omitempty"`
+	Question *Question         `json:"question,omitempty"`
+	Hook     map[string]string `json:"hook,omitempty"`
+	Backend  *BackendData      `json:"backend,omitempty"`
+	Wait     string            `json:"wait,omitempty"`
+
+	// EmailError makes email sends of the step fail with it.
+	EmailError string `json:"email_error,omitempty"`
+
+	Expect Expect `json:"expect"`
+}
+
+// Status is the protocol status update. Protocol is one of the FSM's protocol
+// names, e.g. present_proof. State is the name of the agency's protocol state,
+// and the default is OK.
+type Status struct {
+	Protocol string `json:"protocol"`
+	Content  string `json:"content,omitempty"`
+	State    string `json:"state,omitempty"`
+	Role     string `json:"role,omitempty"`
+}
+
+// Question is the agency's question. Type is ping, issue_propose,
+// proof_propose or proof_verify, which is the default. Attrs are the proposed
+// values of the issue_propose, or the proof values of the proof_propose and
+// the proof_verify. CredDefID is the cred def of the issue_propose.
+type Question struct {
+	Type      string `json:"type,omitempty"`
+	Attrs     []Attr `json:"attrs,omitempty"`
+	CredDefID string `json:"cred_def_id,omitempty"`
+}
+
+type Attr struct {
+	Name      string `json:"name"`
+	Value     string `json:"value,omitempty"`
+	CredDefID string `json:"cred_def_id,omitempty"`
+}
+
+// BackendData is the data from the backend to the conversation machine.
+type BackendData struct {
+	Content   string `json:"content,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+	ConnID    string `json:"conn_id,omitempty"`
+	NoEcho    bool   `json:"no_echo,omitempty"`
+}
+
+// Expect has the expected results of the input. Only the given fields are
+// checked. Sends are checked in order and all of them must match, i.e. an
+// empty list means that nothing must be sent.
+type Expect struct {
+	State        string            `json:"state,omitempty"`
+	Sends        []ExpectedSend    `json:"sends,omitempty"`
+	BackendState string            `json:"backend_state,omitempty"`
+	BackendSends []ExpectedSend    `json:"backend_sends,omitempty"`
+	Memory       map[string]string `json:"memory,omitempty"`
+	Terminated   bool              `json:"terminated,omitempty"`
+
+	// sends lists are nil when they aren't given
+	checkSends, checkBackendSends bool
+}
+
+// UnmarshalJSON tells apart the missing and the empty sends lists.
+func (e *Expect) UnmarshalJSON(data []byte) (err error) {
+	defer err2.Handle(&err)
+
+	type expect Expect // without the methods
+	var fields map[string]any
+	try.To(json.Unmarshal(data, &fields))
+	try.To(json.Unmarshal(data, (*expect)(e)))
+	_, e.checkSends = fields["sends"]
+	_, e.checkBackendSends = fields["backend_sends"]
+	return nil
+}
+
+// ExpectedSend is the expected send. If Match is given, Data isn't compared,
+// but it must match to the Match regular expression, which is useful e.g. for
+// PIN codes.
+type ExpectedSend struct {
+	Send
+	Match string `json:"match,omitempty"`
+}
+
+// LoadScenario loads the scenario file.
+func LoadScenario(fName string) (sc *Scenario, err error) {
+	defer err2.Handle(&err, "load scenario %s", fName)
+
+	sc = new(Scenario)
+	try.To(yaml.Unmarshal(try.To1(os.ReadFile(fName)), sc))
+	sc.dir = filepath.Dir(fName)
+	if sc.Name == "" {
+		sc.Name = filepath.Base(fName)
+	}
+	return sc, nil
+}
+
+// Run runs the scenario and returns an error listing all the failed
+// expectations.
+func (sc *Scenario) Run() (err error) {
+	defer err2.Handle(&err, "scenario %s", sc.Name)
+
+	s := try.To1(New(try.To1(sc.machineData(sc.Machine)), sc.backendData(), sc.ConnID))
+	sc.Coverage = s.Machine.Coverage()
+	if s.Backend != nil {
+		sc.BackendCoverage = s.Backend.Coverage()
+	}
+	for k, v := range sc.DB {
+		try.To(s.Machine.DB.Set(k, v))
+	}
+	var failures []string
+	out := try.To1(s.Start())
+	if sc.Start != nil {
+		failures = append(failures, sc.Start.check("start", s, out)...)
+	}
+	for i, step := range sc.Steps {
+		where := fmt.Sprintf("steps[%d]", i)
+		if step.Name != "" {
+			where += " " + step.Name
+		}
+		out, err := step.run(s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", where, err)
+		}
+		failures = append(failures, step.Expect.check(where, s, out)...)
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// Report is the coverage of the machine file merged from the scenarios.
+type Report struct {
+	File     string
+	Machine  *fsm.Machine
+	Coverage *fsm.Coverage
+}
+
+// Reports merges the coverages of the run scenarios by the machine files. The
+// reports are in the order of the files.
+func Reports(scenarios ...*Scenario) (reports []*Report, err error) {
+	defer err2.Handle(&err, "coverage reports")
+
+	byFile := make(map[string]*Report)
+	add := func(sc *Scenario, fName string, c *fsm.Coverage, backend bool) {
+		if fName == "" || c == nil {
+			return
+		}
+		md := try.To1(sc.machineData(fName))
+		file := try.To1(filepath.Abs(md.FType))
+		r, ok := byFile[file]
+		if !ok {
+			m := fsm.NewMachine(md)
+			if backend {
+				m = fsm.NewBackendMachine(md)
+			}
+			try.To(m.Initialize())
+			r = &Report{File: md.FType, Machine: m, Coverage: fsm.NewCoverage()}
+			byFile[file] = r
+			reports = append(reports, r)
+		}
+		r.Coverage.Merge(c)
+	}
+	for _, sc := range scenarios {
+		add(sc, sc.Machine, sc.Coverage, false)
+		add(sc, sc.Backend, sc.BackendCoverage, true)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].File < reports[j].File })
+	return reports, nil
+}
+
+func (sc *Scenario) machineData(fName string) (md fsm.MachineData, err error) {
+	defer err2.Handle(&err)
+
+	if !filepath.IsAbs(fName) {
+		fName = filepath.Join(sc.dir, fName)
+	}
+	return fsm.MachineData{FType: fName, Data: try.To1(os.ReadFile(fName))}, nil
+}
+
+func (sc *Scenario) backendData() *fsm.MachineData {
+	if sc.Backend == "" {
+		return nil
+	}
+	md := try.To1(sc.machineData(sc.Backend))
+	return &md
+}
+
+func (step *Step) run(s *Simulator) (out Output, err error) {
+	defer err2.Handle(&err)
+
+	s.MailErr = nil
+	if step.EmailError != "" {
+		s.MailErr = errors.New(step.EmailError)
+	}
+	switch {
+	case step.Message != nil:
+		return s.Message(*step.Message)
+	case step.Status != nil:
+		return s.Status(try.To1(step.Status.protocolStatus()))
+	case step.Question != nil:
+		return s.Question(try.To1(step.Question.question(s.ConnID)))
+	case step.Hook != nil:
+		return s.Hook(step.Hook)
+	case step.Backend != nil:
+		b := step.Backend
+		return s.BackendData(&fsm.BackendData{
+			ConnID:    b.ConnID,
+			Protocol:  fsm.MessageBackend,
+			NoEcho:    b.NoEcho,
+			SessionID: b.SessionID,
+			Subject:   b.Subject,
+			Content:   b.Content,
+		})
+	case step.Wait != "":
+		return s.Wait(try.To1(time.ParseDuration(step.Wait)))
+	}
+	return out, errors.New("step doesn't have input")
+}
+
+func (st *Status) protocolStatus() (status *agency.ProtocolStatus, err error) {
+	typeID, ok := fsm.ProtocolType[st.Protocol]
+	if !ok || st.Protocol == fsm.MessageNone {
+		return nil, fmt.Errorf("unknown protocol (%s)", st.Protocol)
+	}
+	state := agency.ProtocolState_OK
+	if st.State != "" {
+		v, ok := agency.ProtocolState_State_value[st.State]
+		if !ok {
+			return nil, fmt.Errorf("unknown protocol state (%s)", st.State)
+		}
+		state = agency.ProtocolState_State(v)
+	}
+	role := agency.Protocol_ADDRESSEE
+	if st.Role != "" {
+		v, ok := agency.Protocol_Role_value[st.Role]
+		if !ok {
+			return nil, fmt.Errorf("unknown role (%s)", st.Role)
+		}
+		role = agency.Protocol_Role(v)
+	}
+	status = &agency.ProtocolStatus{
+		State: &agency.ProtocolState{
+			ProtocolID: &agency.ProtocolID{TypeID: typeID, Role: role},
+			State:      state,
+		},
+	}
+	if typeID == agency.Protocol_BASIC_MESSAGE {
+		status.Status = &agency.ProtocolStatus_BasicMessage{
+			BasicMessage: &agency.ProtocolStatus_BasicMessageStatus{
+				Content: st.Content,
+			},
+		}
+	}
+	return status, nil
+}
+
+var questionTypes = map[string]struct {
+	typeID   agency.Question_Type
+	protocol agency.Protocol_Type
+}{
+	"ping":          {agency.Question_PING_WAITS, agency.Protocol_TRUST_PING},
+	"issue_propose": {agency.Question_ISSUE_PROPOSE_WAITS, agency.Protocol_ISSUE_CREDENTIAL},
+	"proof_propose": {agency.Question_PROOF_PROPOSE_WAITS, agency.Protocol_PRESENT_PROOF},
+	"proof_verify":  {agency.Question_PROOF_VERIFY_WAITS, agency.Protocol_PRESENT_PROOF},
+}
+
+func (qs *Question) question(connID string) (q *agency.Question, err error) {
+	name := qs.Type
+	if name == "" {
+		name = "proof_verify"
+	}
+	qt, ok := questionTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown question type (%s)", qs.Type)
+	}
+	q = &agency.Question{
+		TypeID: qt.typeID,
+		Status: &agency.AgentStatus{
+			ClientID: &agency.ClientID{ID: "sim"},
+			Notification: &agency.Notification{
+				ID:           "sim-question",
+				ConnectionID: connID,
+				ProtocolType: qt.protocol,
+			},
+		},
+	}
+	switch qt.typeID {
+	case agency.Question_ISSUE_PROPOSE_WAITS:
+		values := make([]map[string]string, 0, len(qs.Attrs))
+		for _, a := range qs.Attrs {
+			values = append(values, map[string]string{"name": a.Name, "value": a.Value})
+		}
+		data, _ := json.Marshal(values) // map of strings cannot fail
+		q.Question = &agency.Question_IssuePropose{
+			IssuePropose: &agency.Question_IssueProposeMsg{
+				CredDefID:  qs.CredDefID,
+				ValuesJSON: string(data),
+			},
+		}
+	case agency.Question_PROOF_PROPOSE_WAITS, agency.Question_PROOF_VERIFY_WAITS:
+		attrs := make([]*agency.Question_ProofVerifyMsg_Attribute, 0, len(qs.Attrs))
+		for _, a := range qs.Attrs {
+			attrs = append(attrs, &agency.Question_ProofVerifyMsg_Attribute{
+				Name:      a.Name,
+				Value:     a.Value,
+				CredDefID: a.CredDefID,
+			})
+		}
+		q.Question = &agency.Question_ProofVerify{
+			ProofVerify: &agency.Question_ProofVerifyMsg{Attributes: attrs},
+		}
+	}
+	return q, nil
+}
+
+// check returns the failed expectations.
+func (e *Expect) check(where string, s *Simulator, out Output) (failures []string) {
+	fail := func(format string, a ...any) {
+		failures = append(failures, where+": "+fmt.Sprintf(format, a...))
+	}
+	if e.State != "" && e.State != s.Machine.Current {
+		fail("state: got %s, want %s", s.Machine.Current, e.State)
+	}
+	if e.checkSends {
+		if msg := checkSends(e.Sends, out.Sends); msg != "" {
+			fail("sends: %s", msg)
+		}
+	}
+	if e.BackendState != "" {
+		if s.Backend == nil {
+			fail("backend_state: scenario doesn't have backend")
+		} else if e.BackendState != s.Backend.Current {
+			fail("backend_state: got %s, want %s", s.Backend.Current,
+				e.BackendState)
+		}
+	}
+	if e.checkBackendSends {
+		if msg := checkSends(e.BackendSends, out.BackendSends); msg != "" {
+			fail("backend_sends: %s", msg)
+		}
+	}
+	for k, want := range e.Memory {
+		if got := s.Machine.Memory[k]; got != want {
+			fail("memory[%s]: got %q, want %q", k, got, want)
+		}
+	}
+	if e.Terminated && !out.Terminated {
+		fail("machine didn't terminate")
+	}
+	return failures
+}
+
+func checkSends(want []ExpectedSend, got []Send) string {
+	if len(want) != len(got) {
+		return fmt.Sprintf("got %d %v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		w, g := want[i], got[i]
+		ok := w.Protocol == g.Protocol && (w.To == "" || w.To == g.To)
+		if w.Match != "" {
+			re, err := regexp.Compile(w.Match)
+			if err != nil {
+				return fmt.Sprintf("[%d]: %v", i, err)
+			}
+			ok = ok && re.MatchString(g.Data)
+		} else {
+			ok = ok && w.Data == g.Data
+		}
+		if !ok {
+			return fmt.Sprintf("[%d]: got %v, want %v", i, g, w.Send)
+		}
+	}
+	return ""
+}
+
+// Test runs the scenario files matching the glob pattern as subtests, e.g.
+//
+//	func TestScenarios(t *testing.T) {
+//		sim.Test(t, "testdata/*.sim.yaml")
+//	}
+func Test(t *testing.T, pattern string) {
+	t.Helper()
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no scenario files: %s", pattern)
+	}
+	for _, fName := range files {
+		fName := fName
+		t.Run(filepath.Base(fName), func(t *testing.T) {
+			sc, err := LoadScenario(fName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sc.Run(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
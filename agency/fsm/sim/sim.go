@@ -0,0 +1,465 @@
+// Package sim runs FSM conversations offline without an agency. Simulator
+// drives the conversation machine, and the optional backend machine, in the
+// same way as the chat package does, but the inputs are given by the caller
+// and the sends are recorded instead of sending them. Scenario files describe
+// the inputs and the expected results in YAML, and they can be run with the
+// Test helper from go test, or with the fsmsim tool.
+package sim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/findy-network/findy-common-go/agency/fsm"
+	"github.com/findy-network/findy-common-go/crypto/db"
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/golang/glog"
+	"github.com/lainio/err2"
+	"github.com/lainio/err2/try"
+)
+
+// DefaultConnID is the connection ID of the simulated conversation if it isn't
+// given.
+const DefaultConnID = "sim-connection-id"
+
+// maxInternalEvents limits the internal events, i.e. transient steps, timers
+// and backend messages, processed for one input. It stops the machines which
+// loop forever.
+const maxInternalEvents = 1000
+
+var errTooManyEvents = errors.New("too many internal events, is machine looping?")
+
+// Send is the recorded send of the machine. Transient sends aren't recorded
+// because they are internal to the machine. The fields are the protocol and
+// its main data:
+//
+//	basic_message: content
+//	issue_cred: attributes JSON
+//	present_proof: proof JSON, or attributes and predicates as JSON
+//	email: body, and To is the recipient
+//	hook: hook data as JSON
+//	backend: content
+//	answer: ACK or NACK
+//	connection: invitation JSON
+//	trust_ping: nothing
+type Send struct {
+	Protocol string `json:"protocol"`
+	To       string `json:"to,omitempty"`
+	Data     string `json:"data,omitempty"`
+}
+
+func (s Send) String() string {
+	if s.To != "" {
+		return fmt.Sprintf("%s(%s){%q}", s.Protocol, s.To, s.Data)
+	}
+	return fmt.Sprintf("%s{%q}", s.Protocol, s.Data)
+}
+
+// Output is the result of the single input of the Simulator.
+type Output struct {
+	// Sends are the sends of the conversation machine in the sending order.
+	Sends []Send
+	// BackendSends are the sends of the backend machine.
+	BackendSends []Send
+	// Terminated tells if the conversation machine reached a terminate state.
+	Terminated bool
+}
+
+// Simulator runs the conversation machine and the optional backend machine.
+// It isn't thread-safe.
+type Simulator struct {
+	Machine *fsm.Machine
+	Backend *fsm.Machine
+
+	// Router routes the backend data like the chat multiplexer does. The
+	// simulated conversation receives the data routed to its ConnID. It
+	// shares the rooms with the backend machine.
+	Router *fsm.Router
+
+	// Clock is the time of the machines' timers, see Wait.
+	Clock *fsm.ManualClock
+
+	// ConnID is the connection ID of the conversation.
+	ConnID string
+
+	// MailErr is returned for the email sends when it's set, i.e. the email
+	// triggers can be tested with it.
+	MailErr error
+
+	// invitations is the count of the created invitations, see Invite.
+	invitations int
+
+	termChan         fsm.TerminateChan
+	timerChan        fsm.TimerChan
+	backendTimerChan fsm.TimerChan
+
+	out             *Output
+	pending         []func()
+	emailErr        error
+	backendEmailErr error
+}
+
+// New creates a new Simulator for the machines. The backend machine is
+// optional. The machines have their own in-memory DB registers, and their
+// coverage is tracked, see fsm.Machine.Coverage.
+func New(conversation fsm.MachineData, backend *fsm.MachineData, connID string) (s *Simulator, err error) {
+	defer err2.Handle(&err, "simulator")
+
+	if connID == "" {
+		connID = DefaultConnID
+	}
+	h := db.NewMemDB([][]byte{fsm.RegisterBucket, fsm.RoomBucket})
+	s = &Simulator{
+		Clock:     fsm.NewManualClock(),
+		ConnID:    connID,
+		termChan:  make(fsm.TerminateChan, maxInternalEvents),
+		timerChan: make(fsm.TimerChan, maxInternalEvents),
+	}
+	s.Machine = fsm.NewMachine(conversation)
+	try.To(s.Machine.Initialize())
+	s.Machine.ConnID = connID
+	s.Machine.DB = fsm.NewDBRegister(h, nil, "conversation")
+	s.Machine.Clock = s.Clock
+	s.Machine.InitLua()
+	s.Machine.SetTimerChan(s.timerChan)
+	s.Machine.Inviter = s
+	s.Machine.EnableCoverage()
+
+	if backend.IsValid() {
+		s.backendTimerChan = make(fsm.TimerChan, maxInternalEvents)
+		s.Backend = fsm.NewBackendMachine(*backend)
+		try.To(s.Backend.Initialize())
+		s.Backend.DB = fsm.NewDBRegister(h, nil, "backend")
+		s.Backend.Rooms = try.To1(fsm.NewRooms(h, nil, "backend"))
+		s.Router = fsm.NewRouter(s.Backend.Rooms)
+		s.Backend.Clock = s.Clock
+		s.Backend.InitLua()
+		s.Backend.SetTimerChan(s.backendTimerChan)
+		s.Backend.Inviter = s
+		s.Backend.EnableCoverage()
+	} else {
+		s.Router = fsm.NewRouter(nil)
+	}
+	return s, nil
+}
+
+// Start starts the machines. The backend machine is started first like in
+// the chat package.
+func (s *Simulator) Start() (Output, error) {
+	return s.run(func() {
+		if s.Backend != nil {
+			s.backendSend(s.Backend.Start(nil))
+		}
+		s.send(s.Machine.Start(fsm.TerminateOutChan(s.termChan)))
+	})
+}
+
+// Message simulates the basic message from the other end of the connection.
+func (s *Simulator) Message(content string) (Output, error) {
+	status := &agency.ProtocolStatus{
+		State: &agency.ProtocolState{
+			ProtocolID: &agency.ProtocolID{
+				TypeID: agency.Protocol_BASIC_MESSAGE,
+				Role:   agency.Protocol_ADDRESSEE,
+			},
+			State: agency.ProtocolState_OK,
+		},
+		Status: &agency.ProtocolStatus_BasicMessage{
+			BasicMessage: &agency.ProtocolStatus_BasicMessageStatus{
+				Content: content,
+			},
+		},
+	}
+	return s.Status(status)
+}
+
+// Status simulates the protocol status update. Like the chat package, the
+// machine steps only by the completed protocols.
+func (s *Simulator) Status(status *agency.ProtocolStatus) (Output, error) {
+	return s.run(func() {
+		transition := s.Machine.Triggers(status)
+		if transition == nil {
+			glog.V(1).Infoln("sim: no transition for status in", s.Machine.Current)
+			return
+		}
+		if status.GetState().State != agency.ProtocolState_OK {
+			return
+		}
+		s.send(transition.BuildSendEvents(status))
+		s.send(s.Machine.Step(transition))
+	})
+}
+
+// Question simulates the question of the agency, e.g. proof values waiting
+// for the verification.
+func (s *Simulator) Question(q *agency.Question) (Output, error) {
+	return s.run(func() {
+		if transition := s.Machine.Answers(q); transition != nil {
+			s.send(transition.BuildSendAnswers(q.Status))
+			s.send(s.Machine.Step(transition))
+		}
+	})
+}
+
+// Hook simulates the hook call.
+func (s *Simulator) Hook(data map[string]string) (Output, error) {
+	return s.run(func() {
+		if transition := s.Machine.TriggersByHook(); transition != nil {
+			s.send(transition.BuildSendEventsFromHook(data))
+			s.send(s.Machine.Step(transition))
+		}
+	})
+}
+
+// BackendData simulates the data from the backend to the conversation
+// machine. It can be used without the backend machine.
+func (s *Simulator) BackendData(data *fsm.BackendData) (Output, error) {
+	return s.run(func() {
+		s.backendReceived(data)
+	})
+}
+
+// Wait advances the clock of the machines, and the expired timers trigger.
+func (s *Simulator) Wait(d time.Duration) (Output, error) {
+	return s.run(func() {
+		s.Clock.Advance(d)
+	})
+}
+
+func (s *Simulator) run(f func()) (out Output, err error) {
+	defer err2.Handle(&err)
+
+	s.out = &out
+	s.pending = nil
+	defer func() { s.out = nil }()
+
+	f()
+	s.emailFailed()
+	s.backendEmailFailed()
+	for count := 0; ; count++ {
+		if count > maxInternalEvents {
+			return out, errTooManyEvents
+		}
+		if !s.drainTimers() && len(s.pending) == 0 {
+			break
+		}
+		if len(s.pending) > 0 {
+			next := s.pending[0]
+			s.pending = s.pending[1:]
+			next()
+			s.emailFailed()
+			s.backendEmailFailed()
+		}
+	}
+	for {
+		select {
+		case <-s.termChan:
+			out.Terminated = true
+		default:
+			return out, nil
+		}
+	}
+}
+
+// drainTimers moves the expired timers to the pending events. It returns true
+// if there was any.
+func (s *Simulator) drainTimers() (found bool) {
+	for {
+		select {
+		case td := <-s.timerChan:
+			s.pending = append(s.pending, func() {
+				if transition := s.Machine.TriggersByTimer(td); transition != nil {
+					s.send(transition.BuildSendEventsFromTimer())
+					s.send(s.Machine.Step(transition))
+				}
+			})
+			found = true
+		case td := <-s.backendTimerChan: // nil channel without backend
+			s.pending = append(s.pending, func() {
+				if transition := s.Backend.TriggersByTimer(td); transition != nil {
+					s.backendSend(transition.BuildSendEventsFromTimer())
+					s.backendSend(s.Backend.Step(transition))
+				}
+			})
+			found = true
+		default:
+			return found
+		}
+	}
+}
+
+// routed updates the router and tells if the backend data is routed to the
+// simulated conversation.
+func (s *Simulator) routed(data *fsm.BackendData) bool {
+	if s.Router.Update(data) {
+		return false
+	}
+	connIDs, all := s.Router.Receivers(data)
+	return all || slices.Contains(connIDs, s.ConnID)
+}
+
+// backendReceived filters the backend data like the chat package does.
+func (s *Simulator) backendReceived(data *fsm.BackendData) {
+	if data.ConnID == "" {
+		data.ConnID = s.ConnID
+	}
+	sessionID, ok := s.Machine.Memory[fsm.LUA_SESSION_ID]
+	if ok && sessionID != data.SessionID {
+		return
+	} else if data.NoEcho && s.ConnID == data.ConnID {
+		return
+	}
+	if transition := s.Machine.TriggersByBackendData(data); transition != nil {
+		s.send(transition.BuildSendEventsFromBackendData(data))
+		s.send(s.Machine.Step(transition))
+	}
+}
+
+func (s *Simulator) send(sends []*fsm.Event) {
+	for _, e := range sends {
+		switch e.ProtocolType {
+		case fsm.TransientProtocol:
+			content := e.BasicMessage.Content
+			s.pending = append(s.pending, func() {
+				if transition := s.Machine.TriggersByStep(); transition != nil {
+					s.send(transition.BuildSendEventsFromStep(content))
+					s.send(s.Machine.Step(transition))
+				}
+			})
+			continue
+		case fsm.BackendProtocol:
+			data := *e.Backend // events are reused, take a copy
+			if data.ConnID == "" {
+				data.ConnID = s.ConnID
+			}
+			if data.Service != "" {
+				glog.Warningln("simulator has only the default backend, not:",
+					data.Service)
+			} else if s.Backend != nil {
+				s.pending = append(s.pending, func() {
+					s.Router.Update(&data)
+					if transition := s.Backend.TriggersByBackendData(&data); transition != nil {
+						s.backendSend(transition.BuildSendEventsFromBackendData(&data))
+						s.backendSend(s.Backend.Step(transition))
+					}
+				})
+			}
+		case fsm.EmailProtocol:
+			if s.MailErr != nil {
+				s.emailErr = s.MailErr
+			}
+		}
+		s.out.Sends = append(s.out.Sends, record(e))
+	}
+}
+
+func (s *Simulator) backendSend(sends []*fsm.Event) {
+	for _, e := range sends {
+		switch e.ProtocolType {
+		case fsm.TransientProtocol:
+			content := e.BasicMessage.Content
+			s.pending = append(s.pending, func() {
+				if transition := s.Backend.TriggersByStep(); transition != nil {
+					s.backendSend(transition.BuildSendEventsFromStep(content))
+					s.backendSend(s.Backend.Step(transition))
+				}
+			})
+			continue
+		case fsm.BackendProtocol:
+			data := *e.Backend
+			if s.routed(&data) {
+				s.pending = append(s.pending, func() {
+					s.backendReceived(&data)
+				})
+			}
+		case fsm.EmailProtocol:
+			if s.MailErr != nil {
+				s.backendEmailErr = s.MailErr
+			}
+		}
+		s.out.BackendSends = append(s.out.BackendSends, record(e))
+	}
+}
+
+// Invite creates the invitations of the connection sends. They are numbered
+// that the results are the same in every run:
+//
+//	{"@id":"sim-invitation-1","label":"<label>"}
+//	didcomm://sim-invitation-1
+func (s *Simulator) Invite(label string) (*fsm.Invitation, error) {
+	s.invitations++
+	id := fmt.Sprintf("sim-invitation-%d", s.invitations)
+	data, _ := json.Marshal(map[string]string{"@id": id, "label": label})
+	return &fsm.Invitation{JSON: string(data), URL: "didcomm://" + id}, nil
+}
+
+// emailFailed routes the email error to the machine after the event like the
+// chat package does.
+func (s *Simulator) emailFailed() {
+	err := s.emailErr
+	if err == nil {
+		return
+	}
+	s.emailErr = nil
+	if transition := s.Machine.TriggersByEmailError(err); transition != nil {
+		s.send(transition.BuildSendEventsFromEmailError(err))
+		s.send(s.Machine.Step(transition))
+	}
+}
+
+// backendEmailFailed routes the email error to the backend machine.
+func (s *Simulator) backendEmailFailed() {
+	err := s.backendEmailErr
+	if err == nil {
+		return
+	}
+	s.backendEmailErr = nil
+	if transition := s.Backend.TriggersByEmailError(err); transition != nil {
+		s.backendSend(transition.BuildSendEventsFromEmailError(err))
+		s.backendSend(s.Backend.Step(transition))
+	}
+}
+
+func record(e *fsm.Event) Send {
+	send := Send{Protocol: e.Protocol}
+	if e.ProtocolType == fsm.QAProtocol {
+		send.Data = e.Data
+		return send
+	}
+	if e.EventData == nil {
+		return send
+	}
+	switch {
+	case e.BasicMessage != nil:
+		send.Data = e.BasicMessage.Content
+	case e.Issuing != nil:
+		send.Data = e.Issuing.AttrsJSON
+		if e.Issuing.IsStructured() {
+			data, _ := json.Marshal(e.Issuing.Attributes)
+			send.Data = string(data)
+		}
+	case e.Proof != nil:
+		send.Data = e.Proof.ProofJSON
+		if e.Proof.IsStructured() {
+			data, _ := json.Marshal(struct {
+				Attributes []fsm.ProofAttr      `json:"attributes,omitempty"`
+				Predicates []fsm.ProofPredicate `json:"predicates,omitempty"`
+			}{e.Proof.Attributes, e.Proof.Predicates})
+			send.Data = string(data)
+		}
+	case e.Email != nil:
+		send.To = e.Email.To
+		send.Data = e.Email.Body
+	case e.Hook != nil:
+		data, _ := json.Marshal(e.Hook.Data) // map of strings cannot fail
+		send.Data = string(data)
+	case e.Backend != nil:
+		send.Data = e.Backend.Content
+	case e.Invitation != nil:
+		send.Data = e.Invitation.JSON
+	}
+	return send
+}
@@ -0,0 +1,66 @@
+package sim
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/findy-network/findy-common-go/agency/fsm"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestScenarios(t *testing.T) {
+	Test(t, "testdata/*.sim.yaml")
+}
+
+func TestScenario_Failures(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	sc := try.To1(LoadScenario("testdata/email.sim.yaml"))
+	sc.Steps[0].Expect.State = "DONE"
+	sc.Steps[2].Expect.Memory = map[string]string{"EMAIL": "other@example.com"}
+	err := sc.Run()
+	assert.Error(err)
+	msgs := strings.Split(err.Error(), "\n")
+	assert.SLen(msgs, 2)
+	assert.That(strings.Contains(msgs[0], "steps[0]: state: got WAITING_EMAIL, want DONE"), msgs[0])
+	assert.That(strings.Contains(msgs[1], "steps[2]: memory[EMAIL]"), msgs[1])
+}
+
+func TestSimulator(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	data := fsm.MachineData{FType: "testdata/bot.yaml",
+		Data: try.To1(os.ReadFile("testdata/bot.yaml"))}
+	s := try.To1(New(data, nil, ""))
+	out := try.To1(s.Start())
+	assert.SLen(out.Sends, 1)
+	assert.Equal(out.Sends[0], Send{Protocol: "basic_message", Data: "Welcome!"})
+
+	// backend sends are recorded without backend machine too
+	out = try.To1(s.Message("hi"))
+	assert.DeepEqual(out.Sends, []Send{{Protocol: "backend", Data: "hi"}})
+	assert.SLen(out.BackendSends, 0)
+	assert.Equal(s.Machine.Current, "IDLE")
+}
+
+func TestReports(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	var scenarios []*Scenario
+	for _, fName := range []string{"testdata/email.sim.yaml", "testdata/backend.sim.yaml"} {
+		sc := try.To1(LoadScenario(fName))
+		try.To(sc.Run())
+		assert.INotNil(sc.Coverage)
+		scenarios = append(scenarios, sc)
+	}
+	reports := try.To1(Reports(scenarios...))
+	assert.SLen(reports, 2)
+	assert.Equal(reports[0].Machine.Name, "sim bot")
+	assert.Equal(reports[1].Machine.Name, "echo backend")
+	report := reports[1].Machine.CoverageReport(reports[1].Coverage)
+	assert.That(report.Full(), report.String())
+	report = reports[0].Machine.CoverageReport(reports[0].Coverage)
+	assert.That(!report.Full())
+}
@@ -0,0 +1,60 @@
+package fsm
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// Snapshot is the runtime state of the machine that must survive process
+// restarts. The machine definition itself is not included because it's always
+// loaded from the FSM file.
+type Snapshot struct {
+	ConnID  string            `json:"conn_id,omitempty"`
+	Current string            `json:"current"`
+	Memory  map[string]string `json:"memory,omitempty"`
+
+	// LastProtocolIDs are IDs of the protocols we have started but which
+	// status updates we are still waiting. The machine doesn't know these, the
+	// runner of the machine fills them, e.g. chat.Conversation.
+	LastProtocolIDs []string `json:"last_protocol_ids,omitempty"`
+}
+
+// Snapshot returns a copy of the machine's current runtime state.
+func (m *Machine) Snapshot() *Snapshot {
+	mem := make(map[string]string, len(m.Memory))
+	for k, v := range m.Memory {
+		mem[k] = v
+	}
+	return &Snapshot{
+		ConnID:  m.ConnID,
+		Current: m.Current,
+		Memory:  mem,
+	}
+}
+
+// Resume is the counterpart of the Start for the machines which are restored
+// from the Snapshot. It moves the machine to the snapshot's state and restores
+// the memory, but it doesn't execute initial sends. The machine must be
+// initialized before the call.
+func (m *Machine) Resume(termChan TerminateOutChan, s *Snapshot) (err error) {
+	if !m.Initialized {
+		return fmt.Errorf("resume: machine (%s) isn't initialized", m.Name)
+	}
+	if m.State(s.Current) == nil {
+		return fmt.Errorf("resume: machine (%s) doesn't have state: %s",
+			m.Name, s.Current)
+	}
+	m.termChan = termChan
+	m.Current = s.Current
+	m.Memory = make(map[string]string, len(s.Memory))
+	for k, v := range s.Memory {
+		m.Memory[k] = v
+	}
+	if s.ConnID != "" {
+		m.ConnID = s.ConnID
+	}
+	m.armTimers()
+	glog.V(1).Infof("machine (%s) resumed to state: %s", m.Name, m.Current)
+	return nil
+}
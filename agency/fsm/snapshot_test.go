@@ -0,0 +1,51 @@
+package fsm
+
+import (
+	"testing"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestMachine_SnapshotAndResume(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "valid.yaml", Data: []byte(validMachineYAML)})
+	try.To(m.Initialize())
+	m.ConnID = "TEST_CONN_ID"
+	m.Start(nil)
+
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE, "me@example.com")
+	transition := m.Triggers(status)
+	assert.NotNil(transition)
+	transition.BuildSendEvents(status)
+	m.Step(transition)
+	assert.Equal(m.Current, "WAITING_PIN")
+
+	s := m.Snapshot()
+	assert.Equal(s.Current, "WAITING_PIN")
+	assert.Equal(s.ConnID, "TEST_CONN_ID")
+	assert.Equal(s.Memory["EMAIL"], "me@example.com")
+	pin := s.Memory["PIN"]
+	assert.NotEmpty(pin)
+
+	// snapshot is a copy
+	m.Memory["EMAIL"] = "changed"
+	assert.Equal(s.Memory["EMAIL"], "me@example.com")
+
+	restored := NewMachine(MachineData{FType: "valid.yaml", Data: []byte(validMachineYAML)})
+	assert.Error(restored.Resume(nil, s), "must be initialized first")
+	try.To(restored.Initialize())
+	try.To(restored.Resume(nil, s))
+	assert.Equal(restored.Current, "WAITING_PIN")
+	assert.Equal(restored.ConnID, "TEST_CONN_ID")
+	assert.Equal(restored.Memory["PIN"], pin)
+
+	transition = restored.Triggers(protocolStatus(agency.Protocol_BASIC_MESSAGE, pin))
+	assert.NotNil(transition)
+	assert.Equal(transition.Target, "DONE")
+
+	s.Current = "NO_SUCH_STATE"
+	assert.Error(restored.Resume(nil, s))
+}
@@ -0,0 +1,96 @@
+package fsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/findy-network/findy-common-go/x"
+)
+
+type templateMap = map[string]*template.Template
+
+// templates caches the parsed templates by their text. The cache is shared by
+// all the machines of the process because conversations of the same bot use
+// the same templates. Parsed templates are safe for concurrent use.
+var templates = x.NewRWMap[templateMap]()
+
+// TemplateFuncs are the functions available in FORMAT_MEM and GEN_PIN
+// templates in addition to the text/template's own functions:
+//
+//	upper, lower, trim: strings.ToUpper, ToLower and TrimSpace
+//	default DEF VALUE: DEF if VALUE is empty, e.g. {{default "N/A" .EMAIL}}
+//	json VALUE: VALUE as a JSON literal including the quotes
+//	escapeJSON VALUE: VALUE escaped to be used inside a JSON string
+//	now [LAYOUT]: current UTC time, the default layout is RFC3339
+var TemplateFuncs = template.FuncMap{
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"trim":       strings.TrimSpace,
+	"default":    tmplDefault,
+	"json":       tmplJSON,
+	"escapeJSON": tmplEscapeJSON,
+	"now":        tmplNow,
+}
+
+// parseTemplate returns the parsed template from the cache or parses it.
+func parseTemplate(text string) (tmpl *template.Template, err error) {
+	tmpl = templates.Get(text)
+	if tmpl != nil {
+		return tmpl, nil
+	}
+	tmpl, err = template.New("template").Funcs(TemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	return templates.Set(text, tmpl), nil
+}
+
+// initTemplates parses the templates of the machine that errors are found
+// when the machine is loaded and not during the conversation.
+func (m *Machine) initTemplates() error {
+	for _, e := range m.allEvents() {
+		if !usesTemplate(e) {
+			continue
+		}
+		if _, err := parseTemplate(e.Data); err != nil {
+			return fmt.Errorf("%s send (%.32s): %w", e.Protocol,
+				removeLF(e.Data), err)
+		}
+	}
+	return nil
+}
+
+func usesTemplate(e *Event) bool {
+	return e.Rule == TriggerTypeFormatFromMem || e.Rule == TriggerTypePIN
+}
+
+func tmplDefault(def string, value any) any {
+	if value == nil {
+		return def
+	}
+	if s, ok := value.(string); ok && s == "" {
+		return def
+	}
+	return value
+}
+
+func tmplJSON(value any) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+func tmplEscapeJSON(s string) string {
+	data, _ := json.Marshal(s) // marshaling a string cannot fail
+	return string(data[1 : len(data)-1])
+}
+
+func tmplNow(layout ...string) string {
+	l := time.RFC3339
+	if len(layout) > 0 {
+		l = layout[0]
+	}
+	return time.Now().UTC().Format(l)
+}
@@ -0,0 +1,67 @@
+package fsm
+
+import (
+	"testing"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+func TestFmtFromMem(t *testing.T) {
+	tests := []struct {
+		name string
+		tmpl string
+		want string
+	}{
+		{"upper lower trim", `{{upper .NAME}} {{lower .NAME}} "{{trim .SPACES}}"`,
+			`ALICE alice "in the middle"`},
+		{"default", `{{default "N/A" .EMPTY}} {{default "N/A" .NAME}} {{default "N/A" .MISSING}}`,
+			`N/A Alice N/A`},
+		{"json", `{"name":{{json .QUOTED}}}`, `{"name":"say \"hi\"\\"}`},
+		{"escapeJSON", `{"name":"{{escapeJSON .QUOTED}}"}`, `{"name":"say \"hi\"\\"}`},
+		{"now", `{{now "2006"}}`, tmplNow("2006")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer assert.PushTester(t)()
+
+			m := &Machine{
+				Initial: &Transition{Target: "IDLE"},
+				States: map[string]*State{"IDLE": {Transitions: []*Transition{{
+					Trigger: &Event{Protocol: MessageBasicMessage},
+					Sends: []*Event{{
+						Protocol: MessageBasicMessage,
+						Rule:     TriggerTypeFormatFromMem,
+						Data:     tt.tmpl,
+					}},
+					Target: "IDLE",
+				}}}},
+			}
+			try.To(m.Initialize())
+			m.Memory["NAME"] = "Alice"
+			m.Memory["EMPTY"] = ""
+			m.Memory["SPACES"] = "  in the middle\n"
+			m.Memory["QUOTED"] = `say "hi"\`
+			status := protocolStatus(agency.Protocol_BASIC_MESSAGE)
+			sends := m.Triggers(status).BuildSendEvents(status)
+			assert.SLen(sends, 1)
+			assert.Equal(sends[0].BasicMessage.Content, tt.want)
+		})
+	}
+}
+
+func TestTemplateParsedOnce(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const text = `{{upper .NAME}}`
+	tmpl := try.To1(parseTemplate(text))
+	assert.Equal(try.To1(parseTemplate(text)), tmpl)
+
+	m := NewMachine(MachineData{FType: "bad.json", Data: []byte(`{
+"initial":{"target":"IDLE"},
+"states":{"IDLE":{"transitions":[{"trigger":{"protocol":"basic_message"},
+  "sends":[{"protocol":"basic_message","rule":"FORMAT_MEM","data":"{{.NAME"}],
+  "target":"IDLE"}]}}}`)})
+	assert.Error(m.Initialize())
+}
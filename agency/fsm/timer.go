@@ -0,0 +1,77 @@
+package fsm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// TimerData is sent thru the timer channel when a timer of the state expires.
+// The runner of the machine gives it back to the Machine.TriggersByTimer.
+type TimerData struct {
+	// Seq is used to detect timers which were already cancelled by the state
+	// change but which had fired before that.
+	Seq        int
+	Transition *Transition
+}
+
+type TimerChan = chan *TimerData
+type TimerInChan = <-chan *TimerData
+type TimerOutChan = chan<- *TimerData
+
+func parseTimerDuration(data string) (d time.Duration, err error) {
+	d, err = time.ParseDuration(data)
+	if err != nil {
+		return 0, fmt.Errorf("timer: bad duration (%s): %w", data, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timer: duration must be positive: %s", data)
+	}
+	return d, nil
+}
+
+// SetTimerChan sets the channel where the expired timers are signaled. Timers
+// aren't armed at all if the channel isn't set. Call it before Start.
+func (m *Machine) SetTimerChan(timerChan TimerOutChan) {
+	m.timerChan = timerChan
+}
+
+func (m *Machine) clock() Clock {
+	if m.Clock == nil {
+		return realClock{}
+	}
+	return m.Clock
+}
+
+// armTimers cancels previous timers and arms the timer transitions of the
+// current state and the global ones. It's called every time when the machine
+// steps, which means that staying in the same state, e.g. by a self
+// transition, restarts the timers.
+func (m *Machine) armTimers() {
+	m.stopTimers()
+	if m.timerChan == nil {
+		return
+	}
+	timerChan := m.timerChan
+	for _, transition := range m.transitions() {
+		if transition.Trigger.ProtocolType != TimerProtocol {
+			continue
+		}
+		td := &TimerData{Seq: m.timerSeq, Transition: transition}
+		glog.V(3).Infof("arming timer (%v) in state %s",
+			transition.Trigger.duration, m.Current)
+		m.timers = append(m.timers,
+			m.clock().AfterFunc(transition.Trigger.duration, func() {
+				timerChan <- td
+			}))
+	}
+}
+
+func (m *Machine) stopTimers() {
+	for _, t := range m.timers {
+		t.Stop()
+	}
+	m.timers = nil
+	m.timerSeq++
+}
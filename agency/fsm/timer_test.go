@@ -0,0 +1,129 @@
+package fsm
+
+import (
+	"testing"
+	"time"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const timerMachineYAML = `
+name: timer machine
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+      sends:
+      - protocol: basic_message
+        data: Please answer in 10 minutes.
+      target: WAITING_ANSWER
+  WAITING_ANSWER:
+    transitions:
+    - trigger:
+        protocol: timer
+        data: 5m
+      sends:
+      - protocol: basic_message
+        data: Are you still there?
+      target: WAITING_ANSWER_AGAIN
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_SAVE
+        data: ANSWER
+      target: WAITING_ANSWER
+  WAITING_ANSWER_AGAIN:
+    transitions:
+    - trigger:
+        protocol: timer
+        data: 5m
+      sends:
+      - protocol: basic_message
+        data: Going back to beginning.
+      target: IDLE
+    - trigger:
+        protocol: basic_message
+      target: IDLE
+`
+
+func TestMachine_TimerTriggers(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	clock := NewManualClock()
+	timerChan := make(TimerChan, 4)
+	m := NewMachine(MachineData{FType: "timer.yaml", Data: []byte(timerMachineYAML)})
+	assert.SLen(m.Validate(), 0)
+	try.To(m.Initialize())
+	m.Clock = clock
+	m.SetTimerChan(timerChan)
+	m.Start(nil)
+	assert.Equal(clock.Pending(), 0)
+
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE)
+	m.Step(m.Triggers(status))
+	assert.Equal(m.Current, "WAITING_ANSWER")
+	assert.Equal(clock.Pending(), 1)
+
+	// answering restarts the timer
+	clock.Advance(4 * time.Minute)
+	assert.CLen(timerChan, 0)
+	m.Step(m.Triggers(status))
+	assert.Equal(m.Current, "WAITING_ANSWER")
+	assert.Equal(clock.Pending(), 1)
+	clock.Advance(4 * time.Minute)
+	assert.CLen(timerChan, 0)
+
+	clock.Advance(time.Minute)
+	assert.CLen(timerChan, 1)
+	td := <-timerChan
+	transition := m.TriggersByTimer(td)
+	assert.NotNil(transition)
+	sends := transition.BuildSendEventsFromTimer()
+	assert.SLen(sends, 1)
+	assert.Equal(sends[0].BasicMessage.Content, "Are you still there?")
+	m.Step(transition)
+	assert.Equal(m.Current, "WAITING_ANSWER_AGAIN")
+
+	// leaving the state cancels the timer
+	m.Step(m.Triggers(status))
+	assert.Equal(m.Current, "IDLE")
+	assert.Equal(clock.Pending(), 0)
+	clock.Advance(time.Hour)
+	assert.CLen(timerChan, 0)
+}
+
+func TestMachine_TimerCancelledAfterFire(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	clock := NewManualClock()
+	timerChan := make(TimerChan, 4)
+	m := NewMachine(MachineData{FType: "timer.yaml", Data: []byte(timerMachineYAML)})
+	try.To(m.Initialize())
+	m.Clock = clock
+	m.SetTimerChan(timerChan)
+	m.Start(nil)
+
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE)
+	m.Step(m.Triggers(status))
+	clock.Advance(5 * time.Minute)
+	assert.CLen(timerChan, 1)
+
+	// machine steps before the timer data is processed
+	m.Step(m.Triggers(status))
+	assert.Nil(m.TriggersByTimer(<-timerChan))
+}
+
+func TestMachine_TimerBadDuration(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "timer.json", Data: []byte(`{
+"initial":{"target":"IDLE"},
+"states":{"IDLE":{"transitions":[
+  {"trigger":{"protocol":"timer","data":"soon"},"target":"IDLE"}]}}}`)})
+	assert.That(m.Validate().HasErrors())
+	assert.Error(m.Initialize())
+}
@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
-	"text/template"
+	"strings"
 
 	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
 	"github.com/golang/glog"
@@ -31,9 +31,9 @@ type Transition struct {
 
 // BuildSendEventsFromBackendData is called from b-fsm and it's combined method
 // to execute two phases. Build input events and then build send event list. The
-// second phase is shared with pw-fsm.
-// TODO: Note that the input RULE handling is minimal and many methods are
-// missing!
+// second phase is shared with pw-fsm. The input rules are the same as with the
+// basic messages: the content of the data is the input, and the save rules
+// store it to the memory.
 func (t *Transition) BuildSendEventsFromBackendData(data *BackendData) []*Event {
 	var (
 		usedProtocol agency.Protocol_Type = BackendProtocol
@@ -71,15 +71,15 @@ func (t *Transition) BuildSendEventsFromBackendData(data *BackendData) []*Event
 	}
 	glog.V(5).Infoln("RULE:", t.Trigger.Rule)
 	switch t.Trigger.Rule {
-	case TriggerTypeValidateInputNotEqual, TriggerTypeValidateInputEqual,
-		TriggerTypeLua, TriggerTypeUseInput, TriggerTypeTransient:
-		// for future use
-
 	case TriggerTypeUseInputSaveSessionID:
 		key := data.ConnID + LUA_SESSION_ID
 		sessionID := data.Content
 		t.Machine.Memory[key] = sessionID
-		eData.Backend.SessionID = sessionID
+		if eData.Backend != nil {
+			eData.Backend.SessionID = sessionID
+		} else {
+			t.Machine.Memory[LUA_SESSION_ID] = sessionID
+		}
 		glog.V(3).Infoln("=== save to machine memory", key, "->", sessionID)
 	case TriggerTypeUseInputSaveConnID:
 		t.Machine.Memory[data.ConnID+t.Trigger.Data] = data.Content
@@ -87,9 +87,6 @@ func (t *Transition) BuildSendEventsFromBackendData(data *BackendData) []*Event
 	case TriggerTypeUseInputSave:
 		t.Machine.Memory[t.Trigger.Data] = data.Content
 		glog.V(3).Infoln("=== save to machine memory", t.Trigger.Data, "->", data.Content)
-
-	case TriggerTypeData, TriggerTypeInputEqual:
-		// for future use
 	}
 	if sendEvent.EventData.Backend != nil {
 		glog.V(3).Infoln("connID:", sendEvent.Backend.ConnID)
@@ -108,6 +105,32 @@ func (t *Transition) BuildSendEventsFromStep(data string) []*Event {
 	return t.doBuildSendEvents(input)
 }
 
+// BuildSendEventsFromEmailError builds send events of the email error
+// transition. The error message is the input.
+func (t *Transition) BuildSendEventsFromEmailError(err error) []*Event {
+	input := &Event{
+		Protocol:     toFileProtocolType[EmailProtocol],
+		ProtocolType: EmailProtocol,
+		Data:         err.Error(),
+		EventData: &EventData{BasicMessage: &BasicMessage{
+			Content: err.Error(),
+		}},
+	}
+	return t.doBuildSendEvents(input)
+}
+
+func (t *Transition) BuildSendEventsFromTimer() []*Event {
+	input := &Event{
+		Protocol:     toFileProtocolType[TimerProtocol],
+		ProtocolType: TimerProtocol,
+		Data:         t.Trigger.Data,
+		EventData: &EventData{BasicMessage: &BasicMessage{
+			Content: t.Trigger.Data,
+		}},
+	}
+	return t.doBuildSendEvents(input)
+}
+
 func (t *Transition) BuildSendEventsFromHook(hookData map[string]string) []*Event {
 	input := &Event{
 		Protocol:     toFileProtocolType[HookProtocol],
@@ -122,27 +145,18 @@ func (t *Transition) BuildSendEvents(status *agency.ProtocolStatus) []*Event {
 	return t.doBuildSendEvents(input)
 }
 
+// doBuildSendEvents builds the sends of the transition. Sends of the unknown
+// protocols are skipped, but Initialize doesn't accept them anyway. Sends whose
+// Lua script fails are skipped too, see luaSendFailed.
 func (t *Transition) doBuildSendEvents(input *Event) []*Event {
 	events := t.Sends
-	sends := make([]*Event, len(events))
-	for i, send := range events {
-		sends[i] = send
+	sends := make([]*Event, 0, len(events))
+	for _, send := range events {
 		switch send.Protocol {
 		case MessageIssueCred:
-			switch send.Rule {
-			case TriggerTypeFormatFromMem:
-				send.EventData = &EventData{Issuing: &Issuing{
-					CredDefID: send.EventData.Issuing.CredDefID,
-					AttrsJSON: t.FmtFromMem(send),
-				}}
-			}
+			t.buildIssuingSend(send)
 		case MessagePresentProof:
-			switch send.Rule {
-			case TriggerTypeData:
-				send.EventData = &EventData{Proof: &Proof{
-					ProofJSON: send.Data,
-				}}
-			}
+			t.buildProofSend(send)
 		case MessageAnswer:
 			glog.V(3).Infoln("building answer") // it's so easy
 		case MessageEmail:
@@ -159,22 +173,36 @@ func (t *Transition) doBuildSendEvents(input *Event) []*Event {
 				send.EventData = &EventData{Email: &email}
 			}
 		case MessageBasicMessage:
-			t.buildBMSend(input, send)
+			if !t.buildBMSend(input, send) {
+				continue
+			}
 		case MessageHook:
 			t.buildHookSend(input, send)
 		case MessageBackend:
-			t.buildBackendSend(input, send)
+			if send.Rule == TriggerTypeRoomForward {
+				sends = append(sends, t.buildRoomForward(input, send)...)
+				continue
+			}
+			if !t.buildBackendSend(input, send) {
+				continue
+			}
 		case MessageTransient:
 			t.buildTransientSend(input, send)
+		case MessageTrustPing:
+			glog.V(3).Infoln("building trust ping") // runner pings the pairwise
+		case MessageConnection:
+			t.buildConnectionSend(send)
 		default:
-			glog.Warningln("didn't find protocol handler", send.Protocol)
-			return nil
+			glog.Errorf("no send handler for protocol \"%s\", skipping",
+				send.Protocol)
+			continue
 		}
+		sends = append(sends, send)
 	}
 	return sends
 }
 
-func (t *Transition) buildBackendSend(input *Event, send *Event) {
+func (t *Transition) buildBackendSend(input *Event, send *Event) bool {
 	var (
 		inputEventSID, sendEventSID, sessionID string
 		eventData                              *EventData
@@ -183,7 +211,7 @@ func (t *Transition) buildBackendSend(input *Event, send *Event) {
 	)
 
 	// NOTE: NoEcho we prefer 1) input Event 2) send Event
-	if input.Backend != nil {
+	if input != nil && input.EventData != nil && input.Backend != nil {
 		inputEventSID = input.Backend.SessionID
 		connID = input.Backend.ConnID
 		noEcho = input.Backend.NoEcho // get 1) from incoming
@@ -196,14 +224,17 @@ func (t *Transition) buildBackendSend(input *Event, send *Event) {
 		}
 	}
 
-	if send != nil && send.EventData != nil && send.Backend != nil {
-		eventData = send.EventData
-		sendEventSID = send.Backend.SessionID
-		if connID == "" && send.Backend.ConnID != "" {
-			connID = send.Backend.ConnID
+	if send != nil && send.backend != nil {
+		backend := *send.backend // keep the machine file's data
+		backend.ConnID = t.fmtAddress(backend.ConnID)
+		backend.Subject = t.fmtAddress(backend.Subject)
+		eventData = &EventData{Backend: &backend}
+		sendEventSID = backend.SessionID
+		if connID == "" && backend.ConnID != "" {
+			connID = backend.ConnID
 			glog.V(1).Infoln("connID from send Event", connID)
 		}
-		glog.V(3).Infoln("send", send.Backend)
+		glog.V(3).Infoln("send", send.backend)
 	} else {
 		eventData = &EventData{Backend: &BackendData{
 			SessionID: sessionID,
@@ -213,7 +244,7 @@ func (t *Transition) buildBackendSend(input *Event, send *Event) {
 		sessionID = sendEventSID
 	}
 	glog.V(5).Infoln("send.Rule:", send.Rule)
-	glog.V(5).Infof("Data: '%v'", t.Trigger.Data)
+	glog.V(5).Infof("Data: '%v'", send.Data)
 
 	// backend machine type is a broker so it MUST NOT overwrite SessionID, but
 	// f-fsm is olways to source of backend events, i.e. it MUST. As it, we
@@ -235,30 +266,26 @@ func (t *Transition) buildBackendSend(input *Event, send *Event) {
 		connID = t.Machine.ConnID
 		glog.V(3).Infoln("connID from machine.ConnID", connID)
 	}
-	assert.NotEmpty(connID)
+	// backend machines can send without connection, e.g. from timers, and
+	// then the data is for all the conversations
+	if t.Machine.Type == MachineTypeConversation {
+		assert.NotEmpty(connID)
+	}
 	switch send.Rule {
 	case TriggerTypeLua:
-		out, _, ok := send.ExecLua(input.Data, LUA_ALL_OK)
-		if ok {
-			content = out
-		} else {
-			content = input.Data
+		out, tgt, ok := send.ExecLua(input.data(), LUA_ALL_OK)
+		if !ok {
+			t.luaSendFailed(tgt)
+			return false
 		}
+		content = out
 	case TriggerTypeData:
 		content = send.Data
 	case TriggerTypeUseInput:
-		dataStr := ""
-		if input.ProtocolType == agency.Protocol_BASIC_MESSAGE {
-			dataStr = input.EventData.BasicMessage.Content
-		} else if input.ProtocolType == BackendProtocol {
-			dataStr = input.EventData.Backend.Content
-		} else {
-			glog.Warningln("+++ build backend send: not BM")
-		}
-		glog.V(2).Infoln("+++ dataStr:", dataStr)
-		content = dataStr
+		content = input.content()
+		glog.V(2).Infoln("+++ dataStr:", content)
 	case TriggerTypeFormat:
-		content = fmt.Sprintf(send.Data, input.Data)
+		content = fmt.Sprintf(send.Data, input.data())
 	case TriggerTypeFormatFromMem:
 		content = t.FmtFromMem(send)
 	default:
@@ -269,10 +296,25 @@ func (t *Transition) buildBackendSend(input *Event, send *Event) {
 	eventData.Backend.Content = content
 	eventData.Backend.SessionID = sessionID
 	eventData.Backend.NoEcho = noEcho
+	eventData.Backend.Route = send.Route
+	eventData.Backend.Service = send.Service
+	if send.Route != RouteConn && eventData.Backend.Subject == "" {
+		eventData.Backend.Subject = t.Machine.Memory[LUA_SUBJECT]
+	}
 
 	glog.V(5).Infoln("--- no_echo:", noEcho)
 
 	send.EventData = eventData
+	return true
+}
+
+// fmtAddress formats the ConnID or the Subject of the backend send if it's a
+// template, e.g. {{.CONN_ID}} addresses the latest sender.
+func (t *Transition) fmtAddress(s string) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	return t.fmtFromMem(s)
 }
 
 func (t *Transition) buildTransientSend(_ *Event, send *Event) {
@@ -296,21 +338,17 @@ func (t *Transition) buildHookSend(input *Event, send *Event) {
 			},
 		}}
 	case TriggerTypeUseInput:
-		dataStr := ""
-		if input.ProtocolType == agency.Protocol_BASIC_MESSAGE {
-			dataStr = input.EventData.BasicMessage.Content
-		}
 		send.EventData = &EventData{Hook: &Hook{
 			Data: map[string]string{
 				"ID":   send.TypeID,
-				"data": dataStr,
+				"data": input.content(),
 			},
 		}}
 	case TriggerTypeFormat:
 		send.EventData = &EventData{Hook: &Hook{
 			Data: map[string]string{
 				"ID":   send.TypeID,
-				"data": fmt.Sprintf(send.Data, input.Data),
+				"data": fmt.Sprintf(send.Data, input.data()),
 			},
 		}}
 	case TriggerTypeFormatFromMem:
@@ -323,38 +361,49 @@ func (t *Transition) buildHookSend(input *Event, send *Event) {
 	}
 }
 
-func (t *Transition) buildBMSend(input *Event, send *Event) {
+func (t *Transition) buildBMSend(input *Event, send *Event) bool {
 	assert.That(input != nil ||
 		send.Rule == TriggerTypeData ||
 		send.Rule == TriggerTypeFormatFromMem,
 	)
 	switch send.Rule {
 	case TriggerTypeUseInput:
-		send.EventData = input.EventData
+		send.EventData = &EventData{BasicMessage: &BasicMessage{
+			Content: input.content(),
+		}}
 	case TriggerTypeData:
 		send.EventData = &EventData{BasicMessage: &BasicMessage{
 			Content: send.Data,
 		}}
 	case TriggerTypeFormat:
 		send.EventData = &EventData{BasicMessage: &BasicMessage{
-			Content: fmt.Sprintf(send.Data, input.Data),
+			Content: fmt.Sprintf(send.Data, input.data()),
 		}}
 	case TriggerTypeFormatFromMem:
 		send.EventData = &EventData{BasicMessage: &BasicMessage{
 			Content: t.FmtFromMem(send),
 		}}
 	case TriggerTypeLua:
-		content := input.Data
-		out, _, ok := send.ExecLua(content, LUA_ALL_OK)
-		if ok {
-			send.EventData = &EventData{BasicMessage: &BasicMessage{
-				Content: out,
-			}}
-		} else {
-			send.EventData = &EventData{BasicMessage: &BasicMessage{
-				Content: content,
-			}}
+		out, tgt, ok := send.ExecLua(input.data(), LUA_ALL_OK)
+		if !ok {
+			t.luaSendFailed(tgt)
+			return false
 		}
+		send.EventData = &EventData{BasicMessage: &BasicMessage{
+			Content: out,
+		}}
+	}
+	return true
+}
+
+// luaSendFailed handles the failed Lua script of the send like the LUA
+// triggers do: ExecLua has stored the error to the ERR register, and if the
+// machine has the error target, the next Step transits there instead of the
+// transition's target.
+func (t *Transition) luaSendFailed(tgt string) {
+	glog.Warningln("lua send failed, skipping it:", t.Machine.Memory[LUA_ERROR])
+	if tgt != "" {
+		t.Machine.luaErrorTarget = tgt
 	}
 }
 
@@ -429,11 +478,18 @@ func (t *Transition) buildInputAnswers(status *agency.AgentStatus) (e *Event) {
 	return e
 }
 
+// FmtFromMem executes the send's template with the machine's memory. The
+// templates are parsed only once, and they can use TemplateFuncs.
 func (t *Transition) FmtFromMem(send *Event) string {
-	defer err2.Catch()
+	return t.fmtFromMem(send.Data)
+}
+
+func (t *Transition) fmtFromMem(data string) string {
+	defer err2.Catch(err2.Err(func(err error) {
+		glog.Errorf("format from mem (%.32s): %v", removeLF(data), err)
+	}))
 
-	// TODO: maybe templates should store that we load them only once? pref.
-	tmpl := template.Must(template.New("template").Parse(send.Data))
+	tmpl := try.To1(parseTemplate(data))
 	var buf bytes.Buffer
 	try.To(tmpl.Execute(&buf, t.Machine.Memory))
 	return buf.String()
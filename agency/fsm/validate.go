@@ -0,0 +1,669 @@
+package fsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/go-lua"
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+)
+
+// Severity tells how serious the Diagnostic is. Errors are things that will
+// fail at runtime for sure, warnings are things that most likely are mistakes.
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "ERROR"
+	}
+	return "WARNING"
+}
+
+// Diagnostic is a single finding of the Machine.Validate. The location fields
+// tell where the problem is: State is the full path of the state, and it's
+// empty for machine level findings, e.g. the initial transition. Transition is an index to the State.Transitions or
+// -1 if finding is about the whole state. Event is "trigger", "sends[i]" or
+// empty when the finding is about the whole transition. Findings of the global
+// transitions are machine level, and Event starts with "global_transitions[i]".
+type Diagnostic struct {
+	Severity   Severity
+	State      string
+	Transition int
+	Event      string
+	Msg        string
+}
+
+func (d Diagnostic) String() string {
+	w := new(bytes.Buffer)
+	fmt.Fprintf(w, "%s: ", d.Severity)
+	switch {
+	case d.State == "" && d.Transition == -1:
+		fmt.Fprint(w, "machine")
+	case d.State == "":
+		fmt.Fprint(w, "initial")
+	default:
+		fmt.Fprint(w, d.State)
+		if d.Transition >= 0 {
+			fmt.Fprintf(w, ".transitions[%d]", d.Transition)
+		}
+	}
+	if d.Event != "" {
+		fmt.Fprintf(w, ".%s", d.Event)
+	}
+	fmt.Fprintf(w, ": %s", d.Msg)
+	return w.String()
+}
+
+// Diagnostics is a list of the Machine.Validate findings in the deterministic
+// order.
+type Diagnostics []Diagnostic
+
+// HasErrors tells if there is at least one SeverityError finding.
+func (ds Diagnostics) HasErrors() bool {
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Err returns error including all the SeverityError findings or nil if there
+// are none.
+func (ds Diagnostics) Err() error {
+	if !ds.HasErrors() {
+		return nil
+	}
+	msgs := make([]string, 0, len(ds))
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			msgs = append(msgs, d.String())
+		}
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+func (ds Diagnostics) String() string {
+	w := new(bytes.Buffer)
+	for _, d := range ds {
+		fmt.Fprintln(w, d)
+	}
+	return w.String()
+}
+
+var knownRules = map[string]struct{}{
+	TriggerTypeLua:                   {},
+	TriggerTypeOurMessage:            {},
+	TriggerTypeUseInput:              {},
+	TriggerTypeUseInputSave:          {},
+	TriggerTypeUseInputSaveConnID:    {},
+	TriggerTypeUseInputSaveSessionID: {},
+	TriggerTypeFormat:                {},
+	TriggerTypeFormatFromMem:         {},
+	TriggerTypePIN:                   {},
+	TriggerTypeData:                  {},
+	TriggerTypeValidateInputEqual:    {},
+	TriggerTypeValidateInputNotEqual: {},
+	TriggerTypeInputEqual:            {},
+	TriggerTypeAcceptAndInputValues:  {},
+	TriggerTypeNotAcceptValues:       {},
+	TriggerTypeVerifyAndInputValues:  {},
+	TriggerTypeNotVerifyValues:       {},
+	TriggerTypeTransient:             {},
+	TriggerTypeRoomJoin:              {},
+	TriggerTypeRoomLeave:             {},
+	TriggerTypeRoomList:              {},
+	TriggerTypeRoomForward:           {},
+}
+
+func rules(r ...string) map[string]struct{} {
+	m := make(map[string]struct{}, len(r))
+	for _, rule := range r {
+		m[rule] = struct{}{}
+	}
+	return m
+}
+
+var (
+	inputRules = []string{
+		TriggerTypeData,
+		TriggerTypeUseInput,
+		TriggerTypeUseInputSave,
+		TriggerTypeUseInputSaveConnID,
+		TriggerTypeUseInputSaveSessionID,
+		TriggerTypeValidateInputEqual,
+		TriggerTypeValidateInputNotEqual,
+		TriggerTypeInputEqual,
+		TriggerTypeLua,
+	}
+
+	// answerRules are the rules of the question triggers, see Event.Answers.
+	answerRules = []string{
+		TriggerTypeData,
+		TriggerTypeAcceptAndInputValues,
+		TriggerTypeNotAcceptValues,
+		TriggerTypeVerifyAndInputValues,
+		TriggerTypeNotVerifyValues,
+		TriggerTypeLua,
+	}
+
+	// triggerRules tells which rules each trigger protocol can handle. Rules
+	// that aren't listed here are ignored at runtime, i.e. they never trigger.
+	triggerRules = map[string]map[string]struct{}{
+		MessageBasicMessage: rules(append(inputRules, TriggerTypeTransient)...),
+		MessageBackend: rules(append(inputRules, TriggerTypeTransient,
+			TriggerTypeRoomJoin, TriggerTypeRoomLeave, TriggerTypeRoomList)...),
+		MessageIssueCred:    rules(append(answerRules, TriggerTypeOurMessage)...),
+		MessageConnection:   rules(TriggerTypeData, TriggerTypeOurMessage),
+		MessageTrustPing:    rules(append(answerRules, TriggerTypeOurMessage)...),
+		MessagePresentProof: rules(append(answerRules, TriggerTypeOurMessage)...),
+		MessageHook:         rules(TriggerTypeData, TriggerTypeUseInput),
+		MessageTransient:    rules(TriggerTypeData, TriggerTypeTransient),
+		MessageTimer:        rules(TriggerTypeData),
+		MessageEmail:        rules(TriggerTypeData),
+	}
+
+	// sendRules tells which rules each send protocol can build. Missing
+	// protocol means that sending with it isn't supported at all.
+	sendRules = map[string]map[string]struct{}{
+		MessageBasicMessage: rules(TriggerTypeData, TriggerTypeUseInput,
+			TriggerTypeFormat, TriggerTypeFormatFromMem, TriggerTypeLua),
+		MessageIssueCred:    rules(TriggerTypeData, TriggerTypeFormatFromMem),
+		MessagePresentProof: rules(TriggerTypeData, TriggerTypeFormatFromMem),
+		MessageAnswer:       rules(TriggerTypeData),
+		MessageEmail:        rules(TriggerTypePIN),
+		MessageHook: rules(TriggerTypeData, TriggerTypeUseInput,
+			TriggerTypeFormat, TriggerTypeFormatFromMem),
+		MessageBackend: rules(TriggerTypeData, TriggerTypeUseInput,
+			TriggerTypeFormat, TriggerTypeFormatFromMem, TriggerTypeLua,
+			TriggerTypeRoomForward),
+		MessageTransient: rules(TriggerTypeTransient),
+		MessageTrustPing: rules(TriggerTypeData),
+		MessageConnection: rules(TriggerTypeData,
+			TriggerTypeFormatFromMem),
+	}
+)
+
+// Validate checks the machine statically without running it and returns all
+// the findings. It can be called to the machine loaded from a file before
+// Initialize, and it doesn't change the machine. The findings are targets to
+// unknown states, unreachable and dead-end states, unknown protocols and rules,
+// rule/protocol combinations not supported, invalid templates of FORMAT_MEM
+// and GEN_PIN, invalid proof attributes, syntax errors of Lua scripts, and
+// invalid Lua config.
+func (m *Machine) Validate() Diagnostics {
+	v := &validator{m: m}
+	v.validate()
+	return v.ds
+}
+
+type validator struct {
+	m  *Machine
+	ds Diagnostics
+
+	state      string
+	transition int
+}
+
+func (v *validator) add(s Severity, event, format string, a ...any) {
+	v.ds = append(v.ds, Diagnostic{
+		Severity:   s,
+		State:      v.state,
+		Transition: v.transition,
+		Event:      event,
+		Msg:        fmt.Sprintf(format, a...),
+	})
+}
+
+// statePaths returns the full paths of all the states, parents first.
+func (v *validator) statePaths() []string {
+	var paths []string
+	v.m.walkStates(func(path string, _ *State) {
+		paths = append(paths, path)
+	})
+	return paths
+}
+
+func (v *validator) validate() {
+	v.transition = -1
+	if len(v.m.States) == 0 {
+		v.add(SeverityError, "", "machine doesn't have states")
+	}
+	if v.m.Initial == nil {
+		v.add(SeverityError, "", "machine doesn't have initial state")
+	} else {
+		v.transition = 0
+		v.validateTarget("", v.m.Initial)
+		for i, send := range v.m.Initial.Sends {
+			v.validateSendWithoutInput(fmt.Sprintf("sends[%d]", i), send)
+		}
+	}
+	for _, path := range v.statePaths() {
+		v.state = path
+		v.transition = -1
+		state := v.m.State(path)
+		if state == nil {
+			v.add(SeverityError, "", "state is empty")
+			continue
+		}
+		if state.IsComposite() {
+			if _, ok := state.States[state.Initial]; !ok {
+				v.add(SeverityError, "", "unknown initial state \"%s\"",
+					state.Initial)
+			}
+		}
+		for i, transition := range state.Transitions {
+			v.transition = i
+			if transition == nil {
+				v.add(SeverityError, "", "transition is empty")
+				continue
+			}
+			v.validateTarget("", transition)
+			v.validateTrigger("trigger", transition.Trigger)
+			for j, send := range transition.Sends {
+				v.validateSend(fmt.Sprintf("sends[%d]", j), send)
+			}
+		}
+		v.transition = -1
+		for i, send := range state.OnEntry {
+			v.validateSendWithoutInput(fmt.Sprintf("on_entry[%d]", i), send)
+		}
+		for i, send := range state.OnExit {
+			v.validateSendWithoutInput(fmt.Sprintf("on_exit[%d]", i), send)
+		}
+	}
+	v.state = ""
+	v.transition = -1
+	if v.m.Lua != nil {
+		v.validateLuaConfig()
+	}
+	for i, transition := range v.m.GlobalTransitions {
+		where := fmt.Sprintf("global_transitions[%d]", i)
+		if transition == nil {
+			v.add(SeverityError, where, "transition is empty")
+			continue
+		}
+		v.validateTarget(where, transition)
+		v.validateTrigger(where+".trigger", transition.Trigger)
+		for j, send := range transition.Sends {
+			v.validateSend(fmt.Sprintf("%s.sends[%d]", where, j), send)
+		}
+	}
+	v.validateGraph()
+}
+
+// validateSendWithoutInput validates sends which are built without an input
+// event like initial sends and state's on_entry and on_exit sends.
+func (v *validator) validateSendWithoutInput(where string, e *Event) {
+	v.validateSend(where, e)
+	if e == nil {
+		return
+	}
+	if err := checkSendWithoutInput(e); err != nil {
+		v.add(SeverityError, where, "%v", err)
+	}
+}
+
+func (v *validator) validateTarget(where string, t *Transition) {
+	if t.Target == "" {
+		v.add(SeverityError, where, "missing target")
+		return
+	}
+	if t.Target == TargetCurrent && t != v.m.Initial {
+		return
+	}
+	if _, ok := v.m.resolvePath(v.state, t.Target); !ok {
+		v.add(SeverityError, where, "unknown target state \"%s\"", t.Target)
+	}
+}
+
+func (v *validator) validateTrigger(where string, e *Event) {
+	if e == nil {
+		v.add(SeverityError, where, "missing trigger")
+		return
+	}
+	if !v.validateProtocolAndRule(where, e) {
+		return
+	}
+	if allowed, ok := triggerRules[e.Protocol]; !ok {
+		v.add(SeverityError, where, "protocol \"%s\" cannot be a trigger",
+			e.Protocol)
+	} else if _, ok := allowed[e.Rule]; !ok {
+		v.add(SeverityError, where, "rule \"%s\" isn't supported by \"%s\" trigger",
+			e.Rule, e.Protocol)
+	}
+	v.validateRoomRule(where, e)
+	if v.m.Type == MachineTypeBackend && isDIDCommProtocol(e.Protocol) {
+		v.add(SeverityWarning, where,
+			"backend machine doesn't receive \"%s\", it has no connection",
+			e.Protocol)
+	}
+	if e.TypeID != "" && isDIDCommProtocol(e.Protocol) &&
+		NotificationTypeID(e.TypeID) == 0 {
+		v.add(SeverityError, where, "unknown type_id \"%s\"", e.TypeID)
+	}
+	if qt, ok := QuestionTypeID[e.TypeID]; ok && questionProtocols[qt] != e.Protocol {
+		v.add(SeverityError, where, "type_id \"%s\" needs \"%s\" trigger",
+			e.TypeID, questionProtocols[qt])
+	}
+	if e.Protocol == MessageTimer {
+		if _, err := parseTimerDuration(e.Data); err != nil {
+			v.add(SeverityError, where, "%v", err)
+		}
+	}
+	switch e.Rule {
+	case TriggerTypeAcceptAndInputValues, TriggerTypeNotAcceptValues:
+		// the data is optional for the other questions than proof verify
+		if e.Data != "" || e.Protocol == MessagePresentProof &&
+			QuestionTypeID[e.TypeID] != agency.Question_PROOF_PROPOSE_WAITS {
+			v.validateProofAttrs(where, e.Data)
+		}
+	case TriggerTypeVerifyAndInputValues, TriggerTypeNotVerifyValues:
+		v.validateConstraints(where, e.Data)
+	case TriggerTypeLua:
+		v.validateLua(where, e.Data)
+	}
+}
+
+// questionProtocols are the trigger protocols of the question types.
+var questionProtocols = map[agency.Question_Type]string{
+	agency.Question_PING_WAITS:          MessageTrustPing,
+	agency.Question_ISSUE_PROPOSE_WAITS: MessageIssueCred,
+	agency.Question_PROOF_PROPOSE_WAITS: MessagePresentProof,
+	agency.Question_PROOF_VERIFY_WAITS:  MessagePresentProof,
+}
+
+func (v *validator) validateSend(where string, e *Event) {
+	if e == nil {
+		v.add(SeverityError, where, "send is empty")
+		return
+	}
+	if !v.validateProtocolAndRule(where, e) {
+		return
+	}
+	if allowed, ok := sendRules[e.Protocol]; !ok {
+		v.add(SeverityError, where, "sending \"%s\" isn't supported",
+			e.Protocol)
+	} else if _, ok := allowed[e.Rule]; !ok {
+		v.add(SeverityError, where, "rule \"%s\" isn't supported by \"%s\" send",
+			e.Rule, e.Protocol)
+	}
+	if _, ok := routes[e.Route]; !ok {
+		v.add(SeverityError, where, "unknown route \"%s\"", e.Route)
+	} else if e.Route != RouteConn && e.Protocol != MessageBackend {
+		v.add(SeverityError, where, "route is only for backend sends")
+	}
+	if e.Service != "" && (e.Protocol != MessageBackend ||
+		v.m.Type == MachineTypeBackend) {
+		v.add(SeverityError, where,
+			"service is only for backend sends of conversation machines")
+	}
+	v.validateRoomRule(where, e)
+	if v.m.Type == MachineTypeBackend && isPairwiseSend(e.Protocol) {
+		v.add(SeverityWarning, where,
+			"backend machine cannot send \"%s\", it has no connection",
+			e.Protocol)
+	}
+	switch e.Protocol {
+	case MessageIssueCred:
+		if e.EventData == nil || e.EventData.Issuing == nil {
+			v.add(SeverityError, where, "missing issuing data")
+		} else if e.Issuing.IsStructured() {
+			v.validateIssuing(where, e)
+		}
+	case MessagePresentProof:
+		if e.EventData != nil && e.Proof.IsStructured() {
+			v.validateProof(where, e)
+		} else if e.Rule != TriggerTypeFormatFromMem {
+			v.validateProofAttrs(where, e.Data)
+		}
+	case MessageBackend:
+		if e.EventData != nil && e.Backend != nil {
+			v.validateTemplate(where, e.Backend.ConnID)
+			v.validateTemplate(where, e.Backend.Subject)
+		}
+	case MessageAnswer:
+		if e.Data != "ACK" && e.Data != "NACK" {
+			v.add(SeverityError, where,
+				"answer data must be ACK or NACK, not \"%s\"", e.Data)
+		}
+	}
+	switch e.Rule {
+	case TriggerTypeFormatFromMem, TriggerTypePIN:
+		v.validateTemplate(where, e.Data)
+	case TriggerTypeLua:
+		v.validateLua(where, e.Data)
+	}
+}
+
+func (v *validator) validateProtocolAndRule(where string, e *Event) bool {
+	ok := true
+	if _, known := ProtocolType[e.Protocol]; !known || e.Protocol == MessageNone {
+		v.add(SeverityError, where, "unknown protocol \"%s\"", e.Protocol)
+		ok = false
+	}
+	if _, known := knownRules[e.Rule]; !known {
+		v.add(SeverityError, where, "unknown rule \"%s\"", e.Rule)
+		ok = false
+	}
+	return ok
+}
+
+func (v *validator) validateTemplate(where, data string) {
+	if _, err := parseTemplate(data); err != nil {
+		v.add(SeverityError, where, "%v", err)
+	}
+}
+
+func (v *validator) validateProofAttrs(where, data string) {
+	var attrs []ProofAttr
+	if err := json.Unmarshal([]byte(filterEnvs(data)), &attrs); err != nil {
+		v.add(SeverityError, where, "proof attributes: %v", err)
+	}
+}
+
+func (v *validator) validateConstraints(where, data string) {
+	constraints, err := parseConstraints(data)
+	if err != nil {
+		v.add(SeverityError, where, "%v", err)
+		return
+	}
+	for _, c := range constraints {
+		if c.Name == "" {
+			v.add(SeverityError, where, "attribute constraint without name")
+		}
+		if c.Regex != "" {
+			if _, err := regexp.Compile(c.Regex); err != nil {
+				v.add(SeverityError, where, "attribute %s: %v", c.Name, err)
+			}
+		}
+		if c.Min != nil && c.Max != nil && *c.Min > *c.Max {
+			v.add(SeverityError, where, "attribute %s: min is greater than max",
+				c.Name)
+		}
+		if c.Lua != "" {
+			v.validateLua(where, c.Lua)
+		}
+	}
+}
+
+// validateProof checks the structured proof request of the send.
+func (v *validator) validateProof(where string, e *Event) {
+	templates := e.Rule == TriggerTypeFormatFromMem
+	for _, attr := range e.Proof.Attributes {
+		if attr.Name == "" {
+			v.add(SeverityError, where, "proof attribute without name")
+		}
+		if templates {
+			v.validateTemplate(where, attr.Name)
+			v.validateTemplate(where, attr.CredDefID)
+		}
+	}
+	for _, p := range e.Proof.Predicates {
+		if p.Name == "" {
+			v.add(SeverityError, where, "proof predicate without name")
+		}
+		if _, ok := predicateTypes[p.Type]; !ok {
+			v.add(SeverityError, where, "unknown predicate type \"%s\"", p.Type)
+		}
+		if templates && strings.Contains(string(p.Value), "{{") {
+			v.validateTemplate(where, string(p.Value))
+		} else if _, err := strconv.ParseInt(string(p.Value), 10, 64); err != nil {
+			v.add(SeverityError, where, "predicate %s value must be integer, not \"%s\"",
+				p.Name, p.Value)
+		}
+	}
+}
+
+// validateIssuing checks the structured issuing of the send. The names are
+// checked against the cred def by CheckIssuings.
+func (v *validator) validateIssuing(where string, e *Event) {
+	names := make(map[string]struct{}, len(e.Issuing.Attributes))
+	for _, attr := range e.Issuing.Attributes {
+		if attr.Name == "" {
+			v.add(SeverityError, where, "issuing attribute without name")
+		} else if _, ok := names[attr.Name]; ok {
+			v.add(SeverityError, where, "duplicate issuing attribute \"%s\"",
+				attr.Name)
+		}
+		names[attr.Name] = struct{}{}
+		if e.Rule == TriggerTypeFormatFromMem {
+			v.validateTemplate(where, attr.Value)
+		}
+	}
+}
+
+func (v *validator) validateLua(where, data string) {
+	l := lua.NewState()
+	if err := lua.LoadString(l, filterFilelink(data)); err != nil {
+		v.add(SeverityError, where, "lua: %v", err)
+	}
+}
+
+func (v *validator) validateLuaConfig() {
+	const where = "lua"
+	c := *v.m.Lua // initialize sets defaults, don't change the machine
+	if err := c.initialize(); err != nil {
+		v.add(SeverityError, where, "%v", err)
+	}
+	if c.ErrorTarget != "" {
+		if _, ok := v.m.resolvePath("", c.ErrorTarget); !ok {
+			v.add(SeverityError, where, "unknown error target state \"%s\"",
+				c.ErrorTarget)
+		}
+	}
+}
+
+// validateGraph finds unreachable and dead-end states. The machine is always
+// in a leaf state, and the transitions of its parent states are available
+// there too. A composite state is reached when any of its children is. Note
+// that LUA triggers can set dynamic targets which we cannot know statically,
+// and that's why these are only warnings.
+func (v *validator) validateGraph() {
+	if v.m.Initial == nil {
+		return
+	}
+	// leaf resolves the target of the transition of the scope state to the
+	// leaf state where the machine moves.
+	leaf := func(scope, target string) string {
+		path, _ := v.m.resolvePath(scope, target)
+		return v.m.leafPath(path)
+	}
+	reached := make(map[string]bool)
+	queue := []string{leaf("", v.m.Initial.Target)}
+	// global transitions can be taken from every state and the initial
+	// state is always reached
+	globalTargets := make(map[string]bool, len(v.m.GlobalTransitions))
+	for _, transition := range v.m.GlobalTransitions {
+		if transition != nil && transition.Target != TargetCurrent {
+			target := leaf("", transition.Target)
+			globalTargets[target] = true
+			queue = append(queue, target)
+		}
+	}
+	if v.m.Lua.errorTarget() != "" {
+		queue = append(queue, leaf("", v.m.Lua.ErrorTarget))
+	}
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		if v.m.State(path) == nil || reached[path] {
+			continue
+		}
+		for p := path; p != ""; p = parentPath(p) {
+			reached[p] = true
+			state := v.m.State(p)
+			if state == nil {
+				continue
+			}
+			for _, transition := range state.Transitions {
+				if transition != nil {
+					queue = append(queue, leaf(p, transition.Target))
+				}
+			}
+		}
+	}
+	v.transition = -1
+	for _, path := range v.statePaths() {
+		v.state = path
+		state := v.m.State(path)
+		if !reached[path] {
+			v.add(SeverityWarning, "", "state is unreachable")
+		}
+		if state == nil || state.Terminate || state.IsComposite() {
+			continue
+		}
+		deadEnd := len(globalTargets) == 0 ||
+			len(globalTargets) == 1 && globalTargets[path]
+		for p := path; p != "" && deadEnd; p = parentPath(p) {
+			for _, transition := range v.m.State(p).Transitions {
+				if transition != nil && transition.Target != TargetCurrent &&
+					leaf(p, transition.Target) != path {
+					deadEnd = false
+					break
+				}
+			}
+		}
+		if deadEnd {
+			v.add(SeverityWarning, "", "dead-end state: it cannot be left and it isn't terminate state")
+		}
+	}
+}
+
+// validateRoomRule checks that only the backend machines use the room broker.
+func (v *validator) validateRoomRule(where string, e *Event) {
+	switch e.Rule {
+	case TriggerTypeRoomJoin, TriggerTypeRoomLeave, TriggerTypeRoomList,
+		TriggerTypeRoomForward:
+		if v.m.Type != MachineTypeBackend {
+			v.add(SeverityError, where, "rule \"%s\" is only for backend machines",
+				e.Rule)
+		}
+	}
+}
+
+// isPairwiseSend tells if the send needs the connection of the conversation.
+// The connection sends only create invitations.
+func isPairwiseSend(protocol string) bool {
+	return protocol == MessageAnswer ||
+		isDIDCommProtocol(protocol) && protocol != MessageConnection
+}
+
+func isDIDCommProtocol(protocol string) bool {
+	switch protocol {
+	case MessageConnection, MessageIssueCred, MessagePresentProof,
+		MessageTrustPing, MessageBasicMessage:
+		return true
+	}
+	return false
+}
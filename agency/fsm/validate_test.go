@@ -0,0 +1,138 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lainio/err2/assert"
+)
+
+const validMachineYAML = `
+name: valid machine
+initial:
+  target: IDLE
+  sends:
+  - protocol: basic_message
+    data: Hello!
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_SAVE
+        data: EMAIL
+      sends:
+      - protocol: basic_message
+        rule: FORMAT_MEM
+        data: "Your email is {{.EMAIL}}"
+      - protocol: email
+        rule: GEN_PIN
+        data: '{"to":"{{.EMAIL}}","body":"{{.PIN}}"}'
+      target: WAITING_PIN
+  WAITING_PIN:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_VALIDATE_EQUAL
+        data: PIN
+      sends:
+      - protocol: basic_message
+        rule: LUA
+        data: |
+          local i=getRegValue("MEM", "INPUT")
+          setRegValue("MEM", "OUTPUT", i)
+      target: DONE
+  DONE:
+    terminate: true
+`
+
+const brokenMachineYAML = `
+name: broken machine
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_mesage
+      sends:
+      - protocol: basic_message
+        data: Hi!
+      target: WAITING
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_EQUAL
+        data: pin
+      sends:
+      - protocol: basic_message
+        rule: GEN_PIN
+        data: "{{.PIN"
+      target: IDLE
+    - trigger:
+        protocol: basic_message
+        rule: LUA
+        data: "if then end"
+      sends:
+      - protocol: timer
+      target: IDLE
+  LONELY:
+    transitions:
+    - trigger:
+        protocol: present_proof
+        type_id: ANSWER_NEEDED_PROOF_VERIFY
+        rule: ACCEPT_AND_INPUT_VALUES
+        data: "not json"
+      target: LONELY
+`
+
+func TestMachine_Validate(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "valid.yaml", Data: []byte(validMachineYAML)})
+	ds := m.Validate()
+	assert.SLen(ds, 0, ds.String())
+	assert.NoError(ds.Err())
+
+	m = NewMachine(MachineData{FType: "broken.yaml", Data: []byte(brokenMachineYAML)})
+	ds = m.Validate()
+	assert.That(ds.HasErrors())
+	assert.Error(ds.Err())
+
+	type want struct {
+		severity   Severity
+		state      string
+		transition int
+		event      string
+		msg        string
+	}
+	wants := []want{
+		{SeverityError, "IDLE", 0, "", `unknown target state "WAITING"`},
+		{SeverityError, "IDLE", 0, "trigger", `unknown protocol "basic_mesage"`},
+		{SeverityError, "IDLE", 1, "sends[0]", `rule "GEN_PIN" isn't supported`},
+		{SeverityError, "IDLE", 1, "sends[0]", "template:"},
+		{SeverityError, "IDLE", 2, "trigger", "lua:"},
+		{SeverityError, "IDLE", 2, "sends[0]", `sending "timer" isn't supported`},
+		{SeverityError, "LONELY", 0, "trigger", "proof attributes:"},
+		{SeverityWarning, "LONELY", -1, "", "unreachable"},
+		{SeverityWarning, "LONELY", -1, "", "dead-end"},
+	}
+	assert.SLen(ds, len(wants), ds.String())
+	for i, w := range wants {
+		d := ds[i]
+		assert.Equal(d.Severity, w.severity, d.String())
+		assert.Equal(d.State, w.state, d.String())
+		assert.Equal(d.Transition, w.transition, d.String())
+		assert.Equal(d.Event, w.event, d.String())
+		assert.That(strings.Contains(d.Msg, w.msg), d.String())
+	}
+}
+
+func TestMachine_ValidateDoesntChangeMachine(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "valid.json", Data: []byte(
+		`{"initial":{"target":"IDLE"},"states":{"IDLE":{"terminate":true}}}`)})
+	assert.SLen(m.Validate(), 0)
+	assert.ThatNot(m.Initialized)
+	assert.Equal(m.Current, "")
+}
@@ -0,0 +1,152 @@
+package fsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// AttrConstraint is the expected attribute of the VERIFY_AND_INPUT_VALUES and
+// NOT_VERIFY_VALUES rules. The attribute must be in the proof, or in the
+// proposal, and all the given constraints must hold for its value:
+//
+//	equals: the value of the memory slot, e.g. the email user typed
+//	regex: the regular expression which must match the whole value
+//	one_of: the allowed values
+//	min, max: the numeric range, both inclusive
+//	lua: the script which gets the value as INPUT and sets OUTPUT to OK
+type AttrConstraint struct {
+	ProofAttr
+
+	Equals string   `json:"equals,omitempty"`
+	Regex  string   `json:"regex,omitempty"`
+	OneOf  []string `json:"one_of,omitempty"`
+	Min    *float64 `json:"min,omitempty"`
+	Max    *float64 `json:"max,omitempty"`
+	Lua    string   `json:"lua,omitempty"`
+
+	// regex is compiled Regex, and luaScript is Lua where the file link is
+	// already read. They are set by Initialize.
+	regex     *regexp.Regexp
+	luaScript string
+}
+
+func parseConstraints(data string) (constraints []AttrConstraint, err error) {
+	if err = json.Unmarshal([]byte(data), &constraints); err != nil {
+		return nil, fmt.Errorf("attribute constraints: %w", err)
+	}
+	return constraints, nil
+}
+
+// initConstraints parses the constraints of the verify rules and compiles
+// their regular expressions. The regular expression is anchored to match the
+// whole value.
+func (m *Machine) initConstraints() (err error) {
+	for _, e := range m.allEvents() {
+		if e.Rule != TriggerTypeVerifyAndInputValues &&
+			e.Rule != TriggerTypeNotVerifyValues {
+			continue
+		}
+		if e.constraints, err = parseConstraints(e.Data); err != nil {
+			return err
+		}
+		for i := range e.constraints {
+			c := &e.constraints[i]
+			if c.Regex == "" {
+				continue
+			}
+			if c.regex, err = regexp.Compile(`^(?:` + c.Regex + `)$`); err != nil {
+				return fmt.Errorf("attribute %s: %w", c.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// verifies answers with the verify rules. VERIFY_AND_INPUT_VALUES triggers if
+// all the constraints hold, and it copies the values to the memory.
+// NOT_VERIFY_VALUES triggers if any of them doesn't, and the reason is stored
+// to the ERR register that the answer can tell it.
+func (e Event) verifies(p *proposal) bool {
+	err := e.verify(p)
+	switch e.Rule {
+	case TriggerTypeVerifyAndInputValues:
+		if err != nil {
+			glog.V(1).Infoln("proof values not verified:", err)
+			return false
+		}
+		p.copyToMemory(e.Machine.Memory, true)
+		return true
+	case TriggerTypeNotVerifyValues:
+		if err == nil {
+			return false
+		}
+		p.copyToMemory(e.Machine.Memory, false)
+		e.Machine.Memory[LUA_ERROR] = err.Error()
+		return true
+	}
+	return false
+}
+
+// verify returns error if the values don't meet the constraints of the
+// trigger's data.
+func (e Event) verify(p *proposal) error {
+	for _, c := range e.constraints {
+		value, found := c.find(p.Values)
+		if !found {
+			return fmt.Errorf("attribute %s is missing", c.Name)
+		}
+		if err := e.check(c, value); err != nil {
+			return fmt.Errorf("attribute %s: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c AttrConstraint) find(values []proposedValue) (string, bool) {
+	for _, v := range values {
+		if v.Name == c.Name && (c.CredDefID == "" || c.CredDefID == v.CredDefID) {
+			return v.Value, true
+		}
+	}
+	return "", false
+}
+
+func (e Event) check(c AttrConstraint, value string) error {
+	if c.Equals != "" {
+		if expected, ok := e.Machine.Memory[c.Equals]; !ok || expected != value {
+			return fmt.Errorf("value doesn't equal %s", c.Equals)
+		}
+	}
+	if c.regex != nil && !c.regex.MatchString(value) {
+		return fmt.Errorf("value doesn't match %s", c.Regex)
+	}
+	if len(c.OneOf) > 0 && !slices.Contains(c.OneOf, value) {
+		return fmt.Errorf("value isn't allowed")
+	}
+	if c.Min != nil || c.Max != nil {
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return fmt.Errorf("value isn't number")
+		}
+		if c.Min != nil && n < *c.Min || c.Max != nil && n > *c.Max {
+			return fmt.Errorf("value is out of range")
+		}
+	}
+	if c.luaScript != "" {
+		e.Machine.Memory[LUA_INPUT] = value
+		delete(e.Machine.Memory, LUA_OUTPUT)
+		if err := e.Machine.runLua(c.luaScript); err != nil {
+			return err
+		}
+		if e.Machine.Memory[LUA_OUTPUT] != LUA_OK {
+			return fmt.Errorf("lua doesn't accept value")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package fsm
+
+import (
+	"strings"
+	"testing"
+
+	agency "github.com/findy-network/findy-common-go/grpc/agency/v1"
+	"github.com/lainio/err2/assert"
+	"github.com/lainio/err2/try"
+)
+
+const constraintMachineYAML = `
+name: verify machine
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: basic_message
+        rule: INPUT_SAVE
+        data: EMAIL
+      sends:
+      - protocol: present_proof
+        data: '[{"name":"email"},{"name":"country"},{"name":"age"}]'
+      target: WAITING_PROOF
+  WAITING_PROOF:
+    transitions:
+    - trigger:
+        protocol: present_proof
+        type_id: ANSWER_NEEDED_PROOF_VERIFY
+        rule: VERIFY_AND_INPUT_VALUES
+        data: |
+          [
+            {"name":"email","equals":"EMAIL","regex":".*@example\\.com"},
+            {"name":"country","one_of":["FI","SE"]},
+            {"name":"age","min":18,"max":120,
+             "lua":"if getRegValue('MEM','INPUT') ~= '99' then setRegValue('MEM','OUTPUT','OK') end"}
+          ]
+      sends:
+      - protocol: answer
+        data: ACK
+      target: DONE
+    - trigger:
+        protocol: present_proof
+        type_id: ANSWER_NEEDED_PROOF_VERIFY
+        rule: NOT_VERIFY_VALUES
+        data: |
+          [
+            {"name":"email","equals":"EMAIL","regex":".*@example\\.com"},
+            {"name":"country","one_of":["FI","SE"]},
+            {"name":"age","min":18,"max":120,
+             "lua":"if getRegValue('MEM','INPUT') ~= '99' then setRegValue('MEM','OUTPUT','OK') end"}
+          ]
+      sends:
+      - protocol: answer
+        data: NACK
+      - protocol: basic_message
+        rule: FORMAT_MEM
+        data: "Rejected: {{.ERR}}"
+      target: WAITING_PROOF
+  DONE:
+    terminate: true
+`
+
+func proofVerify(values ...string) *agency.Question {
+	q := question(agency.Question_PROOF_VERIFY_WAITS, agency.Protocol_PRESENT_PROOF, "conn")
+	attrs := make([]*agency.Question_ProofVerifyMsg_Attribute, 0, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		attrs = append(attrs, &agency.Question_ProofVerifyMsg_Attribute{
+			Name:  values[i],
+			Value: values[i+1],
+		})
+	}
+	q.Question = &agency.Question_ProofVerify{
+		ProofVerify: &agency.Question_ProofVerifyMsg{Attributes: attrs},
+	}
+	return q
+}
+
+func TestMachine_VerifyValues(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	m := NewMachine(MachineData{FType: "constraint.yaml", Data: []byte(constraintMachineYAML)})
+	assert.SLen(m.Validate(), 0)
+	try.To(m.Initialize())
+	m.InitLua()
+	m.Start(nil)
+	status := protocolStatus(agency.Protocol_BASIC_MESSAGE, "me@example.com")
+	transition := m.Triggers(status)
+	transition.BuildSendEvents(status)
+	m.Step(transition)
+	assert.Equal(m.Current, "WAITING_PROOF")
+
+	tests := []struct {
+		name   string
+		values []string
+		err    string // empty if accepted
+	}{
+		{"other email", []string{"email", "other@example.com", "country", "FI", "age", "30"},
+			"attribute email: value doesn't equal EMAIL"},
+		{"missing", []string{"email", "me@example.com", "age", "30"},
+			"attribute country is missing"},
+		{"not allowed", []string{"email", "me@example.com", "country", "NO", "age", "30"},
+			"attribute country: value isn't allowed"},
+		{"too young", []string{"email", "me@example.com", "country", "SE", "age", "17"},
+			"attribute age: value is out of range"},
+		{"not number", []string{"email", "me@example.com", "country", "SE", "age", "old"},
+			"attribute age: value isn't number"},
+		{"nan", []string{"email", "me@example.com", "country", "SE", "age", "NaN"},
+			"attribute age: value isn't number"},
+		{"inf", []string{"email", "me@example.com", "country", "SE", "age", "+Inf"},
+			"attribute age: value isn't number"},
+		{"lua", []string{"email", "me@example.com", "country", "SE", "age", "99"},
+			"attribute age: lua doesn't accept value"},
+		{"ok", []string{"email", "me@example.com", "country", "FI", "age", "30"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer assert.PushTester(t)()
+
+			q := proofVerify(tt.values...)
+			transition := m.Answers(q)
+			assert.NotNil(transition)
+			sends := transition.BuildSendAnswers(q.Status)
+			if tt.err == "" {
+				assert.Equal(transition.Target, "DONE")
+				assert.Equal(sends[0].Data, "ACK")
+				assert.Equal(m.Memory["country"], "FI")
+				return
+			}
+			assert.Equal(transition.Target, "WAITING_PROOF")
+			assert.Equal(m.Memory[LUA_ERROR], tt.err)
+			assert.Equal(sends[0].Data, "NACK")
+			assert.Equal(sends[1].BasicMessage.Content, "Rejected: "+tt.err)
+		})
+	}
+
+	// the regex must match the whole value
+	m.Memory["EMAIL"] = "me@example.com.evil"
+	q := proofVerify("email", "me@example.com.evil", "country", "FI", "age", "30")
+	assert.Equal(m.Answers(q).Target, "WAITING_PROOF")
+	assert.Equal(m.Memory[LUA_ERROR], `attribute email: value doesn't match .*@example\.com`)
+
+	// the missing memory slot doesn't equal the empty value
+	delete(m.Memory, "EMAIL")
+	q = proofVerify("email", "", "country", "FI", "age", "30")
+	assert.Equal(m.Answers(q).Target, "WAITING_PROOF")
+	assert.Equal(m.Memory[LUA_ERROR], "attribute email: value doesn't equal EMAIL")
+}
+
+func TestMachine_VerifyValuesInvalid(t *testing.T) {
+	defer assert.PushTester(t)()
+
+	const fsm = `
+initial:
+  target: IDLE
+states:
+  IDLE:
+    transitions:
+    - trigger:
+        protocol: present_proof
+        type_id: ANSWER_NEEDED_PROOF_VERIFY
+        rule: VERIFY_AND_INPUT_VALUES
+        data: '[{"name":"email","regex":"("},{"name":"age","min":2,"max":1},{"regex":"a"}]'
+      sends:
+      - protocol: answer
+        data: ACK
+      target: DONE
+  DONE:
+    terminate: true
+`
+	m := NewMachine(MachineData{FType: "verify.yaml", Data: []byte(fsm)})
+	ds := m.Validate()
+	assert.SLen(ds, 3)
+	assert.That(strings.HasPrefix(ds[0].Msg, "attribute email: error parsing regexp"), ds[0].Msg)
+	assert.Equal(ds[1].Msg, "attribute age: min is greater than max")
+	assert.Equal(ds[2].Msg, "attribute constraint without name")
+	assert.Error(m.Initialize())
+}
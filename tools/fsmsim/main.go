@@ -0,0 +1,112 @@
+// Command fsmsim runs FSM scenario files offline, see the sim package for the
+// file format.
+//
+//	fsmsim [flags] scenario.sim.yaml...
+//
+// With -coverage the state and transition coverage of the machines is printed
+// after the scenarios, and -require-full fails if any of them isn't fully
+// covered.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/findy-network/findy-common-go/agency/fsm"
+	"github.com/findy-network/findy-common-go/agency/fsm/sim"
+	"github.com/golang/glog"
+	_ "github.com/lainio/err2/assert" // we want an --asserter flag
+)
+
+var (
+	list        = flag.Bool("list", false, "print also the passed scenarios")
+	coverage    = flag.Bool("coverage", false, "print the coverage of the machines")
+	jsonOut     = flag.Bool("json", false, "print the coverage as JSON")
+	diagram     = flag.String("diagram", "", "print the coverage as diagram: plantuml or mermaid")
+	requireFull = flag.Bool("require-full", false, "fail if the machines aren't fully covered")
+)
+
+func main() {
+	glog.CopyStandardLogTo("ERROR") // for err2 binging
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"usage: %s [flags] scenario.sim.yaml...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := 0
+	var scenarios []*sim.Scenario
+	for _, fName := range flag.Args() {
+		sc, err := run(fName)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL\t%s\n%v\n", fName, err)
+		} else if *list {
+			fmt.Printf("ok\t%s\n", fName)
+		}
+		if sc != nil {
+			scenarios = append(scenarios, sc)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("FAIL\t%d/%d scenarios\n", failed, flag.NArg())
+		os.Exit(1)
+	}
+	fmt.Printf("ok\t%d scenarios\n", flag.NArg())
+
+	if *coverage || *jsonOut || *diagram != "" || *requireFull {
+		if !printCoverage(scenarios) && *requireFull {
+			fmt.Println("FAIL\tcoverage isn't full")
+			os.Exit(1)
+		}
+	}
+}
+
+func run(fName string) (*sim.Scenario, error) {
+	sc, err := sim.LoadScenario(fName)
+	if err != nil {
+		return nil, err
+	}
+	return sc, sc.Run()
+}
+
+// printCoverage prints the coverage reports of the machines according to the
+// flags, and returns true if all of them are fully covered.
+func printCoverage(scenarios []*sim.Scenario) (full bool) {
+	reports, err := sim.Reports(scenarios...)
+	if err != nil {
+		fmt.Printf("FAIL\tcoverage: %v\n", err)
+		os.Exit(1)
+	}
+	full = true
+	var jsonReports []*fsm.CoverageReport
+	for _, r := range reports {
+		report := r.Machine.CoverageReport(r.Coverage)
+		full = full && report.Full()
+		switch {
+		case *jsonOut:
+			jsonReports = append(jsonReports, report)
+		case *diagram == "plantuml":
+			fmt.Println(r.Machine.PlantUMLCoverage(r.Coverage))
+		case *diagram == "mermaid":
+			fmt.Println(r.Machine.MermaidCoverage(r.Coverage))
+		case *diagram != "":
+			fmt.Printf("unknown diagram: %s\n", *diagram)
+			os.Exit(2)
+		case *coverage:
+			fmt.Printf("coverage\t%s\n%s", r.File, report)
+		}
+	}
+	if *jsonOut {
+		data, _ := json.MarshalIndent(jsonReports, "", "  ")
+		fmt.Println(string(data))
+	}
+	return full
+}